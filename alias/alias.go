@@ -3,8 +3,10 @@ package alias
 import (
 	"context"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/zetamatta/nyagos/completion"
 	"github.com/zetamatta/nyagos/shell"
@@ -93,12 +95,6 @@ func (this *AliasFunc) Call(ctx context.Context, cmd *shell.Cmd) (next int, err
 		print("done cmd.Clone\n")
 	}
 
-	arg1 := shell.QuotedFirstWord(cmdline)
-	if strings.EqualFold(arg1, cmd.Args[0]) {
-		it.HookCount = 100
-	} else {
-		it.HookCount = cmd.HookCount + 1
-	}
 	if dbg {
 		print("it.Interpret\n")
 	}
@@ -109,15 +105,75 @@ func (this *AliasFunc) Call(ctx context.Context, cmd *shell.Cmd) (next int, err
 	return
 }
 
-var Table = map[string]Callable{}
+// Aliases is the table of the aliases of a session. A subshell gets
+// its copy.
+type Aliases struct {
+	mutex sync.Mutex
+	table map[string]Callable
+}
+
+// Get returns the alias `name`, which should be in lower case.
+func (this *Aliases) Get(name string) (Callable, bool) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	value, ok := this.table[name]
+	return value, ok
+}
+
+// Set defines the alias `name`, which should be in lower case.
+func (this *Aliases) Set(name string, value Callable) {
+	this.mutex.Lock()
+	this.table[name] = value
+	this.mutex.Unlock()
+}
+
+func (this *Aliases) Delete(name string) {
+	this.mutex.Lock()
+	delete(this.table, name)
+	this.mutex.Unlock()
+}
+
+// Names returns the names of the aliases sorted.
+func (this *Aliases) Names() []string {
+	this.mutex.Lock()
+	names := make([]string, 0, len(this.table))
+	for name := range this.table {
+		names = append(names, name)
+	}
+	this.mutex.Unlock()
+	sort.Strings(names)
+	return names
+}
+
+// Clone returns the copy of this for a subshell.
+func (this *Aliases) Clone() interface{} {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	table := make(map[string]Callable, len(this.table))
+	for name, value := range this.table {
+		table[name] = value
+	}
+	return &Aliases{table: table}
+}
+
+type tableKey struct{}
+
+// TableOf returns the aliases of the session.
+func TableOf(session *shell.Session) *Aliases {
+	return session.LoadOrStore(tableKey{}, &Aliases{table: map[string]Callable{}}).(*Aliases)
+}
+
 var paramMatch = regexp.MustCompile(`\$(\~)?(\*|[0-9]+)`)
 
+// AllNames returns the names of the aliases of shell.DefaultSession
+// for the completion.
 func AllNames() []completion.Element {
-	names := make([]completion.Element, 0, len(Table))
-	for name1, _ := range Table {
-		names = append(names, completion.Element{InsertStr: name1, ListupStr: name1})
+	names := TableOf(shell.DefaultSession).Names()
+	elements := make([]completion.Element, 0, len(names))
+	for _, name1 := range names {
+		elements = append(elements, completion.Element{InsertStr: name1, ListupStr: name1})
 	}
-	return names
+	return elements
 }
 
 func quoteAndJoin(list []string) string {
@@ -137,20 +193,26 @@ func quoteAndJoin(list []string) string {
 	return string(buffer)
 }
 
-var nextHook shell.HookT
-
-func hook(ctx context.Context, cmd *shell.Cmd) (int, bool, error) {
-	if cmd.HookCount > 5 {
-		return nextHook(ctx, cmd)
-	}
-	callee, ok := Table[strings.ToLower(cmd.Args[0])]
-	if !ok {
-		return nextHook(ctx, cmd)
-	}
-	next, err := callee.Call(ctx, cmd)
-	return next, true, err
+// InitSession makes the session expand the aliases.
+func InitSession(session *shell.Session) {
+	var nextHook shell.HookT
+	nextHook = session.SetHook(func(ctx context.Context, cmd *shell.Cmd) (int, bool, error) {
+		if cmd.IsCalling(cmd.Args[0]) {
+			// the alias is not expanded in itself.
+			return nextHook(ctx, cmd)
+		}
+		callee, ok := TableOf(cmd.Session()).Get(strings.ToLower(cmd.Args[0]))
+		if !ok {
+			return nextHook(ctx, cmd)
+		}
+		if err := cmd.EnterCall(cmd.Args[0]); err != nil {
+			return 255, true, err
+		}
+		next, err := callee.Call(ctx, cmd)
+		return next, true, err
+	})
 }
 
 func Init() {
-	nextHook = shell.SetHook(hook)
+	InitSession(shell.DefaultSession)
 }
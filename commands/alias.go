@@ -10,9 +10,12 @@ import (
 )
 
 func cmd_alias(ctx context.Context, cmd *shell.Cmd) (int, error) {
+	table := alias.TableOf(cmd.Session())
 	if len(cmd.Args) <= 1 {
-		for key, val := range alias.Table {
-			fmt.Fprintf(cmd.Stdout, "%s=%s\n", key, val.String())
+		for _, key := range table.Names() {
+			if val, ok := table.Get(key); ok {
+				fmt.Fprintf(cmd.Stdout, "%s=%s\n", key, val.String())
+			}
 		}
 		return 0, nil
 	}
@@ -21,13 +24,13 @@ func cmd_alias(ctx context.Context, cmd *shell.Cmd) (int, error) {
 			key := args[0:eqlPos]
 			val := args[eqlPos+1:]
 			if len(val) > 0 {
-				alias.Table[strings.ToLower(key)] = alias.New(val)
+				table.Set(strings.ToLower(key), alias.New(val))
 			} else {
-				delete(alias.Table, strings.ToLower(key))
+				table.Delete(strings.ToLower(key))
 			}
 		} else {
 			key := strings.ToLower(args)
-			val, ok := alias.Table[key]
+			val, ok := table.Get(key)
 			if ok {
 				fmt.Fprintf(cmd.Stdout, "%s=%s\n", key, val.String())
 			}
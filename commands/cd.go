@@ -7,29 +7,103 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/zetamatta/nyagos/dos"
 	"github.com/zetamatta/nyagos/shell"
 )
 
-var cd_history = make([]string, 0, 100)
-var cd_uniq = map[string]int{}
+// dirHistory is the directories which cd and pushd remember per session.
+// A subshell gets its copy.
+type dirHistory struct {
+	mutex      sync.Mutex
+	cd_history []string
+	cd_uniq    map[string]int
+	dirstack   []string
+}
+
+type dirHistoryKey struct{}
+
+func dirHistoryOf(cmd *shell.Cmd) *dirHistory {
+	return cmd.Session().LoadOrStore(dirHistoryKey{}, &dirHistory{
+		cd_history: make([]string, 0, 100),
+		cd_uniq:    map[string]int{},
+		dirstack:   make([]string, 0, 20),
+	}).(*dirHistory)
+}
+
+// Clone returns the copy of this for a subshell.
+func (this *dirHistory) Clone() interface{} {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	rv := &dirHistory{
+		cd_history: make([]string, len(this.cd_history), cap(this.cd_history)),
+		cd_uniq:    make(map[string]int, len(this.cd_uniq)),
+		dirstack:   make([]string, len(this.dirstack), cap(this.dirstack)),
+	}
+	copy(rv.cd_history, this.cd_history)
+	for key, val := range this.cd_uniq {
+		rv.cd_uniq[key] = val
+	}
+	copy(rv.dirstack, this.dirstack)
+	return rv
+}
+
+// cdHistory returns the copy of the directories which cd left.
+func (this *dirHistory) cdHistory() []string {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return append([]string{}, this.cd_history...)
+}
+
+// dirStack returns the copy of the stack of pushd.
+func (this *dirHistory) dirStack() []string {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return append([]string{}, this.dirstack...)
+}
+
+func (this *dirHistory) pushDir(dir string) {
+	this.mutex.Lock()
+	this.dirstack = append(this.dirstack, dir)
+	this.mutex.Unlock()
+}
+
+// popDir removes the top of the stack of pushd.
+func (this *dirHistory) popDir() {
+	this.mutex.Lock()
+	if len(this.dirstack) > 0 {
+		this.dirstack = this.dirstack[:len(this.dirstack)-1]
+	}
+	this.mutex.Unlock()
+}
+
+// swapDir replaces the top of the stack of pushd with dir.
+func (this *dirHistory) swapDir(dir string) {
+	this.mutex.Lock()
+	if len(this.dirstack) > 0 {
+		this.dirstack[len(this.dirstack)-1] = dir
+	}
+	this.mutex.Unlock()
+}
 
-func push_cd_history() {
+func (this *dirHistory) push_cd_history() {
 	directory, err := os.Getwd()
 	if err != nil {
 		return
 	}
-	if i, ok := cd_uniq[directory]; ok {
-		for ; i < len(cd_history)-1; i++ {
-			cd_history[i] = cd_history[i+1]
-			cd_uniq[cd_history[i]] = i
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if i, ok := this.cd_uniq[directory]; ok {
+		for ; i < len(this.cd_history)-1; i++ {
+			this.cd_history[i] = this.cd_history[i+1]
+			this.cd_uniq[this.cd_history[i]] = i
 		}
-		cd_history[i] = directory
-		cd_uniq[directory] = i
+		this.cd_history[i] = directory
+		this.cd_uniq[directory] = i
 	} else {
-		cd_uniq[directory] = len(cd_history)
-		cd_history = append(cd_history, directory)
+		this.cd_uniq[directory] = len(this.cd_history)
+		this.cd_history = append(this.cd_history, directory)
 	}
 }
 
@@ -63,14 +137,16 @@ func cmd_cd_sub(dir string) (int, error) {
 }
 
 func cmd_cd(ctx context.Context, cmd *shell.Cmd) (int, error) {
+	history := dirHistoryOf(cmd)
 	if len(cmd.Args) >= 2 {
+		cd_history := history.cdHistory()
 		if cmd.Args[1] == "-" {
 			if len(cd_history) < 1 {
 				return NO_HISTORY, errors.New("cd - : there is no previous directory")
 
 			}
 			directory := cd_history[len(cd_history)-1]
-			push_cd_history()
+			history.push_cd_history()
 			return cmd_cd_sub(directory)
 		} else if cmd.Args[1] == "--history" {
 			dir, dir_err := os.Getwd()
@@ -98,19 +174,19 @@ func cmd_cd(ctx context.Context, cmd *shell.Cmd) (int, error) {
 				return NO_HISTORY, fmt.Errorf("cd %s: too old history", cmd.Args[1])
 			}
 			directory := cd_history[i]
-			push_cd_history()
+			history.push_cd_history()
 			return cmd_cd_sub(directory)
 		}
 		if strings.EqualFold(cmd.Args[1], "/D") {
 			// ignore /D
 			cmd.Args = cmd.Args[1:]
 		}
-		push_cd_history()
+		history.push_cd_history()
 		return cmd_cd_sub(strings.Join(cmd.Args[1:], " "))
 	}
 	home := dos.GetHome()
 	if home != "" {
-		push_cd_history()
+		history.push_cd_history()
 		return cmd_cd_sub(home)
 	}
 	return cmd_pwd(ctx, cmd)
@@ -5,14 +5,14 @@ import (
 	"regexp"
 	"strings"
 
-	"github.com/zetamatta/go-findfile"
-
 	"github.com/zetamatta/nyagos/completion"
 	"github.com/zetamatta/nyagos/dos"
 	"github.com/zetamatta/nyagos/history"
 	"github.com/zetamatta/nyagos/shell"
 )
 
+// BuildInCommand is made by Init and not changed after that,
+// so all the sessions share it.
 var BuildInCommand map[string]func(context.Context, *shell.Cmd) (int, error)
 var unscoNamePattern = regexp.MustCompile("^__(.*)__$")
 
@@ -34,7 +34,8 @@ func Exec(ctx context.Context, cmd *shell.Cmd) (int, bool, error) {
 			return 0, false, nil
 		}
 	}
-	cmd.Args = findfile.Globs(cmd.Args)
+	cmd.GlobArgs()
+	cmd.Trace()
 	next, err := function(ctx, cmd)
 	return next, true, err
 }
@@ -68,10 +69,14 @@ func Init() {
 		"env":      cmd_env,
 		"erase":    cmd_del,
 		"exit":     cmd_exit,
+		"export":   cmd_export,
+		"fg":       cmd_fg,
 		"history":  history.CmdHistory,
-		"if":       cmd_if,
+		"jobs":     cmd_jobs,
+		"kill":     cmd_kill,
 		"ln":       cmd_ln,
 		"lnk":      cmd_lnk,
+		"local":    cmd_local,
 		"ls":       cmd_ls,
 		"md":       cmd_mkdir,
 		"mkdir":    cmd_mkdir,
@@ -83,12 +88,14 @@ func Init() {
 		"pwd":      cmd_pwd,
 		"rd":       cmd_rmdir,
 		"rem":      cmd_rem,
+		"return":   cmd_return,
 		"rmdir":    cmd_rmdir,
 		"set":      cmd_set,
 		"source":   cmd_source,
 		"su":       cmd_su,
 		"touch":    cmd_touch,
 		"type":     cmd_type,
+		"wait":     cmd_wait,
 		"which":    cmd_which,
 	}
 }
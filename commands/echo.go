@@ -3,6 +3,7 @@ package commands
 import (
 	"context"
 	"fmt"
+	"os"
 	"strings"
 
 	"github.com/mattn/go-isatty"
@@ -12,7 +13,7 @@ import (
 
 func cmd_echo(ctx context.Context, cmd *shell.Cmd) (int, error) {
 	fmt.Fprint(cmd.Stdout, strings.Join(cmd.Args[1:], " "))
-	if isatty.IsTerminal(cmd.Stdout.Fd()) {
+	if f, ok := cmd.Stdout.(*os.File); ok && isatty.IsTerminal(f.Fd()) {
 		fmt.Fprint(cmd.Stdout, "\n")
 	} else {
 		fmt.Fprint(cmd.Stdout, "\r\n")
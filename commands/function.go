@@ -0,0 +1,56 @@
+package commands
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/zetamatta/nyagos/completion"
+	"github.com/zetamatta/nyagos/shell"
+)
+
+// local NAME=VALUE ...
+func cmd_local(ctx context.Context, cmd *shell.Cmd) (int, error) {
+	for _, arg1 := range cmd.Args[1:] {
+		name := arg1
+		value := ""
+		if eqlPos := strings.IndexByte(arg1, '='); eqlPos >= 0 {
+			name = arg1[:eqlPos]
+			value = arg1[eqlPos+1:]
+		}
+		if name == "" {
+			return 1, fmt.Errorf("local: %s: invalid variable name", arg1)
+		}
+		if err := cmd.SetLocal(name, value); err != nil {
+			return 1, err
+		}
+	}
+	return 0, nil
+}
+
+// return [N]
+func cmd_return(ctx context.Context, cmd *shell.Cmd) (int, error) {
+	if !cmd.InFunction() {
+		return 1, errors.New("return: not in a function")
+	}
+	errorlevel := cmd.Session().LastErrorLevel()
+	if len(cmd.Args) >= 2 {
+		var err error
+		errorlevel, err = strconv.Atoi(cmd.Args[1])
+		if err != nil {
+			return 1, fmt.Errorf("return: %s: not a number", cmd.Args[1])
+		}
+	}
+	return errorlevel, shell.ErrReturn
+}
+
+func FunctionNames() []completion.Element {
+	functionNames := shell.FunctionNames()
+	names := make([]completion.Element, 0, len(functionNames))
+	for _, name1 := range functionNames {
+		names = append(names, completion.Element{InsertStr: name1, ListupStr: name1})
+	}
+	return names
+}
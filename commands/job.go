@@ -0,0 +1,111 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/zetamatta/nyagos/shell"
+)
+
+// jobs [-l]
+func cmd_jobs(ctx context.Context, cmd *shell.Cmd) (int, error) {
+	long := len(cmd.Args) >= 2 && cmd.Args[1] == "-l"
+	for _, job := range cmd.Session().Jobs() {
+		if long {
+			pids := []string{}
+			for _, pid := range job.Pids() {
+				pids = append(pids, strconv.Itoa(pid))
+			}
+			fmt.Fprintf(cmd.Stdout, "%s (pid:%s started:%s)\n",
+				job.String(),
+				strings.Join(pids, ","),
+				job.StartTime.Format("15:04:05"))
+		} else {
+			fmt.Fprintln(cmd.Stdout, job.String())
+		}
+	}
+	return 0, nil
+}
+
+// wait [%N ...]
+func cmd_wait(ctx context.Context, cmd *shell.Cmd) (int, error) {
+	var list []*shell.Job
+	if len(cmd.Args) <= 1 {
+		list = cmd.Session().Jobs()
+	} else {
+		for _, arg1 := range cmd.Args[1:] {
+			job, err := cmd.Session().FindJob(arg1)
+			if err != nil {
+				return 1, err
+			}
+			list = append(list, job)
+		}
+	}
+	errorlevel := 0
+	for _, job := range list {
+		var err error
+		errorlevel, err = job.Wait(ctx)
+		if err != nil {
+			return errorlevel, err
+		}
+	}
+	return errorlevel, nil
+}
+
+// fg [%N]
+func cmd_fg(ctx context.Context, cmd *shell.Cmd) (int, error) {
+	spec := ""
+	if len(cmd.Args) >= 2 {
+		spec = cmd.Args[1]
+	}
+	job, err := cmd.Session().FindJob(spec)
+	if err != nil {
+		return 1, err
+	}
+	fmt.Fprintln(cmd.Stderr, job.Command)
+	errorlevel, err := job.Wait(ctx)
+	if err == context.Canceled {
+		// Ctrl-C stops the job in foreground.
+		job.Kill()
+		errorlevel, err = job.Wait(context.Background())
+	}
+	return errorlevel, err
+}
+
+// kill [-f] %N|PID ...
+func cmd_kill(ctx context.Context, cmd *shell.Cmd) (int, error) {
+	force := false
+	for _, arg1 := range cmd.Args[1:] {
+		if arg1 == "-f" {
+			force = true
+			continue
+		}
+		if strings.HasPrefix(arg1, "%") {
+			job, err := cmd.Session().FindJob(arg1)
+			if err != nil {
+				return 1, err
+			}
+			if err := job.Kill(); err != nil {
+				return 1, err
+			}
+			continue
+		}
+		if _, err := strconv.Atoi(arg1); err != nil {
+			return 1, fmt.Errorf("kill: %s: not a process id or a job", arg1)
+		}
+		args := []string{"/PID", arg1}
+		if force {
+			args = append([]string{"/F"}, args...)
+		}
+		taskkill := exec.Command("taskkill.exe", args...)
+		taskkill.Stdout = cmd.Stdout
+		taskkill.Stderr = cmd.Stderr
+		if err := taskkill.Run(); err != nil {
+			return 1, err
+		}
+	}
+	return 0, nil
+}
@@ -10,14 +10,13 @@ import (
 	"github.com/zetamatta/nyagos/shell"
 )
 
-var dirstack = make([]string, 0, 20)
-
 const (
 	NO_DIRSTACK = 2
 	GETWD_FAIL  = 3
 )
 
 func cmd_dirs(ctx context.Context, cmd *shell.Cmd) (int, error) {
+	dirstack := dirHistoryOf(cmd).dirStack()
 	wd, err := os.Getwd()
 	if err != nil {
 		return GETWD_FAIL, err
@@ -31,6 +30,8 @@ func cmd_dirs(ctx context.Context, cmd *shell.Cmd) (int, error) {
 }
 
 func cmd_popd(ctx context.Context, cmd *shell.Cmd) (int, error) {
+	history := dirHistoryOf(cmd)
+	dirstack := history.dirStack()
 	if len(dirstack) <= 0 {
 		return NO_DIRSTACK, errors.New("popd: directory stack empty.")
 	}
@@ -38,22 +39,24 @@ func cmd_popd(ctx context.Context, cmd *shell.Cmd) (int, error) {
 	if err != nil {
 		return CHDIR_FAIL, err
 	}
-	dirstack = dirstack[:len(dirstack)-1]
+	history.popDir()
 	return cmd_dirs(ctx, cmd)
 }
 
 func cmd_pushd(ctx context.Context, cmd *shell.Cmd) (int, error) {
+	history := dirHistoryOf(cmd)
 	wd, err := os.Getwd()
 	if err != nil {
 		return GETWD_FAIL, err
 	}
 	if len(cmd.Args) >= 2 {
-		dirstack = append(dirstack, wd)
+		history.pushDir(wd)
 		_, err := cmd_cd_sub(cmd.Args[1])
 		if err != nil {
 			return CHDIR_FAIL, err
 		}
 	} else {
+		dirstack := history.dirStack()
 		if len(dirstack) <= 0 {
 			return NO_DIRSTACK, errors.New("pushd: directory stack empty.")
 		}
@@ -61,7 +64,7 @@ func cmd_pushd(ctx context.Context, cmd *shell.Cmd) (int, error) {
 		if err != nil {
 			return CHDIR_FAIL, err
 		}
-		dirstack[len(dirstack)-1] = wd
+		history.swapDir(wd)
 	}
 	return cmd_dirs(ctx, cmd)
 }
@@ -18,6 +18,7 @@ func cmd_pwd(ctx context.Context, cmd *shell.Cmd) (int, error) {
 		} else if cmd.Args[1] == "-L" || cmd.Args[1] == "-l" {
 			physical = false
 		} else if i, err := strconv.ParseInt(cmd.Args[1], 10, 0); err == nil && i < 0 {
+			cd_history := dirHistoryOf(cmd).cdHistory()
 			i += int64(len(cd_history))
 			if i < 0 {
 				return NO_HISTORY, fmt.Errorf("pwd %s: too old history", cmd.Args[1])
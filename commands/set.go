@@ -3,9 +3,11 @@ package commands
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"regexp"
 	"strings"
 
 	"github.com/zetamatta/nyagos/shell"
@@ -33,34 +35,109 @@ func shrink(values ...string) string {
 	return buffer.String()
 }
 
+// set [-l] [NAME[=VALUE]] or set /a EXPR
+// With -l, or when NAME is a shell variable already, the shell variable
+// is set instead of the environment variable.
 func cmd_set(ctx context.Context, cmd *shell.Cmd) (int, error) {
-	if len(cmd.Args) <= 1 {
-		for _, val := range os.Environ() {
+	args := cmd.Args[1:]
+	local := false
+	if len(args) > 0 && strings.EqualFold(args[0], "-l") {
+		local = true
+		args = args[1:]
+	} else if len(args) > 0 && strings.EqualFold(args[0], "/a") {
+		return cmd_set_arith(cmd, strings.Join(args[1:], " "))
+	}
+	if len(args) <= 0 {
+		values := os.Environ()
+		if local {
+			values = cmd.Vars()
+		}
+		for _, val := range values {
 			fmt.Fprintln(cmd.Stdout, val)
 		}
 		return 0, nil
 	}
-	arg := strings.Join(cmd.Args[1:], " ")
+	arg := strings.Join(args, " ")
 	eqlPos := strings.Index(arg, "=")
+	name := arg
+	if eqlPos >= 0 {
+		name = strings.TrimRight(arg[:eqlPos], "+^")
+	}
+	getenv := os.Getenv
+	setenv := func(name, value string) { os.Setenv(name, value) }
+	unsetenv := func(name string) { os.Unsetenv(name) }
+	if _, ok := cmd.LookupVar(name); ok || local {
+		getenv = func(name string) string {
+			value, _ := cmd.LookupVar(name)
+			return value
+		}
+		setenv = cmd.SetVar
+		unsetenv = cmd.UnsetVar
+	}
 	if eqlPos < 0 {
 		// set NAME
-		fmt.Fprintf(cmd.Stdout, "%s=%s\n", arg, os.Getenv(arg))
+		fmt.Fprintf(cmd.Stdout, "%s=%s\n", arg, getenv(arg))
 	} else if eqlPos >= 3 && arg[eqlPos-1] == '+' {
 		// set NAME+=VALUE
 		right := arg[eqlPos+1:]
 		left := arg[:eqlPos-1]
-		os.Setenv(left, shrink(os.Getenv(left), right))
+		setenv(left, shrink(getenv(left), right))
 	} else if eqlPos >= 3 && arg[eqlPos-1] == '^' {
 		// set NAME^=VALUE
 		right := arg[eqlPos+1:]
 		left := arg[:eqlPos-1]
-		os.Setenv(left, shrink(right, os.Getenv(left)))
+		setenv(left, shrink(right, getenv(left)))
 	} else if eqlPos+1 < len(arg) {
 		// set NAME=VALUE
-		os.Setenv(arg[:eqlPos], arg[eqlPos+1:])
+		setenv(arg[:eqlPos], arg[eqlPos+1:])
 	} else {
 		// set NAME=
-		os.Unsetenv(arg[:eqlPos])
+		unsetenv(arg[:eqlPos])
+	}
+	return 0, nil
+}
+
+var rxArithAssign = regexp.MustCompile(`(^|[^=!<>]|<<|>>)=($|[^=])`)
+
+// set /a EXPR
+// The value is printed when EXPR has no assignments.
+func cmd_set_arith(cmd *shell.Cmd, expr string) (int, error) {
+	if strings.TrimSpace(expr) == "" {
+		return 1, errors.New(shell.SYNTAX_ERROR)
+	}
+	value, err := cmd.EvalArith(expr)
+	if err != nil {
+		return 1, err
+	}
+	if !rxArithAssign.MatchString(expr) {
+		fmt.Fprintln(cmd.Stdout, value)
+	}
+	return 0, nil
+}
+
+// export NAME[=VALUE] ...
+// moves the shell variables to the environment variables.
+func cmd_export(ctx context.Context, cmd *shell.Cmd) (int, error) {
+	if len(cmd.Args) <= 1 {
+		for _, val := range os.Environ() {
+			fmt.Fprintln(cmd.Stdout, val)
+		}
+		return 0, nil
+	}
+	for _, arg1 := range cmd.Args[1:] {
+		if eqlPos := strings.IndexByte(arg1, '='); eqlPos > 0 {
+			name := arg1[:eqlPos]
+			cmd.UnsetVar(name)
+			if value := arg1[eqlPos+1:]; value != "" {
+				os.Setenv(name, value)
+			} else {
+				os.Unsetenv(name)
+			}
+		} else if !cmd.Export(arg1) {
+			if _, ok := os.LookupEnv(arg1); !ok {
+				return 1, fmt.Errorf("export: %s: not defined", arg1)
+			}
+		}
 	}
 	return 0, nil
 }
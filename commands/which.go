@@ -37,7 +37,13 @@ func cmd_which(ctx context.Context, cmd *shell.Cmd) (int, error) {
 			extList = envToList("", "PATHEXT")
 			continue
 		}
-		if a, ok := alias.Table[strings.ToLower(name)]; ok {
+		if _, ok := cmd.Session().Function(name); ok {
+			fmt.Fprintf(cmd.Stdout, "%s: shell function\n", name)
+			if !all {
+				continue
+			}
+		}
+		if a, ok := alias.TableOf(cmd.Session()).Get(strings.ToLower(name)); ok {
 			fmt.Fprintf(cmd.Stdout, "%s: aliased to %s\n", name, a.String())
 			if !all {
 				continue
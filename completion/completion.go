@@ -12,6 +12,7 @@ import (
 	"github.com/zetamatta/go-box"
 
 	"github.com/zetamatta/nyagos/readline"
+	"github.com/zetamatta/nyagos/shell"
 )
 
 type Element struct {
@@ -29,6 +30,30 @@ type List struct {
 
 var UseSlash = false
 
+// currentWord returns the word before the cursor as written, its position
+// in runes and whether it is the place of a command name.
+func currentWord(this *readline.Buffer) (string, int, bool) {
+	line := string(this.Buffer[:this.Cursor])
+	lexer := shell.NewLexer(line)
+	lexer.HistoryMark = 0
+	tokens := lexer.Tokens()
+
+	first := len(tokens)
+	if first > 0 && tokens[first-1].IsWord() && tokens[first-1].End == len(line) {
+		first--
+		for first > 0 && tokens[first-1].IsWord() && tokens[first-1].End == tokens[first].Pos {
+			first--
+		}
+	}
+	word, pos := "", this.Cursor
+	if first < len(tokens) {
+		word, pos = line[tokens[first].Pos:], tokens[first].RunePos
+	}
+	isCommand := first <= 0 ||
+		(tokens[first-1].Type == shell.TOKEN_OPERATOR && tokens[first-1].Text != ")")
+	return word, pos, isCommand
+}
+
 func listUpComplete(this *readline.Buffer) (*List, rune, error) {
 	var err error
 	rv := new(List)
@@ -44,7 +69,8 @@ func listUpComplete(this *readline.Buffer) (*List, rune, error) {
 	}
 
 	// filename or commandname completion
-	rv.RawWord, rv.Pos = this.CurrentWord()
+	var isCommand bool
+	rv.RawWord, rv.Pos, isCommand = currentWord(this)
 	found_delimter := false
 	rv.Word = strings.Map(func(c rune) rune {
 		if strings.ContainsRune(readline.Delimiters, c) {
@@ -60,10 +86,10 @@ func listUpComplete(this *readline.Buffer) (*List, rune, error) {
 
 	start := strings.LastIndexAny(rv.Word, ";=") + 1
 
-	if rv.Pos > 0 {
-		rv.List, err = listUpFiles(rv.Word[start:])
-	} else {
+	if isCommand {
 		rv.List, err = listUpCommands(rv.Word[start:])
+	} else {
+		rv.List, err = listUpFiles(rv.Word[start:])
 	}
 
 	for i := 0; i < len(rv.List); i++ {
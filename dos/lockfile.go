@@ -0,0 +1,42 @@
+package dos
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+var procLockFileEx = kernel32.NewProc("LockFileEx")
+var procUnlockFileEx = kernel32.NewProc("UnlockFileEx")
+
+const LOCKFILE_EXCLUSIVE_LOCK = 2
+
+// LockFile waits until it gets the exclusive lock of the whole file.
+func LockFile(fd *os.File) error {
+	var overlapped syscall.Overlapped
+	rc, _, err := procLockFileEx.Call(fd.Fd(),
+		uintptr(LOCKFILE_EXCLUSIVE_LOCK),
+		0,
+		0xFFFFFFFF,
+		0xFFFFFFFF,
+		uintptr(unsafe.Pointer(&overlapped)))
+	if rc == 0 {
+		return fmt.Errorf("LockFileEx: %s", err.Error())
+	}
+	return nil
+}
+
+// UnlockFile releases the lock by LockFile.
+func UnlockFile(fd *os.File) error {
+	var overlapped syscall.Overlapped
+	rc, _, err := procUnlockFileEx.Call(fd.Fd(),
+		0,
+		0xFFFFFFFF,
+		0xFFFFFFFF,
+		uintptr(unsafe.Pointer(&overlapped)))
+	if rc == 0 {
+		return fmt.Errorf("UnlockFileEx: %s", err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package dos
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+var procCreateNamedPipeW = kernel32.NewProc("CreateNamedPipeW")
+var procConnectNamedPipe = kernel32.NewProc("ConnectNamedPipe")
+
+const (
+	PIPE_ACCESS_INBOUND  = 1
+	PIPE_ACCESS_OUTBOUND = 2
+	ERROR_NO_DATA        = 232
+	ERROR_PIPE_CONNECTED = 535
+)
+
+// NamedPipe is the server of `\\.\pipe\NAME`, which the other processes
+// open as a file.
+type NamedPipe struct {
+	Path    string
+	inbound bool
+	file    *os.File
+}
+
+// NewNamedPipe makes the pipe for one client. When inbound is true,
+// the server reads what the client writes. Otherwise the client reads.
+func NewNamedPipe(name string, inbound bool) (*NamedPipe, error) {
+	path := `\\.\pipe\` + name
+	path16, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return nil, err
+	}
+	openMode := uintptr(PIPE_ACCESS_OUTBOUND)
+	if inbound {
+		openMode = PIPE_ACCESS_INBOUND
+	}
+	// PIPE_TYPE_BYTE|PIPE_WAIT, one instance and the buffers of 4KB
+	rc, _, err := procCreateNamedPipeW.Call(uintptr(unsafe.Pointer(path16)),
+		openMode, 0, 1, 4096, 4096, 0, 0)
+	if syscall.Handle(rc) == syscall.InvalidHandle {
+		return nil, fmt.Errorf("CreateNamedPipe: %s", err.Error())
+	}
+	return &NamedPipe{
+		Path:    path,
+		inbound: inbound,
+		file:    os.NewFile(rc, path),
+	}, nil
+}
+
+// Accept waits for the client to open Path and returns the server end.
+func (this *NamedPipe) Accept() (*os.File, error) {
+	// the client may open (and close) Path before ConnectNamedPipe.
+	rc, _, err := procConnectNamedPipe.Call(this.file.Fd(), 0)
+	if rc == 0 && err != syscall.Errno(ERROR_PIPE_CONNECTED) && err != syscall.Errno(ERROR_NO_DATA) {
+		this.file.Close()
+		return nil, fmt.Errorf("ConnectNamedPipe: %s", err.Error())
+	}
+	return this.file, nil
+}
+
+// Cancel makes Accept return when no client has opened Path, by opening
+// it as the client which closes at once. The server gets EOF or
+// the error of the broken pipe then.
+func (this *NamedPipe) Cancel() {
+	flag := os.O_RDONLY
+	if this.inbound {
+		flag = os.O_WRONLY
+	}
+	if fd, err := os.OpenFile(this.Path, flag, 0); err == nil {
+		fd.Close()
+	}
+}
@@ -0,0 +1,186 @@
+package history
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/zetamatta/nyagos/dos"
+)
+
+// File is the history file shared by the processes of nyagos.
+// The operations lock `PATH.lock` and read the records which the other
+// processes appended after the last operation, so the commands typed
+// in the other windows are seen before the next prompt.
+type File struct {
+	Path   string
+	offset int64       // the size of the records read
+	info   os.FileInfo // the file read, which the compaction replaces
+}
+
+// lock waits for the other processes to finish reading or writing
+// the history file and returns the function to unlock.
+func (this *File) lock() (func(), error) {
+	fd, err := os.OpenFile(this.Path+".lock", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := dos.LockFile(fd); err != nil {
+		fd.Close()
+		return nil, err
+	}
+	return func() {
+		dos.UnlockFile(fd)
+		fd.Close()
+	}, nil
+}
+
+// read reads the records after the offset. When the file is replaced
+// by the compaction of the other process, it reads all the records
+// again. reloaded is true then.
+func (this *File) read() (data []byte, reloaded bool, err error) {
+	fd, err := os.Open(this.Path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			// keep the lines read until the file is made again.
+			this.offset = 0
+			this.info = nil
+			err = nil
+		}
+		return nil, false, err
+	}
+	defer fd.Close()
+	info, err := fd.Stat()
+	if err != nil {
+		return nil, false, err
+	}
+	if this.info == nil || !os.SameFile(info, this.info) || info.Size() < this.offset {
+		this.offset = 0
+		reloaded = true
+	}
+	this.info = info
+	if _, err := fd.Seek(this.offset, io.SeekStart); err != nil {
+		return nil, reloaded, err
+	}
+	data, err = ioutil.ReadAll(fd)
+	if err != nil {
+		return nil, reloaded, err
+	}
+	// the record being written without the lock by the older versions
+	data = data[:bytes.LastIndexByte(data, '\n')+1]
+	this.offset += int64(len(data))
+	return data, reloaded, nil
+}
+
+// sync adds the records which the other processes appended to hisObj.
+func (this *File) sync(hisObj *Container) (bool, error) {
+	data, reloaded, err := this.read()
+	if err != nil {
+		return false, err
+	}
+	if reloaded {
+		hisObj.rows = nil
+		hisObj.LoadViaReader(bytes.NewReader(data))
+		return true, nil
+	}
+	for _, line := range bytes.Split(data, []byte{'\n'}) {
+		if row, err := parseLine(string(line)); err == nil && row.Text != "" {
+			hisObj.merge(row)
+		}
+	}
+	return false, nil
+}
+
+// Load reads the history file to hisObj. When the file has many
+// records duplicated or those of the old format, it is compacted.
+func (this *File) Load(hisObj *Container) error {
+	unlock, err := this.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	this.info = nil
+	this.offset = 0
+	data, _, err := this.read()
+	if err != nil {
+		return err
+	}
+	hisObj.rows = nil
+	hisObj.LoadViaReader(bytes.NewReader(data))
+
+	records := 0
+	migrated := false
+	for _, line := range bytes.Split(data, []byte{'\n'}) {
+		if len(line) > 0 {
+			records++
+			migrated = migrated || line[0] != '{'
+		}
+	}
+	if records <= max_histories*2 && !migrated {
+		return nil
+	}
+	return this.compact(hisObj)
+}
+
+// compact replaces the history file with the records of hisObj.
+// The other processes read the new file again on their next operation.
+func (this *File) compact(hisObj *Container) error {
+	tmpPath := this.Path + ".tmp"
+	fd, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	hisObj.SaveViaWriter(fd)
+	if err := fd.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Rename(tmpPath, this.Path); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("%s: %s", this.Path, err.Error())
+	}
+	this.info = nil
+	_, _, err = this.read()
+	return err
+}
+
+// Sync adds the records which the other processes appended after
+// the last operation to hisObj.
+func (this *File) Sync(hisObj *Container) error {
+	unlock, err := this.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	_, err = this.sync(hisObj)
+	return err
+}
+
+// Append reads the records of the other processes and appends row
+// to the history file. row replaces its duplicates in hisObj.
+func (this *File) Append(hisObj *Container, row Line) error {
+	unlock, err := this.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if _, err := this.sync(hisObj); err != nil {
+		return err
+	}
+	hisObj.merge(row)
+
+	fd, err := os.OpenFile(this.Path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(fd, row.String())
+	if err := fd.Close(); err != nil {
+		return err
+	}
+	// only the record of row is after the offset.
+	_, _, err = this.read()
+	return err
+}
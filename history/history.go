@@ -28,141 +28,78 @@ func (hisObj *Container) Replace(line string) (string, bool) {
 		mark = c
 		break
 	}
+	lexer := shell.NewLexer(line)
+	lexer.HistoryMark = mark
+	lexer.HistoryQuotes = DisableMarks
 
 	var buffer bytes.Buffer
 	isReplaced := false
-	reader := strings.NewReader(line)
-	history_count := hisObj.Len()
-
-	quotedChar := '\000'
-
-	for reader.Len() > 0 {
-		ch, _, _ := reader.ReadRune()
-		if quotedChar == '\000' && strings.IndexRune(DisableMarks, ch) >= 0 {
-			quotedChar = ch
-			buffer.WriteRune(ch)
-			continue
-		} else if ch == quotedChar {
-			quotedChar = '\000'
-			buffer.WriteRune(ch)
-			continue
-		}
-		if ch != mark || reader.Len() <= 0 || quotedChar != '\000' {
-			buffer.WriteRune(ch)
+	last := 0
+	for _, token := range lexer.Tokens() {
+		if token.Type != shell.TOKEN_HISTORY {
 			continue
 		}
-		ch, _, _ = reader.ReadRune()
-		if n := strings.IndexRune("^$:*", ch); n >= 0 {
-			reader.UnreadRune()
-			if history_count >= 1 {
-				line := hisObj.At(history_count - 1)
-				ExpandMacro(&buffer, reader, line)
-				isReplaced = true
-			}
-			continue
+		buffer.WriteString(line[last:token.Pos])
+		last = token.End
+		if text, ok := hisObj.expandEvent(token.Text[len(string(mark)):], mark); ok {
+			buffer.WriteString(text)
+			isReplaced = true
+		} else {
+			buffer.WriteString(token.Text)
 		}
-		if ch == mark { // !!
-			if history_count >= 1 {
-				line := hisObj.At(history_count - 1)
-				ExpandMacro(&buffer, reader, line)
-				isReplaced = true
-				continue
-			} else {
-				buffer.WriteRune(mark)
-				continue
-			}
-		}
-		if strings.IndexRune("0123456789", ch) >= 0 { // !n
-			reader.UnreadRune()
-			var backno int
-			fmt.Fscan(reader, &backno)
-			backno = backno % history_count
-			if 0 <= backno && backno < history_count {
-				line := hisObj.At(backno)
-				ExpandMacro(&buffer, reader, line)
-				isReplaced = true
-			}
-			continue
-		}
-		if ch == '-' && reader.Len() > 0 { // !-n
-			var number int
-			if _, err := fmt.Fscan(reader, &number); err == nil {
-				backno := history_count - number
-				for backno < 0 {
-					backno += history_count
-				}
-				if 0 <= backno && backno < history_count {
-					line := hisObj.At(backno)
-					ExpandMacro(&buffer, reader, line)
-					isReplaced = true
-				} else {
-					buffer.WriteRune(mark)
-					buffer.WriteString("-0")
-				}
-				continue
-			} else {
-				reader.UnreadRune() // next char of '-'
-			}
+	}
+	buffer.WriteString(line[last:])
+	return buffer.String(), isReplaced
+}
+
+// expandEvent returns the history which the text after the mark refers.
+func (hisObj *Container) expandEvent(event string, mark rune) (string, bool) {
+	history_count := hisObj.Len()
+	if history_count <= 0 {
+		return "", false
+	}
+	var buffer bytes.Buffer
+	reader := strings.NewReader(event)
+	ch, _, _ := reader.ReadRune()
+	switch {
+	case strings.ContainsRune("^$:*", ch):
+		reader.UnreadRune()
+		ExpandMacro(&buffer, reader, hisObj.At(history_count-1))
+	case ch == mark: // !!
+		ExpandMacro(&buffer, reader, hisObj.At(history_count-1))
+	case '0' <= ch && ch <= '9': // !n
+		reader.UnreadRune()
+		var backno int
+		fmt.Fscan(reader, &backno)
+		ExpandMacro(&buffer, reader, hisObj.At(backno%history_count))
+	case ch == '-' && len(event) > 1 && '0' <= event[1] && event[1] <= '9': // !-n
+		var number int
+		fmt.Fscan(reader, &number)
+		backno := history_count - number
+		for backno < 0 {
+			backno += history_count
 		}
-		if ch == '?' { // !?str?
-			var seekStrBuf bytes.Buffer
-			lastCharIsQuestionMark := false
-			for reader.Len() > 0 {
-				ch, _, _ := reader.ReadRune()
-				if ch == '?' {
-					lastCharIsQuestionMark = true
-					break
-				}
-				seekStrBuf.WriteRune(ch)
-			}
-			seekStr := seekStrBuf.String()
-			found := false
-			for i := history_count - 1; i >= 0; i-- {
-				his1 := hisObj.At(i)
-				if strings.Contains(his1, seekStr) {
-					buffer.WriteString(his1)
-					isReplaced = true
-					found = true
-					break
-				}
-			}
-			if !found {
-				buffer.WriteRune('?')
-				buffer.WriteString(seekStr)
-				if lastCharIsQuestionMark {
-					buffer.WriteRune('?')
-				}
-			}
-			continue
+		if backno >= history_count {
+			return "", false
 		}
-		// !str
-		var seekStrBuf bytes.Buffer
-		seekStrBuf.WriteRune(ch)
-		for reader.Len() > 0 {
-			ch, _, _ := reader.ReadRune()
-			if ch == ' ' {
-				reader.UnreadRune()
-				break
+		ExpandMacro(&buffer, reader, hisObj.At(backno))
+	case ch == '?': // !?str?
+		seekStr := strings.TrimSuffix(event[1:], "?")
+		for i := history_count - 1; i >= 0; i-- {
+			if his1 := hisObj.At(i); strings.Contains(his1, seekStr) {
+				return his1, true
 			}
-			seekStrBuf.WriteRune(ch)
 		}
-		seekStr := seekStrBuf.String()
-		found := false
+		return "", false
+	default: // !str
 		for i := history_count - 1; i >= 0; i-- {
-			his1 := hisObj.At(i)
-			if strings.HasPrefix(his1, seekStr) {
-				buffer.WriteString(his1)
-				isReplaced = true
-				found = true
-				break
+			if his1 := hisObj.At(i); strings.HasPrefix(his1, event) {
+				return his1, true
 			}
 		}
-		if !found {
-			buffer.WriteRune(mark)
-			buffer.WriteRune(ch)
-		}
+		return "", false
 	}
-	return buffer.String(), isReplaced
+	return buffer.String(), true
 }
 
 func ExpandMacro(buffer *bytes.Buffer, reader *strings.Reader, line string) {
@@ -222,7 +159,7 @@ func CmdHistory(ctx context.Context, cmd *shell.Cmd) (int, error) {
 
 	historyObj_ := ctx.Value(NoInstance)
 	if historyObj, ok := historyObj_.(*Container); ok {
-		if isatty.IsTerminal(cmd.Stdout.Fd()) && historyObj.Len() > num {
+		if f, ok := cmd.Stdout.(*os.File); ok && isatty.IsTerminal(f.Fd()) && historyObj.Len() > num {
 
 			start = historyObj.Len() - num
 		}
@@ -234,12 +171,17 @@ func CmdHistory(ctx context.Context, cmd *shell.Cmd) (int, error) {
 				dir = "~" + dir[len(home):]
 			}
 			dir = filepath.ToSlash(dir)
-			fmt.Fprintf(cmd.Stdout, "%4d  %s [%d] %-s (%s)\n",
+			var result string
+			if row.Duration > 0 {
+				result = fmt.Sprintf(" exit:%d %s", row.ExitCode, row.Duration.Round(time.Millisecond))
+			}
+			fmt.Fprintf(cmd.Stdout, "%4d  %s [%d] %-s (%s)%s\n",
 				i,
 				row.Stamp.Format("Jan _2 15:04:05"),
 				row.Pid,
 				row.Text,
-				dir)
+				dir,
+				result)
 		}
 	} else {
 		fmt.Fprintln(cmd.Stderr, "history not found (case 2)")
@@ -270,39 +212,31 @@ func (hisObj *Container) Save(path string) error {
 	return fd.Close()
 }
 
+// LoadViaReader reads the history file. The records of the old format
+// are migrated and written in the new one by the next Save.
 func (hisObj *Container) LoadViaReader(reader io.Reader) {
 	sc := bufio.NewScanner(reader)
-	list := make([][]string, 0, 2000)
+	sc.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	list := make([]*Line, 0, 2000)
 	hash := make(map[string]int)
 	for sc.Scan() {
-		line := sc.Text()
-		if lnum, ok := hash[line]; ok {
+		row, err := parseLine(sc.Text())
+		if err != nil {
+			continue
+		}
+
+		key := row.dedupKey()
+		if lnum, ok := hash[key]; ok {
 			// delete duplicated record (marking)
 			list[lnum] = nil
 		}
-		hash[line] = len(list)
-
-		p := strings.Split(line, "\t")
-		list = append(list, p)
+		hash[key] = len(list)
+		list = append(list, &row)
 	}
 	for _, p := range list {
 		// push only not duplicated record.
 		if p != nil {
-			var stamp time.Time
-			var dir string
-			pid := 0
-			if len(p) >= 3 {
-				dir = p[1]
-				stamp, _ = time.Parse("2006-01-02 15:04:05", p[2])
-				if len(p) >= 4 {
-					pid, _ = strconv.Atoi(p[3])
-				}
-			}
-			hisObj.PushLine(Line{
-				Text:  p[0],
-				Dir:   dir,
-				Stamp: stamp,
-				Pid:   pid})
+			hisObj.PushLine(*p)
 		}
 	}
 	sort.Slice(hisObj.rows, func(i, j int) bool {
@@ -2,8 +2,12 @@ package history
 
 import (
 	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 )
 
 type history_t struct {
@@ -72,28 +76,109 @@ func TestExpandMacro(t *testing.T) {
 	}
 }
 
-func TestLoadFromReader(t *testing.T) {
-	source := `aaaa
-aaaa
-bbbb
-bbbb
-cccc`
-	hisObj := &history_t{[]string{}}
-	LoadFromReader(strings.NewReader(source), hisObj)
+func TestLoadViaReader(t *testing.T) {
+	source := "aaaa\tC:\\\t2018-01-01 10:00:00\t100\n" +
+		"ls  -l|more\n" +
+		`{"v":1,"text":"bbbb\tcccc","dir":"C:\\","stamp":"2018-01-02T10:00:00Z","pid":200,"exitcode":3,"duration_ms":1500,"session":"200-1","host":"pc"}` + "\n" +
+		`{"v":1,"text":"ls -l | more","stamp":"2018-01-03T10:00:00Z"}` + "\n" +
+		"{broken\n"
+	hisObj := &Container{}
+	hisObj.LoadViaReader(strings.NewReader(source))
 	if hisObj.Len() != 3 || hisObj.At(0) != "aaaa" ||
-		hisObj.At(1) != "bbbb" || hisObj.At(2) != "cccc" {
+		hisObj.At(1) != "bbbb\tcccc" || hisObj.At(2) != "ls -l | more" {
 
-		t.Fail()
+		t.Fatalf("%#v", hisObj.rows)
 	}
-}
+	if row := hisObj.LineAt(0); row.Dir != `C:\` || row.Pid != 100 || row.Stamp.Hour() != 10 {
+		t.Errorf("migrated: %#v", row)
+	}
+	row := hisObj.LineAt(1)
+	if row.ExitCode != 3 || row.Duration != 1500*time.Millisecond ||
+		row.Session != "200-1" || row.Host != "pc" {
 
-func TestSaveToWriter(t *testing.T) {
-	hisObj := &history_t{
-		[]string{"aaaa", "bbbb", "aaaa", "dddd", "eeee"},
+		t.Errorf("json: %#v", row)
 	}
+}
+
+func TestSaveViaWriter(t *testing.T) {
+	hisObj := &Container{}
+	hisObj.PushLine(NewHistoryLine("echo a\tb"))
+	hisObj.PushLine(NewHistoryLine("if a==b (\necho c\n)"))
+	hisObj.Finish(1, 2, 3*time.Second)
+
 	var buffer bytes.Buffer
-	SaveToWriter(&buffer, hisObj)
-	if buffer.String() != "bbbb\naaaa\ndddd\neeee\n" {
-		t.Fail()
+	hisObj.SaveViaWriter(&buffer)
+	if n := strings.Count(buffer.String(), "\n"); n != 2 {
+		t.Fatalf("%d lines:\n%s", n, buffer.String())
+	}
+	loaded := &Container{}
+	loaded.LoadViaReader(&buffer)
+	if loaded.Len() != 2 {
+		t.Fatalf("%#v", loaded.rows)
+	}
+	for i := 0; i < 2; i++ {
+		expect := hisObj.LineAt(i)
+		row := loaded.LineAt(i)
+		if row.Text != expect.Text || row.ExitCode != expect.ExitCode ||
+			row.Duration != expect.Duration || row.Session != SessionId ||
+			!row.Stamp.Equal(expect.Stamp) {
+
+			t.Errorf("%#v\nexpect %#v", row, expect)
+		}
+	}
+}
+
+func TestFileShare(t *testing.T) {
+	dir, err := ioutil.TempDir("", "history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "nyagos.history")
+	ioutil.WriteFile(path, []byte("ls  -l\tC:\\\t2018-01-01 10:00:00\t100\n"), 0600)
+
+	file1, his1 := &File{Path: path}, &Container{}
+	file2, his2 := &File{Path: path}, &Container{}
+	if err := file1.Load(his1); err != nil {
+		t.Fatal(err)
+	}
+	// the old format is rewritten by file1.
+	if err := file2.Load(his2); err != nil {
+		t.Fatal(err)
+	}
+	if his2.Len() != 1 || his2.At(0) != "ls  -l" {
+		t.Fatalf("load: %#v", his2.rows)
+	}
+
+	his1.PushLine(NewHistoryLine("echo a"))
+	if err := file1.Append(his1, his1.LineAt(-1)); err != nil {
+		t.Fatal(err)
+	}
+	his2.PushLine(NewHistoryLine("ls -l"))
+	if err := file2.Append(his2, his2.LineAt(-1)); err != nil {
+		t.Fatal(err)
+	}
+	if his2.Len() != 2 || his2.At(0) != "echo a" || his2.At(1) != "ls -l" {
+		t.Fatalf("append: %#v", his2.rows)
+	}
+	if err := file1.Sync(his1); err != nil {
+		t.Fatal(err)
+	}
+	if his1.Len() != 2 || his1.At(0) != "echo a" || his1.At(1) != "ls -l" {
+		t.Fatalf("sync: %#v", his1.rows)
+	}
+
+	// the file replaced by the compaction is read again.
+	his3 := &Container{}
+	his3.PushLine(NewHistoryLine("dir"))
+	file3 := &File{Path: path}
+	if err := file3.compact(his3); err != nil {
+		t.Fatal(err)
+	}
+	if err := file1.Sync(his1); err != nil {
+		t.Fatal(err)
+	}
+	if his1.Len() != 1 || his1.At(0) != "dir" {
+		t.Fatalf("compact: %#v", his1.rows)
 	}
 }
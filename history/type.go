@@ -1,16 +1,33 @@
 package history
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
+	"strconv"
+	"strings"
 	"time"
+
+	"github.com/zetamatta/nyagos/shell"
 )
 
+// RECORD_VERSION is the version of the records in the history file.
+const RECORD_VERSION = 1
+
 type Line struct {
 	Text  string
 	Dir   string
 	Stamp time.Time
 	Pid   int
+
+	// ExitCode and Duration are set after the command-line runs.
+	// They are zero for the lines migrated from the old history file.
+	ExitCode int
+	Duration time.Duration
+	Session  string // the id of the process which read the line
+	Host     string
+
+	key string // the cache of dedupKey
 }
 
 type Container struct {
@@ -19,15 +36,24 @@ type Container struct {
 
 var NoInstance = &Container{}
 
+// SessionId identifies this process in the history shared with
+// the other ones.
+var SessionId = fmt.Sprintf("%d-%d", os.Getpid(), time.Now().Unix())
+
 func (this *Container) Len() int {
 	return len(this.rows)
 }
 
 func (this *Container) At(n int) string {
+	return this.LineAt(n).Text
+}
+
+// LineAt returns the n-th line. n < 0 counts from the last.
+func (this *Container) LineAt(n int) Line {
 	for n < 0 {
 		n += len(this.rows)
 	}
-	return this.rows[n%len(this.rows)].Text
+	return this.rows[n%len(this.rows)]
 }
 
 func (this *Container) Push(line string) {
@@ -38,12 +64,100 @@ func (this *Container) PushLine(row Line) {
 	this.rows = append(this.rows, row)
 }
 
+// dedupKey returns the text in the canonical form. The lines which have
+// the same key are duplicated.
+func (row *Line) dedupKey() string {
+	if row.key == "" {
+		row.key = row.Text
+		if formatted, err := shell.FormatText(row.Text); err == nil {
+			row.key = formatted
+		}
+	}
+	return row.key
+}
+
+// merge appends row removing the older lines duplicated with it.
+func (this *Container) merge(row Line) {
+	key := row.dedupKey()
+	rows := this.rows[:0]
+	for i := range this.rows {
+		if this.rows[i].dedupKey() != key {
+			rows = append(rows, this.rows[i])
+		}
+	}
+	this.rows = append(rows, row)
+}
+
+// Finish sets the exit code and the duration of the n-th line
+// after it runs, and returns the line.
+func (this *Container) Finish(n, exitCode int, duration time.Duration) Line {
+	this.rows[n].ExitCode = exitCode
+	this.rows[n].Duration = duration
+	return this.rows[n]
+}
+
+// record is a line of the history file in JSON Lines.
+type record struct {
+	Version    int       `json:"v"`
+	Text       string    `json:"text"`
+	Dir        string    `json:"dir"`
+	Stamp      time.Time `json:"stamp"`
+	Pid        int       `json:"pid"`
+	ExitCode   int       `json:"exitcode"`
+	DurationMs int64     `json:"duration_ms"`
+	Session    string    `json:"session,omitempty"`
+	Host       string    `json:"host,omitempty"`
+}
+
+// String returns the record of row in the history file.
 func (row *Line) String() string {
-	return fmt.Sprintf("%s\t%s\t%s\t%d",
-		row.Text,
-		row.Dir,
-		row.Stamp.Format("2006-01-02 15:04:05"),
-		row.Pid)
+	bin, err := json.Marshal(&record{
+		Version:    RECORD_VERSION,
+		Text:       row.Text,
+		Dir:        row.Dir,
+		Stamp:      row.Stamp,
+		Pid:        row.Pid,
+		ExitCode:   row.ExitCode,
+		DurationMs: int64(row.Duration / time.Millisecond),
+		Session:    row.Session,
+		Host:       row.Host,
+	})
+	if err != nil {
+		return "{}"
+	}
+	return string(bin)
+}
+
+// parseLine reads a record of the history file. The records not
+// starting with `{` are `TEXT<TAB>DIR<TAB>STAMP<TAB>PID` of the
+// older versions.
+func parseLine(text string) (Line, error) {
+	if !strings.HasPrefix(text, "{") {
+		p := strings.Split(text, "\t")
+		row := Line{Text: p[0]}
+		if len(p) >= 3 {
+			row.Dir = p[1]
+			row.Stamp, _ = time.ParseInLocation("2006-01-02 15:04:05", p[2], time.Local)
+			if len(p) >= 4 {
+				row.Pid, _ = strconv.Atoi(p[3])
+			}
+		}
+		return row, nil
+	}
+	var r record
+	if err := json.Unmarshal([]byte(text), &r); err != nil {
+		return Line{}, err
+	}
+	return Line{
+		Text:     r.Text,
+		Dir:      r.Dir,
+		Stamp:    r.Stamp,
+		Pid:      r.Pid,
+		ExitCode: r.ExitCode,
+		Duration: time.Duration(r.DurationMs) * time.Millisecond,
+		Session:  r.Session,
+		Host:     r.Host,
+	}, nil
 }
 
 func NewHistoryLine(text string) Line {
@@ -51,5 +165,13 @@ func NewHistoryLine(text string) Line {
 	if err != nil {
 		wd = ""
 	}
-	return Line{Text: text, Dir: wd, Stamp: time.Now(), Pid: os.Getpid()}
+	host, _ := os.Hostname()
+	return Line{
+		Text:    text,
+		Dir:     wd,
+		Stamp:   time.Now(),
+		Pid:     os.Getpid(),
+		Session: SessionId,
+		Host:    host,
+	}
 }
@@ -47,6 +47,23 @@ func (this BoolProperty) Set(L Lua, index int) error {
 	return nil
 }
 
+type IntProperty struct {
+	Pointer *int
+}
+
+func (this IntProperty) Push(L Lua) int {
+	L.PushInteger(Integer(*this.Pointer))
+	return 1
+}
+
+func (this IntProperty) Set(L Lua, index int) error {
+	n, err := L.ToInteger(index)
+	if err == nil {
+		*this.Pointer = n
+	}
+	return err
+}
+
 type MetaOnlyTableT struct {
 	Name  string
 	Table TTable
@@ -164,12 +164,26 @@ func barNyagos(it InterpreterT, folder string, L lua.Lua) {
 	}
 	defer fd.Close()
 	scanner := bufio.NewScanner(fd)
+	command := ""
 	for scanner.Scan() {
-		text := scanner.Text()
-		text = doLuaFilter(L, text)
+		text := doLuaFilter(L, scanner.Text())
+		if command != "" {
+			text = shell.ContinueLine(command, text)
+		}
+		if _, err := shell.Parse(text); shell.IsIncomplete(err) {
+			// the lines of if/for/while-blocks, quotations and so on
+			command = text
+			continue
+		}
+		command = ""
 		_, err := it.Interpret(text)
 		if err != nil {
 			fmt.Fprint(os.Stderr, err.Error())
 		}
 	}
+	if command != "" {
+		if _, err := it.Interpret(command); err != nil {
+			fmt.Fprint(os.Stderr, err.Error())
+		}
+	}
 }
@@ -33,6 +33,14 @@ func getRegInt(L lua.Lua) *shell.Cmd {
 	return rc
 }
 
+// getSession returns the session of the interpreter calling L.
+func getSession(L lua.Lua) *shell.Session {
+	if it := getRegInt(L); it != nil {
+		return it.Session()
+	}
+	return shell.DefaultSession
+}
+
 func NyagosCallLua(L lua.Lua, it *shell.Cmd, nargs int, nresult int) error {
 	save := getRegInt(L)
 	setRegInt(L, it)
@@ -117,8 +125,67 @@ func on_command_not_found(inte *shell.Cmd, err error) error {
 	}
 }
 
+// boolOption is the option of the session which calls Lua.
+type boolOption struct {
+	get func(*shell.Session) bool
+	set func(*shell.Session, bool)
+}
+
+func (this boolOption) Push(L lua.Lua) int {
+	L.PushBool(this.get(getSession(L)))
+	return 1
+}
+
+func (this boolOption) Set(L lua.Lua, index int) error {
+	this.set(getSession(L), L.ToBool(index))
+	return nil
+}
+
+type intOption struct {
+	get func(*shell.Session) int
+	set func(*shell.Session, int)
+}
+
+func (this intOption) Push(L lua.Lua) int {
+	L.PushInteger(lua.Integer(this.get(getSession(L))))
+	return 1
+}
+
+func (this intOption) Set(L lua.Lua, index int) error {
+	n, err := L.ToInteger(index)
+	if err == nil {
+		this.set(getSession(L), n)
+	}
+	return err
+}
+
+type stringOption struct {
+	get func(*shell.Session) string
+	set func(*shell.Session, string)
+}
+
+func (this stringOption) Push(L lua.Lua) int {
+	L.PushString(this.get(getSession(L)))
+	return 1
+}
+
+func (this stringOption) Set(L lua.Lua, index int) error {
+	s, err := L.ToString(index)
+	if err == nil {
+		this.set(getSession(L), s)
+	}
+	return err
+}
+
 var option_table_member = map[string]IProperty{
-	"glob": &lua.BoolProperty{Pointer: &shell.WildCardExpansionAlways},
+	"glob":          boolOption{(*shell.Session).WildCardExpansionAlways, (*shell.Session).SetWildCardExpansionAlways},
+	"pipefail":      boolOption{(*shell.Session).PipeFail, (*shell.Session).SetPipeFail},
+	"errexit":       boolOption{(*shell.Session).ExitOnError, (*shell.Session).SetExitOnError},
+	"xtrace":        boolOption{(*shell.Session).XTrace, (*shell.Session).SetXTrace},
+	"xtrace_prefix": stringOption{(*shell.Session).XTracePrefix, (*shell.Session).SetXTracePrefix},
+	"reporttime":    intOption{(*shell.Session).ReportTime, (*shell.Session).SetReportTime},
+	"nullglob":      boolOption{(*shell.Session).GlobNull, (*shell.Session).SetGlobNull},
+	"caseglob":      boolOption{(*shell.Session).GlobCaseSensitive, (*shell.Session).SetGlobCaseSensitive},
 }
 
 func getOption(L lua.Lua) int {
@@ -327,8 +394,7 @@ func NewLua() (lua.Lua, error) {
 	if !hook_setuped {
 		orgArgHook = shell.SetArgsHook(newArgHook)
 
-		orgOnCommandNotFound = shell.OnCommandNotFound
-		shell.OnCommandNotFound = on_command_not_found
+		orgOnCommandNotFound = shell.SetOnCommandNotFound(on_command_not_found)
 		hook_setuped = true
 	}
 	return this, nil
@@ -389,6 +455,7 @@ func init() {
 		"eval":         lua.TGoFunction(cmdEval),
 		"exec":         lua.TGoFunction(cmdExec),
 		"filter":       lua.Property{Pointer: &luaFilter},
+		"format":       lua.TGoFunction(cmdFormat),
 		"getalias":     lua.TGoFunction(cmdGetAlias),
 		"getenv":       lua.TGoFunction(cmdGetEnv),
 		"gethistory":   lua.TGoFunction(cmdGetHistory),
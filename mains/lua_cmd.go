@@ -14,6 +14,7 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 	"unicode"
 
 	"github.com/mattn/go-colorable"
@@ -26,6 +27,7 @@ import (
 	"github.com/zetamatta/nyagos/alias"
 	"github.com/zetamatta/nyagos/completion"
 	"github.com/zetamatta/nyagos/dos"
+	"github.com/zetamatta/nyagos/history"
 	"github.com/zetamatta/nyagos/lua"
 	"github.com/zetamatta/nyagos/readline"
 	"github.com/zetamatta/nyagos/shell"
@@ -45,7 +47,18 @@ func (this *LuaBinaryChank) Call(ctx context.Context, cmd *shell.Cmd) (int, erro
 		return 255, errors.New("LuaBinaryChank.Call: Lua instance not found")
 	}
 
-	if f := cmd.Stdout; f != os.Stdout && f != os.Stderr {
+	if w := cmd.Stdout; w != os.Stdout && w != os.Stderr {
+		f, done, err := shell.FileWriter(w)
+		if err != nil {
+			return 255, err
+		}
+		defer func() {
+			// io.write of Lua is buffered by the C runtime.
+			if L.LoadString("io.output():flush()") == nil {
+				L.Call(0, 0)
+			}
+			done()
+		}()
 		L.GetGlobal("io")        // +1
 		L.GetField(-1, "output") // +1 (get function pointer)
 		if err := L.PushFileWriter(f); err != nil {
@@ -55,7 +68,12 @@ func (this *LuaBinaryChank) Call(ctx context.Context, cmd *shell.Cmd) (int, erro
 		L.Call(1, 0)
 		L.Pop(1) // remove io-table
 	}
-	if f := cmd.Stdin; f != os.Stdin {
+	if r := cmd.Stdin; r != os.Stdin {
+		f, done, err := shell.FileReader(r)
+		if err != nil {
+			return 255, err
+		}
+		defer done()
 		L.GetGlobal("io")       // +1
 		L.GetField(-1, "input") // +1 (get function pointer)
 		if err := L.PushFileReader(f); err != nil {
@@ -139,13 +157,13 @@ func cmdSetAlias(L lua.Lua) int {
 	case lua.LUA_TSTRING:
 		value, err := L.ToString(-1)
 		if err == nil {
-			alias.Table[key] = alias.New(value)
+			alias.TableOf(getSession(L)).Set(key, alias.New(value))
 		} else {
 			return L.Push(nil, err)
 		}
 	case lua.LUA_TFUNCTION:
 		chank := L.Dump()
-		alias.Table[key] = &LuaBinaryChank{Chank: chank}
+		alias.TableOf(getSession(L)).Set(key, &LuaBinaryChank{Chank: chank})
 	}
 	return L.Push(true)
 }
@@ -155,7 +173,7 @@ func cmdGetAlias(L lua.Lua) int {
 	if nameErr != nil {
 		return L.Push(nil, nameErr)
 	}
-	value, ok := alias.Table[name]
+	value, ok := alias.TableOf(getSession(L)).Get(name)
 	if !ok {
 		L.PushNil()
 		return 1
@@ -193,7 +211,13 @@ func cmdGetEnv(L lua.Lua) int {
 	if nameErr != nil {
 		return L.Push(nil)
 	}
-	value, ok := shell.OurGetEnv(name)
+	var value string
+	var ok bool
+	if it := getRegInt(L); it != nil {
+		value, ok = it.GetEnv(name)
+	} else {
+		value, ok = shell.OurGetEnv(name)
+	}
 	if ok && len(value) > 0 {
 		L.PushString(value)
 	} else {
@@ -243,9 +267,60 @@ func cmdExec(L lua.Lua) int {
 		}
 		errorlevel, err = it.Interpret(statement)
 	}
+	if e, ok := err.(*shell.ParseError); ok {
+		L.Push(int(errorlevel))
+		pushParseError(L, e)
+		return 2
+	}
 	return L.Push(int(errorlevel), err)
 }
 
+// pushParseError pushes the table which has the fields of the syntax
+// error. tostring() of it returns the message.
+func pushParseError(L lua.Lua, e *shell.ParseError) {
+	L.NewTable()
+	for _, field := range []struct {
+		name  string
+		value interface{}
+	}{
+		{"message", e.Error()},
+		{"reason", e.Reason},
+		{"pos", e.Pos},
+		{"line", e.Line},
+		{"column", e.Column},
+		{"expected", e.Expected},
+		{"found", e.Found},
+	} {
+		L.Push(field.value)
+		L.SetField(-2, field.name)
+	}
+	L.NewTable()
+	L.PushGoFunction(parseErrorToString)
+	L.SetField(-2, "__tostring")
+	L.SetMetaTable(-2)
+}
+
+func parseErrorToString(L lua.Lua) int {
+	L.GetField(1, "message")
+	return 1
+}
+
+func cmdFormat(L lua.Lua) int {
+	text, err := L.ToString(1)
+	if err != nil {
+		return L.Push(nil, err)
+	}
+	formatted, err := shell.FormatText(text)
+	if e, ok := err.(*shell.ParseError); ok {
+		L.PushNil()
+		pushParseError(L, e)
+		return 2
+	} else if err != nil {
+		return L.Push(nil, err)
+	}
+	return L.Push(formatted, nil)
+}
+
 type emptyWriter struct{}
 
 func (e *emptyWriter) Write(b []byte) (int, error) {
@@ -257,25 +332,12 @@ func cmdEval(L lua.Lua) int {
 	if statementErr != nil {
 		return L.Push(nil, statementErr)
 	}
-	r, w, err := os.Pipe()
-	if err != nil {
-		return L.Push(nil, err)
-	}
-	go func(statement string, w *os.File) {
-		it := shell.New()
-		it.Tag = L
-		it.Stdout = w
-		it.Interpret(statement)
-		w.Close()
-	}(statement, w)
-
-	result, err := ioutil.ReadAll(r)
-	r.Close()
-	if err == nil {
-		L.PushBytes(bytes.Trim(result, "\r\n\t "))
-	} else {
-		L.PushNil()
-	}
+	var buffer bytes.Buffer
+	it := shell.New()
+	it.Tag = L
+	it.Stdout = &buffer
+	it.Interpret(statement)
+	L.PushBytes(bytes.Trim(buffer.Bytes(), "\r\n\t "))
 	return 1
 }
 
@@ -455,8 +517,8 @@ func cmdGlob(L lua.Lua) int {
 		if wildcard == "" || wildcardErr != nil {
 			break
 		}
-		list, err := findfile.Glob(wildcard)
-		if list == nil || err != nil {
+		list := getSession(L).Glob(wildcard)
+		if len(list) <= 0 {
 			result = append(result, wildcard)
 		} else {
 			result = append(result, list...)
@@ -472,6 +534,7 @@ func cmdGlob(L lua.Lua) int {
 }
 
 func cmdGetHistory(this lua.Lua) int {
+	default_history := historyOf(getSession(this))
 	if default_history == nil {
 		return 0
 	}
@@ -480,14 +543,39 @@ func cmdGetHistory(this lua.Lua) int {
 		if err != nil {
 			return this.Push(nil, err.Error())
 		}
-		this.PushString(default_history.At(val))
+		row := default_history.LineAt(val)
+		this.PushString(row.Text)
+		pushHistoryLine(this, &row)
+		return 2
 	} else {
 		this.PushInteger(lua.Integer(default_history.Len()))
 	}
 	return 1
 }
 
+// pushHistoryLine pushes the table which has the fields of the history.
+func pushHistoryLine(L lua.Lua, row *history.Line) {
+	L.NewTable()
+	for _, field := range []struct {
+		name  string
+		value interface{}
+	}{
+		{"text", row.Text},
+		{"dir", row.Dir},
+		{"stamp", row.Stamp.Format("2006-01-02 15:04:05")},
+		{"pid", row.Pid},
+		{"exitcode", row.ExitCode},
+		{"duration_ms", int64(row.Duration / time.Millisecond)},
+		{"session", row.Session},
+		{"host", row.Host},
+	} {
+		L.Push(field.value)
+		L.SetField(-2, field.name)
+	}
+}
+
 func cmdLenHistory(this lua.Lua) int {
+	default_history := historyOf(getSession(this))
 	if default_history == nil {
 		return 0
 	}
@@ -695,7 +783,7 @@ func cmdLoadFile(L lua.Lua) int {
 }
 
 type iolines_t struct {
-	Fd         *os.File
+	Fd         io.Reader
 	Reader     *bufio.Reader
 	Marks      []string
 	HasToClose bool
@@ -703,8 +791,8 @@ type iolines_t struct {
 
 func (this *iolines_t) Close() {
 	this.Reader = nil
-	if this.HasToClose {
-		this.Fd.Close()
+	if closer, ok := this.Fd.(io.Closer); ok && this.HasToClose {
+		closer.Close()
 	}
 	this.Fd = nil
 }
@@ -9,6 +9,7 @@ import (
 	"path/filepath"
 	"regexp"
 	"strings"
+	"time"
 
 	"github.com/mattn/go-isatty"
 	"github.com/zetamatta/go-getch"
@@ -54,8 +55,14 @@ func nyagosPrompt(L lua.Lua) int {
 	if err != nil {
 		template = "[" + err.Error() + "]"
 	}
-	text := Format2Prompt(template)
+	L.PushInteger(lua.Integer(printPromptText(Format2Prompt(template))))
+	return 1
+}
+
+var prompt_hook lua.Object = lua.TGoFunction(nyagosPrompt)
 
+// printPromptText prints the prompt and returns the width of its last line.
+func printPromptText(text string) int {
 	fmt.Fprint(readline.Console, text)
 
 	text = rxAnsiEscCode.ReplaceAllString(text, "")
@@ -63,11 +70,18 @@ func nyagosPrompt(L lua.Lua) int {
 	if lfPos >= 0 {
 		text = text[lfPos+1:]
 	}
-	L.PushInteger(lua.Integer(readline.GetStringWidth(text)))
-	return 1
+	return readline.GetStringWidth(text)
 }
 
-var prompt_hook lua.Object = lua.TGoFunction(nyagosPrompt)
+// printPrompt2 prints %PROMPT2% ("> " when it is not set) for
+// the continuation lines of the incomplete command.
+func printPrompt2() (int, error) {
+	template := os.Getenv("PROMPT2")
+	if template == "" {
+		template = "$G$S"
+	}
+	return printPromptText(Format2Prompt(template)), nil
+}
 
 func printPrompt(L lua.Lua) (int, error) {
 	L.Push(prompt_hook)
@@ -101,7 +115,11 @@ func AppDataDir() string {
 	return appdatapath_
 }
 
-var default_history *history.Container
+// historyOf returns the history of the console which the session reads.
+func historyOf(session *shell.Session) *history.Container {
+	h, _ := session.Value(history.NoInstance).(*history.Container)
+	return h
+}
 
 func doLuaFilter(L lua.Lua, line string) string {
 	stackPos := L.GetTop()
@@ -155,12 +173,13 @@ func offFork(cmd *shell.Cmd) error {
 
 type MainStream struct {
 	shell.Stream
-	L lua.Lua
+	L       lua.Lua
+	Session *shell.Session
 }
 
 func (this *MainStream) ReadLine(ctx context.Context) (context.Context, string, error) {
 	ctx = context.WithValue(ctx, lua.NoInstance, this.L)
-	ctx = context.WithValue(ctx, history.NoInstance, default_history)
+	ctx = context.WithValue(ctx, history.NoInstance, historyOf(this.Session))
 	ctx, line, err := this.Stream.ReadLine(ctx)
 	if err != nil {
 		return ctx, "", err
@@ -168,6 +187,12 @@ func (this *MainStream) ReadLine(ctx context.Context) (context.Context, string,
 	return ctx, doLuaFilter(this.L, line), nil
 }
 
+func (this *MainStream) Record(errorlevel int, elapsed time.Duration) {
+	if recorder, ok := this.Stream.(shell.Recorder); ok {
+		recorder.Record(errorlevel, elapsed)
+	}
+}
+
 func Main() error {
 	// for issue #155 & #158
 	lua.NG_UPVALUE_NAME["prompter"] = struct{}{}
@@ -178,6 +203,7 @@ func Main() error {
 	})
 	completion.AppendCommandLister(commands.AllNames)
 	completion.AppendCommandLister(alias.AllNames)
+	completion.AppendCommandLister(commands.FunctionNames)
 	completion.HookToList = append(completion.HookToList, luaHookForComplete)
 
 	dos.CoInitializeEx(0, dos.COINIT_MULTITHREADED)
@@ -225,20 +251,19 @@ func Main() error {
 		}
 	}
 
-	backupHistory := default_history
-	defer func() {
-		default_history = backupHistory
-	}()
+	session := it.Session()
+	backupHistory := session.Value(history.NoInstance)
+	defer session.SetValue(history.NoInstance, backupHistory)
 
 	var stream1 shell.Stream
 	if isatty.IsTerminal(os.Stdin.Fd()) {
 		constream := NewCmdStreamConsole(
 			func() (int, error) { return printPrompt(L) })
 		stream1 = constream
-		default_history = constream.History
+		session.SetValue(history.NoInstance, constream.History)
 	} else {
 		stream1 = NewCmdStreamFile(os.Stdin)
 	}
 
-	return it.Loop(&MainStream{stream1, L})
+	return it.Loop(&MainStream{stream1, L, session})
 }
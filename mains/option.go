@@ -1,7 +1,6 @@
 package mains
 
 import (
-	"bufio"
 	"encoding/base64"
 	"errors"
 	"fmt"
@@ -83,11 +82,11 @@ func optionParse(it *shell.Cmd, L lua.Lua) (func() error, error) {
 					if fd_err != nil {
 						return fmt.Errorf("%s: %s\n", args[i], fd_err.Error())
 					}
-					scanner := bufio.NewScanner(fd)
-					for scanner.Scan() {
-						it.Interpret(scanner.Text())
-					}
+					err := it.Loop(NewCmdStreamFile(fd))
 					fd.Close()
+					if err != nil {
+						return err
+					}
 					return io.EOF
 				}, nil
 			}
@@ -107,6 +106,10 @@ func optionParse(it *shell.Cmd, L lua.Lua) (func() error, error) {
 			}, nil
 		} else if arg1 == "--norc" {
 			optionNorc = true
+		} else if arg1 == "--errexit" {
+			it.Session().SetExitOnError(true)
+		} else if arg1 == "--xtrace" {
+			it.Session().SetXTrace(true)
 		}
 	}
 	return nil, nil
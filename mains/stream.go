@@ -9,9 +9,11 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/zetamatta/nyagos/history"
 	"github.com/zetamatta/nyagos/readline"
+	"github.com/zetamatta/nyagos/shell"
 )
 
 type CmdSeeker struct {
@@ -38,29 +40,34 @@ func (this *CmdSeeker) SetPos(pos int) error {
 
 type CmdStreamConsole struct {
 	CmdSeeker
-	DoPrompt func() (int, error)
-	History  *history.Container
-	Editor   *readline.Editor
-	HistPath string
+	DoPrompt  func() (int, error)
+	DoPrompt2 func() (int, error) // the prompt of the continuation lines
+	History   *history.Container
+	Editor    *readline.Editor
+	HistFile  *history.File
+	lastRow   int // the index of the history of the line running (-1: none)
 }
 
 func NewCmdStreamConsole(doPrompt func() (int, error)) *CmdStreamConsole {
 	history1 := &history.Container{}
 	this := &CmdStreamConsole{
-		History:  history1,
-		Editor:   &readline.Editor{History: history1, Prompt: doPrompt},
-		HistPath: filepath.Join(AppDataDir(), "nyagos.history"),
+		DoPrompt:  doPrompt,
+		DoPrompt2: printPrompt2,
+		History:   history1,
+		Editor:    &readline.Editor{History: history1, Prompt: doPrompt},
+		HistFile:  &history.File{Path: filepath.Join(AppDataDir(), "nyagos.history")},
+		lastRow:   -1,
 		CmdSeeker: CmdSeeker{
 			PlainHistory: []string{},
 			Pointer:      -1,
 		},
 	}
-	history1.Load(this.HistPath)
-	history1.Save(this.HistPath)
+	this.HistFile.Load(history1)
 	return this
 }
 
 func (this *CmdStreamConsole) ReadLine(ctx context.Context) (context.Context, string, error) {
+	this.lastRow = -1
 	if this.Pointer >= 0 {
 		if this.Pointer < len(this.PlainHistory) {
 			this.Pointer++
@@ -68,36 +75,64 @@ func (this *CmdStreamConsole) ReadLine(ctx context.Context) (context.Context, st
 		}
 		this.Pointer = -1
 	}
+	// the commands typed in the other windows
+	this.HistFile.Sync(this.History)
+
 	var line string
 	var err error
 	for {
-		line, err = this.Editor.ReadLine(ctx)
+		line, err = this.readLine(ctx)
 		if err != nil {
 			return ctx, line, err
 		}
-		var isReplaced bool
-		line, isReplaced = this.History.Replace(line)
-		if isReplaced {
-			fmt.Fprintln(os.Stdout, line)
-		}
 		if line != "" {
 			break
 		}
 	}
-	row := history.NewHistoryLine(line)
-	this.History.PushLine(row)
-	fd, err := os.OpenFile(this.HistPath, os.O_APPEND, 0600)
-	if err != nil && os.IsNotExist(err) {
-		fd, err = os.Create(this.HistPath)
+	// the continuation lines of the incomplete command
+	for {
+		if _, err := shell.Parse(line); !shell.IsIncomplete(err) {
+			break
+		}
+		this.Editor.Prompt = this.DoPrompt2
+		next, err := this.readLine(ctx)
+		this.Editor.Prompt = this.DoPrompt
+		if err != nil {
+			// Ctrl-D cancels the command.
+			return ctx, "", nil
+		}
+		line = shell.ContinueLine(line, next)
 	}
-	if err == nil {
-		fmt.Fprintln(fd, row.String())
-		fd.Close()
-	} else {
+	this.History.PushLine(history.NewHistoryLine(line))
+	this.lastRow = this.History.Len() - 1
+	this.PlainHistory = append(this.PlainHistory, line)
+	return ctx, line, nil
+}
+
+// Record sets the result to the history of the line which ran last
+// and appends it to the history file.
+func (this *CmdStreamConsole) Record(errorlevel int, elapsed time.Duration) {
+	if this.lastRow < 0 {
+		return
+	}
+	row := this.History.Finish(this.lastRow, errorlevel, elapsed)
+	this.lastRow = -1
+	if err := this.HistFile.Append(this.History, row); err != nil {
 		fmt.Fprintln(os.Stderr, err.Error())
 	}
-	this.PlainHistory = append(this.PlainHistory, line)
-	return ctx, line, err
+}
+
+// readLine reads one line from the editor and expands the history in it.
+func (this *CmdStreamConsole) readLine(ctx context.Context) (string, error) {
+	line, err := this.Editor.ReadLine(ctx)
+	if err != nil {
+		return line, err
+	}
+	line, isReplaced := this.History.Replace(line)
+	if isReplaced {
+		fmt.Fprintln(os.Stdout, line)
+	}
+	return line, nil
 }
 
 type CmdStreamFile struct {
@@ -123,14 +158,33 @@ func (this *CmdStreamFile) ReadLine(ctx context.Context) (context.Context, strin
 		}
 		this.Pointer = -1
 	}
+	text, err := this.scanLine()
+	if err != nil {
+		return ctx, "", err
+	}
+	// the continuation lines of the incomplete command
+	for {
+		if _, err := shell.Parse(text); !shell.IsIncomplete(err) {
+			break
+		}
+		next, err := this.scanLine()
+		if err != nil {
+			// let the interpreter report that it is not closed.
+			break
+		}
+		text = shell.ContinueLine(text, next)
+	}
+	this.PlainHistory = append(this.PlainHistory, text)
+	return ctx, text, nil
+}
+
+func (this *CmdStreamFile) scanLine() (string, error) {
 	if !this.Scanner.Scan() {
 		if err := this.Scanner.Err(); err != nil {
-			return ctx, "", err
+			return "", err
 		} else {
-			return ctx, "", io.EOF
+			return "", io.EOF
 		}
 	}
-	text := strings.TrimRight(this.Scanner.Text(), "\r\n")
-	this.PlainHistory = append(this.PlainHistory, text)
-	return ctx, text, nil
+	return strings.TrimRight(this.Scanner.Text(), "\r\n"), nil
 }
@@ -0,0 +1,319 @@
+package shell
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// arith is the evaluator of the integer expressions of `set /a` and `$((...))`.
+// The operators and their precedence are the same as C:
+//
+//	,  = *= /= %= += -= <<= >>= &= ^= |=  ||  &&  |  ^  &
+//	== !=  < <= > >=  << >>  + -  * / %  ! ~ - + (unary)
+//
+// Names in the expression are the shell variables or the environment
+// variables. Undefined or non-numeric variables are 0.
+type arith struct {
+	text string
+	pos  int
+	vars *variables
+	skip int // >0 while reading the operand not evaluated after `||` and `&&`
+}
+
+// ArithError is the error of the expression: syntax errors and
+// division by zero.
+type ArithError struct {
+	Expr   string
+	Pos    int
+	Reason string
+}
+
+func (this *ArithError) Error() string {
+	return fmt.Sprintf("%s: %s (at column %d)", strings.TrimSpace(this.Expr), this.Reason, this.Pos+1)
+}
+
+// EvalArith evaluates the integer expression. Assignments change
+// the shell variable when it is defined, otherwise the environment variable.
+func (this *Cmd) EvalArith(expr string) (int64, error) {
+	return this.vars.evalArith(expr)
+}
+
+func (this *variables) evalArith(expr string) (int64, error) {
+	a := &arith{text: expr, vars: this}
+	value, err := a.comma()
+	if err != nil {
+		return 0, err
+	}
+	if a.skipSpaces(); a.pos < len(a.text) {
+		return 0, a.errorf("unexpected `%s`", a.text[a.pos:])
+	}
+	return value, nil
+}
+
+func (this *arith) errorf(format string, args ...interface{}) error {
+	return &ArithError{Expr: this.text, Pos: this.pos, Reason: fmt.Sprintf(format, args...)}
+}
+
+func (this *arith) skipSpaces() {
+	for this.pos < len(this.text) && strings.IndexByte(" \t\r\n", this.text[this.pos]) >= 0 {
+		this.pos++
+	}
+}
+
+// accept reads one of ops when the text continues with it and
+// returns the operator read or "".
+func (this *arith) accept(ops ...string) string {
+	this.skipSpaces()
+	for _, op := range ops {
+		if !strings.HasPrefix(this.text[this.pos:], op) {
+			continue
+		}
+		next := this.text[this.pos+len(op):]
+		// do not take `<` of `<<`, `&` of `&&` and `=` of `==` ...
+		if len(op) == 1 && len(next) > 0 && (next[0] == op[0] && op != "!" && op != "~" || next[0] == '=' && op != "=") {
+			continue
+		}
+		if (op == "<<" || op == ">>") && strings.HasPrefix(next, "=") {
+			continue
+		}
+		this.pos += len(op)
+		return op
+	}
+	return ""
+}
+
+func (this *arith) comma() (int64, error) {
+	value, err := this.assign()
+	for err == nil && this.accept(",") != "" {
+		value, err = this.assign()
+	}
+	return value, err
+}
+
+var arithAssignOps = []string{"<<=", ">>=", "*=", "/=", "%=", "+=", "-=", "&=", "^=", "|=", "="}
+
+func (this *arith) assign() (int64, error) {
+	start := this.pos
+	this.skipSpaces()
+	if m := rxVarName.FindString(this.text[this.pos:]); m != "" {
+		this.pos += len(m)
+		if op := this.accept(arithAssignOps...); op != "" {
+			right, err := this.assign()
+			if err != nil {
+				return 0, err
+			}
+			value := right
+			if this.skip > 0 {
+				return 0, nil
+			}
+			if op != "=" {
+				left, err := this.variable(m)
+				if err != nil {
+					return 0, err
+				}
+				if value, err = this.apply(op[:len(op)-1], left, right); err != nil {
+					return 0, err
+				}
+			}
+			this.vars.assign(m, strconv.FormatInt(value, 10))
+			return value, nil
+		}
+	}
+	this.pos = start
+	return this.binary(0)
+}
+
+var arithLevels = [][]string{
+	{"||"},
+	{"&&"},
+	{"|"},
+	{"^"},
+	{"&"},
+	{"==", "!="},
+	{"<=", ">=", "<", ">"},
+	{"<<", ">>"},
+	{"+", "-"},
+	{"*", "/", "%"},
+}
+
+func (this *arith) binary(level int) (int64, error) {
+	if level >= len(arithLevels) {
+		return this.unary()
+	}
+	left, err := this.binary(level + 1)
+	if err != nil {
+		return 0, err
+	}
+	for {
+		opPos := this.pos
+		op := this.accept(arithLevels[level]...)
+		if op == "" {
+			return left, nil
+		}
+		// the right of `||` and `&&` is not evaluated as C when
+		// the left decides the result.
+		shortCut := (op == "||" && left != 0) || (op == "&&" && left == 0)
+		if shortCut {
+			this.skip++
+		}
+		right, err := this.binary(level + 1)
+		if shortCut {
+			this.skip--
+		}
+		if err != nil {
+			return 0, err
+		}
+		if shortCut {
+			left = bool2int(op == "||")
+			continue
+		}
+		if this.skip > 0 {
+			continue
+		}
+		if left, err = this.apply(op, left, right); err != nil {
+			if e, ok := err.(*ArithError); ok {
+				e.Pos = opPos
+			}
+			return 0, err
+		}
+	}
+}
+
+func bool2int(b bool) int64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func (this *arith) apply(op string, left, right int64) (int64, error) {
+	switch op {
+	case "||":
+		return bool2int(left != 0 || right != 0), nil
+	case "&&":
+		return bool2int(left != 0 && right != 0), nil
+	case "|":
+		return left | right, nil
+	case "^":
+		return left ^ right, nil
+	case "&":
+		return left & right, nil
+	case "==":
+		return bool2int(left == right), nil
+	case "!=":
+		return bool2int(left != right), nil
+	case "<":
+		return bool2int(left < right), nil
+	case "<=":
+		return bool2int(left <= right), nil
+	case ">":
+		return bool2int(left > right), nil
+	case ">=":
+		return bool2int(left >= right), nil
+	case "<<":
+		return left << uint64(right), nil
+	case ">>":
+		return left >> uint64(right), nil
+	case "+":
+		return left + right, nil
+	case "-":
+		return left - right, nil
+	case "*":
+		return left * right, nil
+	case "/", "%":
+		if right == 0 {
+			return 0, this.errorf("division by zero")
+		}
+		if op == "/" {
+			return left / right, nil
+		}
+		return left % right, nil
+	}
+	return 0, this.errorf("unknown operator `%s`", op)
+}
+
+func (this *arith) unary() (int64, error) {
+	switch op := this.accept("!", "~", "-", "+"); op {
+	case "!":
+		value, err := this.unary()
+		return bool2int(value == 0), err
+	case "~":
+		value, err := this.unary()
+		return ^value, err
+	case "-":
+		value, err := this.unary()
+		return -value, err
+	case "+":
+		return this.unary()
+	}
+	return this.primary()
+}
+
+func (this *arith) primary() (int64, error) {
+	this.skipSpaces()
+	if this.pos >= len(this.text) {
+		return 0, this.errorf("operand expected")
+	}
+	if this.accept("(") != "" {
+		value, err := this.comma()
+		if err != nil {
+			return 0, err
+		}
+		if this.accept(")") == "" {
+			return 0, this.errorf("`)` expected")
+		}
+		return value, nil
+	}
+	rest := this.text[this.pos:]
+	if m := rxVarName.FindString(rest); m != "" {
+		this.pos += len(m)
+		return this.variable(m)
+	}
+	end := 0
+	for end < len(rest) && (rest[end] >= '0' && rest[end] <= '9' ||
+		rest[end] >= 'a' && rest[end] <= 'z' || rest[end] >= 'A' && rest[end] <= 'Z') {
+		end++
+	}
+	if end <= 0 {
+		return 0, this.errorf("operand expected")
+	}
+	value, err := strconv.ParseInt(rest[:end], 0, 64)
+	if err != nil {
+		return 0, this.errorf("invalid number `%s`", rest[:end])
+	}
+	this.pos += end
+	return value, nil
+}
+
+// variable returns the value of the variable `name`.
+func (this *arith) variable(name string) (int64, error) {
+	value, ok := this.vars.getenv(name)
+	if !ok {
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(value), 0, 64)
+	if err != nil {
+		return 0, nil
+	}
+	return n, nil
+}
+
+// isArith returns true when text (`$(...)`) is `$((EXPR))`.
+func isArith(text string) bool {
+	if !strings.HasPrefix(text, "$((") || !strings.HasSuffix(text, "))") {
+		return false
+	}
+	depth := 0
+	for _, ch := range text[3 : len(text)-2] {
+		switch ch {
+		case '(':
+			depth++
+		case ')':
+			if depth--; depth < 0 {
+				return false
+			}
+		}
+	}
+	return depth == 0
+}
@@ -0,0 +1,98 @@
+package shell
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestEvalArith(t *testing.T) {
+	cases := []struct {
+		expr   string
+		expect int64
+	}{
+		{"1+2*3", 7},
+		{"(1+2)*3", 9},
+		{"7/2 + 7%2", 4},
+		{"-3 - -2", -1},
+		{"1<<4 | 3 & 1 ^ 2", 19},
+		{"~0", -1},
+		{"!0 + !5", 1},
+		{"2 < 3 && 3 <= 3 && 4 > 3 && 3 >= 4 || 1 == 1", 1},
+		{"1 != 1", 0},
+		{"0x10 + 010", 24},
+		{"NYAGOS_TEST_N=5, NYAGOS_TEST_N+=2, NYAGOS_TEST_N*=NYAGOS_TEST_N", 49},
+		{"NYAGOS_TEST_N <<= 1", 98},
+		{"1 || 1/0", 1},
+		{"0 && 1/0 || 2", 1},
+		{"NYAGOS_TEST_M=0 && 1/0", 0},
+		{"1 || (NYAGOS_TEST_N=1)", 1},
+		{"0 && (NYAGOS_TEST_N/=0) && 1/0", 0},
+	}
+	it := New()
+	for _, c := range cases {
+		value, err := it.EvalArith(c.expr)
+		if err != nil {
+			t.Errorf("%s: %s", c.expr, err.Error())
+		} else if value != c.expect {
+			t.Errorf("%s: %d (expected %d)", c.expr, value, c.expect)
+		}
+	}
+	if value := os.Getenv("NYAGOS_TEST_N"); value != "98" {
+		t.Errorf("NYAGOS_TEST_N=%s", value)
+	}
+	os.Unsetenv("NYAGOS_TEST_N")
+	if value := os.Getenv("NYAGOS_TEST_M"); value != "0" {
+		t.Errorf("NYAGOS_TEST_M=%s", value)
+	}
+	os.Unsetenv("NYAGOS_TEST_M")
+
+	for _, expr := range []string{"1/0", "5 % (2-2)", "1 +", "(1", "1 2", "08", "3 = 4", ""} {
+		if _, err := it.EvalArith(expr); err == nil {
+			t.Errorf("%s: no error", expr)
+		} else if _, ok := err.(*ArithError); !ok {
+			t.Errorf("%s: %s", expr, err.Error())
+		}
+	}
+	if _, err := it.EvalArith("10 / (3-3)"); err == nil || !strings.Contains(err.Error(), "division by zero") {
+		t.Errorf("division by zero: %v", err)
+	}
+}
+
+func TestInterpretArith(t *testing.T) {
+	var args []string
+	orgHook := SetHook(func(ctx context.Context, cmd *Cmd) (int, bool, error) {
+		args = cmd.Args
+		return 0, true, nil
+	})
+	defer SetHook(orgHook)
+
+	it := New()
+	it.SetVar("N", "4")
+	if _, err := it.Interpret(`show $((N * (N+1))) "[$(( N < 5 ))]" $((N+=1))`); err != nil {
+		t.Fatal(err.Error())
+	}
+	if strings.Join(args, " ") != "show 20 [1] 5" {
+		t.Errorf("args: %q", args)
+	}
+	if value, _ := it.LookupVar("N"); value != "5" {
+		t.Errorf("N=%s", value)
+	}
+	if _, err := it.Interpret(`show $((1/0))`); err == nil {
+		t.Error("division by zero: no error")
+	}
+
+	var stderr bytes.Buffer
+	it.Stderr = &stderr
+	if _, err := it.Interpret(`show $((1/0)) ; show next`); err != nil {
+		t.Fatal(err.Error())
+	}
+	if !strings.Contains(stderr.String(), "division by zero") {
+		t.Errorf("stderr: %q", stderr.String())
+	}
+	if strings.Join(args, " ") != "show next" {
+		t.Errorf("args: %q", args)
+	}
+}
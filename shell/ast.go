@@ -0,0 +1,166 @@
+package shell
+
+// Node is an element of the syntax tree which Parse returns.
+type Node interface {
+	Pos() int // byte offset of the first character in the source
+	End() int // byte offset just after the last character
+}
+
+type span struct {
+	pos int
+	end int
+}
+
+func (this span) Pos() int { return this.pos }
+func (this span) End() int { return this.end }
+
+// StatementT is a simple command: words and redirections.
+// Words are kept as written in the source. They are expanded
+// (variables, quotations) each time the statement runs.
+type StatementT struct {
+	span
+	Words    []string
+	Redirect []*Redirecter
+}
+
+// PipelineT is `STAGE1 | STAGE2 |& STAGE3 ...`
+type PipelineT struct {
+	span
+	Stages []Node
+	Pipes  []string // Pipes[i] is the operator ("|" or "|&") after Stages[i]
+}
+
+// TimeT is `time PIPELINE`. It prints the time which PIPELINE takes.
+type TimeT struct {
+	span
+	Node Node
+}
+
+// AndOrT is `LEFT && RIGHT` or `LEFT || RIGHT`.
+// `a || b && c` is parsed as `(a || b) && c`.
+type AndOrT struct {
+	span
+	Left  Node
+	Op    string
+	Right Node
+}
+
+// BackgroundT is `NODE &`
+type BackgroundT struct {
+	span
+	Node Node
+	Text string // the source of Node
+}
+
+// SubshellT is `( BODY ) REDIRECT...`.
+// BODY runs on a clone of Cmd and the current directory and
+// the environment variables are restored after BODY ends.
+type SubshellT struct {
+	span
+	Body     *SequenceT
+	Redirect []*Redirecter
+}
+
+// GroupT is `{ BODY ; } REDIRECT...`. BODY runs on the current shell.
+type GroupT struct {
+	span
+	Body     *SequenceT
+	Redirect []*Redirecter
+}
+
+// IfT is `if COND (THEN) else (ELSE)` or the block form
+//
+//	if COND [then]
+//	    THEN
+//	else
+//	    ELSE
+//	end
+//
+// `else if` is parsed as an IfT nested in Else.
+type IfT struct {
+	span
+	Cond *ConditionT
+	Then *SequenceT
+	Else *SequenceT // nil when no else-part
+}
+
+// ConditionT is the condition of if and while:
+// `[/I] [NOT] A==B`, `A OP B` (OP: EQU NEQ LSS LEQ GTR GEQ),
+// `EXIST PATH`, `ERRORLEVEL N` or `DEFINED VAR`.
+type ConditionT struct {
+	span
+	Not        bool
+	IgnoreCase bool
+	Op         string // "==", "equ", ... "exist", "errorlevel" or "defined"
+	Args       []string
+}
+
+// ForT is `for %X in (ITEMS) do BODY` or `for /L %X in (START,STEP,END) do BODY`.
+// The body may be a block closed by `end` as IfT.
+type ForT struct {
+	span
+	Var   string // the name without %
+	Range bool   // true for /L
+	Items []string
+	Body  *SequenceT
+}
+
+// WhileT is `while COND [do] BODY`
+type WhileT struct {
+	span
+	Cond *ConditionT
+	Body *SequenceT
+}
+
+// FunctionT is `function NAME { BODY }`. Running it defines the function.
+type FunctionT struct {
+	span
+	Name string
+	Body *SequenceT
+}
+
+// SequenceT is `NODE1 ; NODE2 ; ...`
+type SequenceT struct {
+	span
+	Nodes []Node
+}
+
+// Walk calls f for node and its descendants in depth-first order.
+// When f returns false, the children of that node are skipped.
+func Walk(node Node, f func(Node) bool) {
+	if node == nil || !f(node) {
+		return
+	}
+	switch n := node.(type) {
+	case *PipelineT:
+		for _, stage := range n.Stages {
+			Walk(stage, f)
+		}
+	case *AndOrT:
+		Walk(n.Left, f)
+		Walk(n.Right, f)
+	case *TimeT:
+		Walk(n.Node, f)
+	case *BackgroundT:
+		Walk(n.Node, f)
+	case *SubshellT:
+		Walk(n.Body, f)
+	case *GroupT:
+		Walk(n.Body, f)
+	case *IfT:
+		Walk(n.Then, f)
+		if n.Else != nil {
+			Walk(n.Else, f)
+		}
+	case *ForT:
+		Walk(n.Body, f)
+	case *WhileT:
+		Walk(n.Body, f)
+	case *FunctionT:
+		Walk(n.Body, f)
+	case *SequenceT:
+		for _, node1 := range n.Nodes {
+			Walk(node1, f)
+		}
+	}
+}
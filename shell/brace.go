@@ -0,0 +1,195 @@
+package shell
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var rxNumberRange = regexp.MustCompile(`^(-?[0-9]+)\.\.(-?[0-9]+)(?:\.\.(-?[0-9]+))?$`)
+var rxAlphaRange = regexp.MustCompile(`^([a-zA-Z])\.\.([a-zA-Z])(?:\.\.(-?[0-9]+))?$`)
+
+// braceScanner walks a word written in the source and tells whether
+// each byte is out of quotations, `$(...)` and `${...}`.
+type braceScanner struct {
+	word     string
+	quoteNow rune
+	yenCount int
+}
+
+// next returns the offset of the next byte to check and whether the byte
+// at i is a meta character (not quoted).
+func (this *braceScanner) next(i int) (int, bool) {
+	ch := this.word[i]
+	isMeta := false
+	if this.quoteNow == NOTQUOTED {
+		if this.yenCount%2 == 0 && (ch == '"' || ch == '\'') {
+			this.quoteNow = rune(ch)
+		} else {
+			isMeta = true
+		}
+	} else if this.yenCount%2 == 0 && rune(ch) == this.quoteNow {
+		this.quoteNow = NOTQUOTED
+	}
+	if ch == '\\' {
+		this.yenCount++
+	} else {
+		this.yenCount = 0
+	}
+	if ch == '$' && this.quoteNow != '\'' && i+1 < len(this.word) && this.word[i+1] == '{' {
+		// skip ${...}
+		if end := closingBrace([]byte(this.word[i+1:])); end >= 0 {
+			return i + end + 2, false
+		}
+	}
+	if ch == '$' && this.quoteNow != '\'' && i+1 < len(this.word) && this.word[i+1] == '(' {
+		// skip $(...)
+		if text, err := readCommandSubst(this.word, i); err == nil {
+			return i + len(text), false
+		}
+	}
+	return i + 1, isMeta
+}
+
+// braceT is a pair of `{` and `}` found in a word.
+type braceT struct {
+	open   int
+	close  int
+	commas []int
+	inner  *braceT // the first expandable brace in this
+}
+
+// alternatives returns the words which the brace is expanded into
+// or nil when it is not expandable (`{}`, `{a}` ...).
+func (this *braceT) alternatives(word string) []string {
+	if len(this.commas) <= 0 {
+		return expandRange(word[this.open+1 : this.close])
+	}
+	alts := make([]string, 0, len(this.commas)+1)
+	last := this.open + 1
+	for _, comma := range this.commas {
+		alts = append(alts, word[last:comma])
+		last = comma + 1
+	}
+	return append(alts, word[last:this.close])
+}
+
+// findBrace returns the first outermost expandable brace in word
+// and its alternatives. It returns nil when not found.
+func findBrace(word string) (*braceT, []string) {
+	s := &braceScanner{word: word}
+	stack := []*braceT{}
+	alts := map[*braceT][]string{}
+	for i := 0; i < len(word); {
+		next, isMeta := s.next(i)
+		if isMeta {
+			switch word[i] {
+			case '{':
+				stack = append(stack, &braceT{open: i})
+			case ',':
+				if len(stack) > 0 {
+					top := stack[len(stack)-1]
+					top.commas = append(top.commas, i)
+				}
+			case '}':
+				if len(stack) > 0 {
+					top := stack[len(stack)-1]
+					stack = stack[:len(stack)-1]
+					top.close = i
+					found := top.inner
+					if alts1 := top.alternatives(word); alts1 != nil {
+						alts[top] = alts1
+						found = top
+					}
+					if found != nil {
+						if len(stack) <= 0 {
+							return found, alts[found]
+						}
+						if parent := stack[len(stack)-1]; parent.inner == nil {
+							parent.inner = found
+						}
+					}
+				}
+			}
+		}
+		i = next
+	}
+	// braces not closed are not expanded, but the ones in them are.
+	for _, b := range stack {
+		if b.inner != nil {
+			return b.inner, alts[b.inner]
+		}
+	}
+	return nil, nil
+}
+
+// expandRange returns the items of `START..END[..STEP]`
+// or nil when text is not a range.
+func expandRange(text string) []string {
+	if m := rxNumberRange.FindStringSubmatch(text); m != nil {
+		start, _ := strconv.Atoi(m[1])
+		end, _ := strconv.Atoi(m[2])
+		width := 0
+		for _, s := range m[1:3] {
+			if digits := strings.TrimPrefix(s, "-"); len(digits) >= 2 && digits[0] == '0' {
+				if len(s) > width {
+					width = len(s)
+				}
+			}
+		}
+		result := []string{}
+		for _, n := range rangeOf(start, end, m[3]) {
+			result = append(result, fmt.Sprintf("%0*d", width, n))
+		}
+		return result
+	}
+	if m := rxAlphaRange.FindStringSubmatch(text); m != nil {
+		result := []string{}
+		for _, n := range rangeOf(int(m[1][0]), int(m[2][0]), m[3]) {
+			result = append(result, string(rune(n)))
+		}
+		return result
+	}
+	return nil
+}
+
+func rangeOf(start, end int, step_ string) []int {
+	step := 1
+	if step_ != "" {
+		if n, err := strconv.Atoi(step_); err == nil && n != 0 {
+			step = n
+		}
+	}
+	if step < 0 {
+		step = -step
+	}
+	result := []int{}
+	if start <= end {
+		for n := start; n <= end; n += step {
+			result = append(result, n)
+		}
+	} else {
+		for n := start; n >= end; n -= step {
+			result = append(result, n)
+		}
+	}
+	return result
+}
+
+// expandBrace expands `{A,B,...}` and the ranges `{1..10}`, `{a..f}`,
+// `{01..20..2}` in the word written in the source. Braces in quotations,
+// `$(...)` and `${...}` are not expanded.
+func expandBrace(word string) []string {
+	brace, alts := findBrace(word)
+	if brace == nil {
+		return []string{word}
+	}
+	prefix := word[:brace.open]
+	suffix := word[brace.close+1:]
+	result := []string{}
+	for _, alt := range alts {
+		result = append(result, expandBrace(prefix+alt+suffix)...)
+	}
+	return result
+}
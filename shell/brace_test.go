@@ -0,0 +1,50 @@
+package shell
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestExpandBrace(t *testing.T) {
+	cases := []struct {
+		word   string
+		expect string
+	}{
+		{`a{b,c,d}e`, `abe ace ade`},
+		{`{a,b{1,2}}x`, `ax b1x b2x`},
+		{`{1..5}`, `1 2 3 4 5`},
+		{`{5..1..2}`, `5 3 1`},
+		{`{01..10..3}`, `01 04 07 10`},
+		{`{a..e}`, `a b c d e`},
+		{`{x,y}{1..2}`, `x1 x2 y1 y2`},
+		{`{}`, `{}`},
+		{`{a}`, `{a}`},
+		{`{a,b`, `{a,b`},
+		{`{x{a,b}}`, `{xa} {xb}`},
+		{`"{a,b}"c`, `"{a,b}"c`},
+		{`{"a,b",c}`, `"a,b" c`},
+		{`$(echo {a,b})`, `$(echo {a,b})`},
+		{`${X:-a,b}{1,2}`, `${X:-a,b}1 ${X:-a,b}2`},
+	}
+	for _, c := range cases {
+		result := strings.Join(expandBrace(c.word), " ")
+		if result != c.expect {
+			t.Errorf("%s: %s (expected %s)", c.word, result, c.expect)
+		}
+	}
+}
+
+func TestInterpretBrace(t *testing.T) {
+	var args []string
+	orgHook := SetHook(func(ctx context.Context, cmd *Cmd) (int, bool, error) {
+		args = cmd.Args
+		return 0, true, nil
+	})
+	defer SetHook(orgHook)
+
+	New().Interpret(`show "a b"{1,2} '{c,d}'`)
+	if len(args) != 4 || args[1] != "a b1" || args[2] != "a b2" || args[3] != "{c,d}" {
+		t.Errorf("args: %q", args)
+	}
+}
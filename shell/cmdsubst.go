@@ -0,0 +1,210 @@
+package shell
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/zetamatta/go-mbcs"
+)
+
+// readCommandSubst reads `$(...)` or `$((...))` at text[pos:] and returns it as written.
+func readCommandSubst(text string, pos int) (string, error) {
+	lexer := &Lexer{text: text, pos: pos}
+	token, err := lexer.readSubst(pos, 2)
+	if err != nil {
+		return "", err
+	}
+	if err := checkSubst(text, pos, token.Text); err != nil {
+		return "", err
+	}
+	return token.Text, nil
+}
+
+// commandSubst runs the command in `$(...)` and returns its output
+// without the last newlines and the errorlevel of the command.
+func (this *Cmd) commandSubst(ctx context.Context, text string) (string, int, error) {
+	tree, err := Parse(text)
+	if err != nil {
+		return "", 255, err
+	}
+	cmd, err := this.Clone()
+	if err != nil {
+		return "", 255, err
+	}
+	r, w := io.Pipe()
+	cmd.Stdout = w
+	errorlevel := 0
+	done := make(chan struct{})
+	go func() {
+		errorlevel, _ = cmd.run(ctx, tree)
+		w.Close()
+		close(done)
+	}()
+	output, err := ioutil.ReadAll(r)
+	r.Close()
+	<-done
+	if err != nil {
+		return "", errorlevel, err
+	}
+	var result string
+	if utf8.Valid(output) {
+		result = string(output)
+	} else if result, err = mbcs.AtoU(output); err != nil {
+		return "", errorlevel, err
+	}
+	result = strings.Replace(result, "\r\n", "\n", -1)
+	return strings.TrimRight(result, "\n"), errorlevel, nil
+}
+
+// argsBuilder makes Args and RawArgs from the pieces of a word.
+type argsBuilder struct {
+	args    []string
+	rawArgs []string
+	arg     bytes.Buffer
+	rawArg  bytes.Buffer
+	started bool
+}
+
+func (this *argsBuilder) write(arg, rawArg string) {
+	this.arg.WriteString(arg)
+	this.rawArg.WriteString(rawArg)
+	this.started = true
+}
+
+func (this *argsBuilder) flush() {
+	if this.started {
+		this.args = append(this.args, this.arg.String())
+		this.rawArgs = append(this.rawArgs, this.rawArg.String())
+	}
+	this.arg.Reset()
+	this.rawArg.Reset()
+	this.started = false
+}
+
+// expandArgs expands words into Args and RawArgs. Braces are expanded
+// first and each result becomes one word. The output of `$(...)`
+// out of quotations is split into words by spaces and newlines.
+// In double quotations, it stays in one word. When `$(...)` runs,
+// %ERRORLEVEL% is set to the errorlevel of the last one.
+func (this *Cmd) expandArgs(ctx context.Context, words []string) (args, rawArgs []string, err error) {
+	var b argsBuilder
+	for _, word0 := range words {
+		if word0 == "$*" && this.frame != nil {
+			// each argument of the function becomes one word.
+			for _, arg1 := range this.frame.args[1:] {
+				b.write(string2word(arg1, true), string2word(arg1, false))
+				b.flush()
+			}
+			continue
+		}
+		for _, word := range expandBrace(word0) {
+			if !strings.Contains(word, "$(") {
+				arg, err := this.expandWord(word, true)
+				if err != nil {
+					return nil, nil, err
+				}
+				rawArg, _ := this.expandWord(word, false)
+				b.write(arg, rawArg)
+				b.flush()
+				continue
+			}
+			if err := this.expandCommandSubst(ctx, word, &b); err != nil {
+				return nil, nil, err
+			}
+			b.flush()
+		}
+	}
+	return b.args, b.rawArgs, nil
+}
+
+// expandCommandSubst splits word into the pieces between `$(...)` and
+// writes them and the outputs of `$(...)` into b. `$((EXPR))` is replaced
+// with the value of the integer expression.
+func (this *Cmd) expandCommandSubst(ctx context.Context, word string, b *argsBuilder) error {
+	quoteNow := NOTQUOTED
+	yenCount := 0
+	last := 0
+	// writePiece expands word[last:end] as the rest of the quotation which
+	// was open at the start of the piece.
+	writePiece := func(end int, quote rune) error {
+		if end <= last {
+			return nil
+		}
+		piece := word[last:end]
+		if quote != NOTQUOTED {
+			piece = string(quote) + piece
+		}
+		arg, err := this.expandWord(piece, true)
+		if err != nil {
+			return err
+		}
+		rawArg, _ := this.expandWord(piece, false)
+		if quote != NOTQUOTED {
+			rawArg = rawArg[1:]
+		}
+		b.write(arg, rawArg)
+		return nil
+	}
+	pieceQuote := NOTQUOTED
+	for i := 0; i < len(word); i++ {
+		ch := word[i]
+		if quoteNow == NOTQUOTED {
+			if yenCount%2 == 0 && (ch == '"' || ch == '\'') {
+				quoteNow = rune(ch)
+			}
+		} else if yenCount%2 == 0 && rune(ch) == quoteNow {
+			quoteNow = NOTQUOTED
+		}
+		if ch == '\\' {
+			yenCount++
+		} else {
+			yenCount = 0
+		}
+		if ch != '$' || quoteNow == '\'' || i+1 >= len(word) || word[i+1] != '(' {
+			continue
+		}
+		text, err := readCommandSubst(word, i)
+		if err != nil {
+			return err
+		}
+		if err := writePiece(i, pieceQuote); err != nil {
+			return err
+		}
+		if isArith(text) {
+			expr, err := this.expandWord(text[3:len(text)-2], true)
+			if err != nil {
+				return err
+			}
+			value, err := this.vars.evalArith(expr)
+			if err != nil {
+				return err
+			}
+			b.write(strconv.FormatInt(value, 10), strconv.FormatInt(value, 10))
+		} else {
+			output, errorlevel, err := this.commandSubst(ctx, text[2:len(text)-1])
+			if err != nil {
+				return err
+			}
+			this.Session().SetLastErrorLevel(errorlevel)
+			if quoteNow == '"' {
+				b.write(output, strings.Replace(output, `"`, `\"`, -1))
+			} else {
+				for j, field := range strings.Fields(output) {
+					if j > 0 {
+						b.flush()
+					}
+					b.write(field, field)
+				}
+			}
+		}
+		i += len(text) - 1
+		last = i + 1
+		pieceQuote = quoteNow
+	}
+	return writePiece(len(word), pieceQuote)
+}
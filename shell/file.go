@@ -0,0 +1,47 @@
+package shell
+
+import (
+	"io"
+	"os"
+)
+
+// FileWriter returns w as *os.File for the code which requires
+// the handle of the OS (for example, the C runtime of Lua).
+// When w is not a file, it returns the pipe whose contents are copied
+// to w, and done closes the pipe and waits for the copy to end.
+func FileWriter(w io.Writer) (f *os.File, done func(), err error) {
+	if f, ok := w.(*os.File); ok {
+		return f, func() {}, nil
+	}
+	r, f, err := os.Pipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	copied := make(chan struct{})
+	go func() {
+		io.Copy(w, r)
+		r.Close()
+		close(copied)
+	}()
+	return f, func() {
+		f.Close()
+		<-copied
+	}, nil
+}
+
+// FileReader returns r as *os.File. When r is not a file, it returns
+// the pipe which the contents of r are copied into, and done closes it.
+func FileReader(r io.Reader) (f *os.File, done func(), err error) {
+	if f, ok := r.(*os.File); ok {
+		return f, func() {}, nil
+	}
+	f, w, err := os.Pipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	go func() {
+		io.Copy(w, r)
+		w.Close()
+	}()
+	return f, func() { f.Close() }, nil
+}
@@ -0,0 +1,597 @@
+package shell
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+)
+
+const FORMAT_INDENT = "    "
+
+type formatter struct {
+	buffer   bytes.Buffer
+	indent   int
+	hereDocs []*Redirecter // the here-documents whose contents are not written yet
+	open     bool          // true after the one-line body of if, for or while
+	unclosed bool          // true after `!(` or `${` which is not closed on the line
+}
+
+// Format returns the source of node in the canonical form: the operators
+// and the redirections are separated by one space, the nodes of
+// a sequence by ` ; ` (a newline after the one-line if, for and while)
+// and the bodies of the blocks are indented.
+// The words are written as they are in the source, so the result is
+// parsed to the same tree as node. The exception is the words starting
+// with `#` or `;` (as `>&N#WORD` makes), whose first character is quoted
+// because they are not a word after a space.
+func Format(node Node) string {
+	f := &formatter{}
+	if sequence, ok := node.(*SequenceT); ok {
+		f.writeSequence(sequence, true, true)
+	} else {
+		f.writeNode(node, true)
+	}
+	f.flushHereDocs()
+	if strings.HasSuffix(f.buffer.String(), "\n") {
+		// the empty delimiter of the here-document needs its line
+		f.write("\n")
+	}
+	if endsWithCaret(f.buffer.String()) {
+		// not to continue to the next line
+		f.write(" ")
+	}
+	return f.buffer.String()
+}
+
+// FormatText parses text and returns it in the canonical form.
+func FormatText(text string) (string, error) {
+	sequence, err := Parse(text)
+	if err != nil {
+		return "", err
+	}
+	return Format(sequence), nil
+}
+
+func (this *formatter) write(text string) {
+	this.buffer.WriteString(text)
+	this.open = false
+}
+
+// newline starts the next line. The contents of the here-documents
+// on the current line are written before it.
+func (this *formatter) newline() {
+	this.flushHereDocs()
+	this.buffer.WriteByte('\n')
+	this.buffer.WriteString(strings.Repeat(FORMAT_INDENT, this.indent))
+	this.open = false
+	this.unclosed = false
+}
+
+func (this *formatter) flushHereDocs() {
+	for _, red := range this.hereDocs {
+		this.buffer.WriteByte('\n')
+		this.buffer.WriteString(red.text)
+		this.buffer.WriteString(string2word(strings.TrimPrefix(red.path, "-"), true))
+	}
+	this.hereDocs = nil
+}
+
+// writeNode writes node. tail is true when nothing follows node on
+// the line but a closer, so node may be an if, for or while whose body
+// is the rest of the line.
+func (this *formatter) writeNode(node Node, tail bool) {
+	switch n := node.(type) {
+	case *StatementT:
+		this.writeStatement(n)
+	case *PipelineT:
+		for i, stage := range n.Stages {
+			if i > 0 {
+				this.writeOperator(n.Pipes[i-1])
+			}
+			this.writeNode(stage, tail && i == len(n.Stages)-1)
+		}
+	case *TimeT:
+		this.write("time ")
+		this.writeNode(n.Node, tail)
+	case *AndOrT:
+		this.writeNode(n.Left, false)
+		this.writeOperator(n.Op)
+		this.writeNode(n.Right, tail)
+	case *BackgroundT:
+		this.writeNode(n.Node, false)
+		this.write(" &")
+	case *SubshellT:
+		this.write("(")
+		this.writeGroupBody(n.Body, ")")
+		this.writeRedirects(n.Redirect)
+	case *GroupT:
+		this.write("{")
+		this.writeGroupBody(n.Body, "}")
+		this.writeRedirects(n.Redirect)
+	case *IfT:
+		this.writeIf(n, tail)
+	case *ForT:
+		this.write("for ")
+		if n.Range {
+			this.write("/L ")
+		}
+		this.write("%" + n.Var + " in (" + forSet(n.Items, n.Range) + ") do")
+		this.writeBody(n.Body, tail)
+	case *WhileT:
+		this.write("while ")
+		this.writeCondition(n.Cond)
+		this.write(" do")
+		this.writeBody(n.Body, tail)
+	case *FunctionT:
+		this.write("function " + n.Name + " {")
+		this.writeGroupBody(n.Body, "}")
+	case *SequenceT:
+		this.writeSequence(n, tail, false)
+	}
+}
+
+// writeOperator writes `|`, `&&` or `||`. After `!(` or `${` not
+// closed, the next command is written on the next line.
+func (this *formatter) writeOperator(op string) {
+	if this.unclosed {
+		this.write(" " + op)
+		this.newline()
+	} else {
+		this.write(" " + op + " ")
+	}
+}
+
+// forSet returns the items of for separated by spaces (`,` for /L).
+// When they are not read as they are, `,` is written before the items
+// starting with `#` or `;` (which are not a word after a space). Then
+// all the separators are spaces or `,`.
+func forSet(items []string, isRange bool) string {
+	separator := func(i int, item string) string {
+		if i <= 0 {
+			return ""
+		} else if isRange {
+			return ","
+		}
+		return " "
+	}
+	candidates := []func(i int, item string) string{
+		separator,
+		func(i int, item string) string {
+			if strings.IndexAny(item, "#;") == 0 {
+				return ","
+			}
+			return separator(i, item)
+		},
+		func(int, string) string { return " " },
+		func(int, string) string { return "," },
+	}
+	for _, candidate := range candidates {
+		var buffer bytes.Buffer
+		for i, item := range items {
+			if s := candidate(i, item); i > 0 || s != " " {
+				buffer.WriteString(s)
+			}
+			buffer.WriteString(item)
+		}
+		if readAsSet(buffer.String(), items) {
+			return buffer.String()
+		}
+	}
+	if isRange {
+		return strings.Join(items, ",")
+	}
+	return strings.Join(items, " ")
+}
+
+// readAsSet returns true when text in the brackets of for is read
+// as items.
+func readAsSet(text string, items []string) bool {
+	text = "(" + text + ")"
+	p := &parser{text: text, reader: strings.NewReader(text)}
+	result, err := p.readForSet()
+	if err != nil || p.reader.Len() > 0 || len(result) != len(items) {
+		return false
+	}
+	for i := range items {
+		if result[i] != items[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// writeSequence writes the nodes separated by ` ; `. After `&`, no separator
+// is needed. When multiline is true, the one-line if, for and while may be
+// followed by the newline instead. Otherwise they can be only the last node.
+func (this *formatter) writeSequence(sequence *SequenceT, tail, multiline bool) {
+	for i, node := range sequence.Nodes {
+		if i > 0 {
+			// `{` is a word only at the end of the text, so the contents
+			// of the here-documents are written before it.
+			if this.open || this.unclosed || (len(this.hereDocs) > 0 && firstWord(node) == "{") {
+				this.newline()
+			} else if _, ok := sequence.Nodes[i-1].(*BackgroundT); ok {
+				this.write(" ")
+			} else {
+				this.write(" ; ")
+			}
+		}
+		if i == len(sequence.Nodes)-1 {
+			this.writeNode(node, tail)
+		} else {
+			this.writeNode(node, multiline)
+		}
+	}
+}
+
+// writeGroupBody writes the body of `( )`, `{ }` and functions
+// after the open bracket, and closer. `}` needs ` ; ` before it.
+// The closer after `!(` or `${` not closed would close it, so it is
+// written on the next line then.
+func (this *formatter) writeGroupBody(body *SequenceT, closer string) {
+	this.write(" ")
+	this.writeSequence(body, true, true)
+	if this.unclosed {
+		this.newline()
+	} else if len(body.Nodes) > 0 {
+		if closer == "}" {
+			this.write(" ;")
+		}
+		this.write(" ")
+	}
+	this.write(closer)
+}
+
+// asLine returns the node written as the one-line body of if, for
+// and while. `( )` there is not a subshell, so the group as the whole
+// body is written with `( )` and a subshell can not be.
+// It returns nil when the body has to be the block.
+func asLine(body *SequenceT) Node {
+	if body == nil || len(body.Nodes) <= 0 {
+		return nil
+	}
+	if len(body.Nodes) > 1 {
+		return body
+	}
+	switch n := body.Nodes[0].(type) {
+	case *SubshellT:
+		return nil
+	case *GroupT:
+		return &SubshellT{Body: n.Body, Redirect: n.Redirect}
+	}
+	return body
+}
+
+// writeBody writes the body of for and while after `do`.
+func (this *formatter) writeBody(body *SequenceT, tail bool) {
+	if line := asLine(body); tail && line != nil {
+		this.write(" ")
+		this.writeNode(line, true)
+		this.open = true
+		return
+	}
+	this.writeBlock(body)
+	this.write("end")
+}
+
+// writeBlock writes the lines of body indented and starts the line
+// of the closer.
+func (this *formatter) writeBlock(body *SequenceT) {
+	this.indent++
+	for _, node := range body.Nodes {
+		this.newline()
+		this.writeNode(node, true)
+	}
+	this.indent--
+	this.newline()
+}
+
+func (this *formatter) writeIf(node *IfT, tail bool) {
+	this.write("if ")
+	this.writeCondition(node.Cond)
+
+	then := asLine(node.Then)
+	var elseIf *IfT
+	if node.Else != nil && len(node.Else.Nodes) == 1 {
+		elseIf, _ = node.Else.Nodes[0].(*IfT)
+	}
+	// THEN may be empty before else: `if COND else ...`
+	emptyThen := len(node.Then.Nodes) <= 0 && node.Else != nil
+	if !tail || (then == nil && !emptyThen) || (node.Else != nil && elseIf == nil && asLine(node.Else) == nil) {
+		this.writeBlock(node.Then)
+		if node.Else == nil {
+			this.write("end")
+		} else if elseIf != nil {
+			// the inner if closes the block.
+			this.write("else ")
+			this.writeIf(elseIf, tail)
+		} else {
+			this.write("else")
+			this.writeBlock(node.Else)
+			this.write("end")
+		}
+		return
+	}
+	if then != nil {
+		// `then` keeps the first word of THEN from being read as `then`
+		// or the operator of the condition.
+		word := leadingWord(firstWord(then))
+		if _, ok := conditionOperators[word]; ok || word == "then" {
+			this.write(" then")
+		}
+		this.write(" ")
+		if node.Else == nil {
+			this.writeNode(then, true)
+			this.open = true
+			return
+		}
+		// THEN before else must not be the one-line if, for and while.
+		this.writeNode(then, false)
+		if n, ok := then.(*SubshellT); !ok || len(n.Redirect) > 0 {
+			this.write(" ;")
+		}
+	}
+	if elseIf != nil {
+		this.write(" else ")
+		this.writeIf(elseIf, true)
+	} else {
+		this.write(" else ")
+		this.writeNode(asLine(node.Else), true)
+		this.open = true
+	}
+}
+
+// firstWord returns the first word of node in lower case.
+func firstWord(node Node) string {
+	switch n := node.(type) {
+	case *StatementT:
+		if len(n.Words) > 0 {
+			return strings.ToLower(n.Words[0])
+		}
+	case *PipelineT:
+		return firstWord(n.Stages[0])
+	case *AndOrT:
+		return firstWord(n.Left)
+	case *BackgroundT:
+		return firstWord(n.Node)
+	case *SequenceT:
+		if len(n.Nodes) > 0 {
+			return firstWord(n.Nodes[0])
+		}
+	}
+	return ""
+}
+
+func (this *formatter) writeCondition(cond *ConditionT) {
+	if cond.IgnoreCase {
+		this.write("/I ")
+	}
+	if cond.Not {
+		this.write("not ")
+	}
+	switch cond.Op {
+	case "exist", "errorlevel", "defined":
+		this.write(cond.Op + " " + cond.Args[0])
+	case "==":
+		// `A==B` is split at the first `==`.
+		compact := cond.Args[0] + "==" + cond.Args[1]
+		if cond.Args[1] == "" || strings.Index(compact, "==") == len(cond.Args[0]) {
+			this.write(compact)
+		} else {
+			this.write(cond.Args[0] + " == " + cond.Args[1])
+		}
+	default:
+		this.write(cond.Args[0] + " " + strings.ToUpper(cond.Op) + " " + cond.Args[1])
+	}
+}
+
+// keywords are the words which can not be the first word of
+// the statement written before its redirections.
+var keywords = map[string]struct{}{
+	"if":       struct{}{},
+	"for":      struct{}{},
+	"while":    struct{}{},
+	"function": struct{}{},
+	"time":     struct{}{},
+	"else":     struct{}{},
+	"end":      struct{}{},
+	"{":        struct{}{},
+	"}":        struct{}{},
+}
+
+// leadingWord returns the word which the parser reads first from text
+// in lower case. It may be a part of the first word (`if` of `if(`).
+func leadingWord(text string) string {
+	p := &parser{text: text, reader: strings.NewReader(text)}
+	return p.peekWord()
+}
+
+// writeStatement writes the words and the redirections after them.
+// When the words start with a keyword, the redirections are written
+// before them. When a part would be joined with the text before it
+// (as `!(` not closed takes `)`), the other is written before it.
+func (this *formatter) writeStatement(statement *StatementT) {
+	redirects := make([]string, 0, len(statement.Redirect))
+	for _, red := range statement.Redirect {
+		redirects = append(redirects, this.redirect(red))
+	}
+	words := make([]string, 0, len(statement.Words)+len(redirects))
+	for _, word := range statement.Words {
+		words = append(words, quoteWord(word))
+	}
+	joined := strings.Join(words, " ")
+	_, keyword := keywords[leadingWord(joined)]
+	a := &arrangement{
+		words:          words,
+		redirect:       statement.Redirect,
+		redirects:      redirects,
+		redirectsFirst: keyword || strings.HasPrefix(joined, "("),
+		budget:         ARRANGE_BUDGET,
+	}
+	parts := a.search(nil, 0, 0)
+	if parts == nil {
+		parts = append(words, redirects...)
+	}
+	line := strings.Join(parts, " ")
+	this.write(line)
+	if takesCloser(line) {
+		this.unclosed = true
+	}
+}
+
+// quoteWord returns word with its first character quoted when it is
+// `#` or `;`, which starts a comment or is an operator after a space.
+func quoteWord(word string) string {
+	if strings.IndexAny(word, "#;") == 0 {
+		return `"` + word[:1] + `"` + word[1:]
+	}
+	return word
+}
+
+// ARRANGE_BUDGET is the number of the lines tried to arrange a statement.
+const ARRANGE_BUDGET = 1000
+
+// arrangement finds the order of the words and the redirections
+// of a statement in which the line is read as the statement.
+type arrangement struct {
+	words          []string
+	redirect       []*Redirecter
+	redirects      []string // redirect written
+	redirectsFirst bool
+	budget         int
+}
+
+// search returns parts followed by the rest of the words from w and
+// the redirections from r. The redirections are taken first when
+// redirectsFirst is true and the words are otherwise. It returns nil
+// when no order is found.
+func (this *arrangement) search(parts []string, w, r int) []string {
+	words := this.words
+	if w >= len(words) && r >= len(this.redirects) {
+		return parts
+	}
+	for _, takeRedirect := range []bool{this.redirectsFirst, !this.redirectsFirst} {
+		next, nextW, nextR := "", w, r
+		if takeRedirect && r < len(this.redirects) {
+			next, nextR = this.redirects[r], r+1
+		} else if !takeRedirect && w < len(words) {
+			next, nextW = words[w], w+1
+		} else {
+			continue
+		}
+		if this.budget--; this.budget < 0 {
+			return nil
+		}
+		line := append(parts[:len(parts):len(parts)], next)
+		if readAsStatement(strings.Join(line, " "), words[:nextW], this.redirect[:nextR]) {
+			if result := this.search(line, nextW, nextR); result != nil {
+				return result
+			}
+		}
+	}
+	return nil
+}
+
+// readAsStatement returns true when line is read as the statement
+// of words and redirect. The contents of the here-documents are not
+// compared because they are not on the line.
+func readAsStatement(line string, words []string, redirect []*Redirecter) bool {
+	p := &parser{text: line, reader: strings.NewReader(line)}
+	statement, err := p.readStatement()
+	if err != nil || p.reader.Len() > 0 ||
+		len(statement.Words) != len(words) || len(statement.Redirect) != len(redirect) {
+		return false
+	}
+	for i, word := range words {
+		if statement.Words[i] != word {
+			return false
+		}
+	}
+	for i, red := range redirect {
+		read := *statement.Redirect[i]
+		read.text, read.expand = red.text, red.expand
+		if read != *red {
+			return false
+		}
+	}
+	return true
+}
+
+// separated returns true when no token is across the parts joined
+// by spaces.
+func separated(parts []string) bool {
+	line := strings.Join(parts, " ")
+	p := &parser{text: line, reader: strings.NewReader(line)}
+	tokens := p.lexerAt(true).Tokens()
+	end := -1
+	for _, part := range parts {
+		end += len(part) + 1
+		for _, token := range tokens {
+			if token.Pos < end && token.End > end {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// takesCloser returns true when `)` or `}` after text on the line could
+// be a part of it because it has `!(` or `${` which is not closed.
+func takesCloser(text string) bool {
+	return !separated([]string{text, strings.Repeat(")", strings.Count(text, "(")+1)}) ||
+		!separated([]string{text, strings.Repeat("}", strings.Count(text, "{")+1)})
+}
+
+func (this *formatter) writeRedirects(redirect []*Redirecter) {
+	for _, red := range redirect {
+		text := this.redirect(red)
+		this.write(" " + text)
+		if takesCloser(text) {
+			this.unclosed = true
+		}
+	}
+}
+
+// redirect returns red as `N>PATH`, `N>&M`, `<<WORD` and so on.
+// The default descriptor is omitted. The here-document is kept
+// to be written after the line.
+func (this *formatter) redirect(red *Redirecter) string {
+	var buffer bytes.Buffer
+	if red.isInput {
+		if red.no != 0 {
+			buffer.WriteString(strconv.Itoa(red.no))
+		}
+		switch {
+		case red.hereString:
+			buffer.WriteString("<<<")
+		case red.hereDoc:
+			buffer.WriteString("<<")
+			this.hereDocs = append(this.hereDocs, red)
+		default:
+			buffer.WriteString("<")
+		}
+	} else {
+		if red.both {
+			buffer.WriteString("&")
+		} else if red.no != 1 {
+			buffer.WriteString(strconv.Itoa(red.no))
+		}
+		buffer.WriteString(">")
+		if red.isAppend {
+			buffer.WriteString(">")
+		}
+	}
+	switch {
+	case red.isClose:
+		buffer.WriteString("&-")
+	case red.dupFrom >= 0:
+		buffer.WriteString("&" + strconv.Itoa(red.dupFrom))
+	default:
+		if red.path != "" && strings.ContainsRune("(&<>", rune(red.path[0])) {
+			// not to be read as a part of the operator
+			buffer.WriteString(" ")
+		}
+		buffer.WriteString(red.path)
+	}
+	return buffer.String()
+}
@@ -0,0 +1,19 @@
+//go:build go1.18
+// +build go1.18
+
+package shell
+
+import (
+	"testing"
+)
+
+func FuzzFormat(f *testing.F) {
+	for _, p := range formatSamples {
+		f.Add(p.text)
+	}
+	f.Fuzz(func(t *testing.T, text string) {
+		if formatted, message := checkFormat(text); message != "" {
+			t.Errorf("`%s`: `%s`: %s", text, formatted, message)
+		}
+	})
+}
@@ -0,0 +1,131 @@
+package shell
+
+import (
+	"reflect"
+	"testing"
+	"unsafe"
+)
+
+// clearSource zeroes the spans and the sources kept in the nodes
+// to compare the trees parsed from the different texts.
+func clearSource(value reflect.Value) {
+	switch value.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if !value.IsNil() {
+			clearSource(value.Elem())
+		}
+	case reflect.Slice:
+		for i := 0; i < value.Len(); i++ {
+			clearSource(value.Index(i))
+		}
+	case reflect.Struct:
+		for i := 0; i < value.NumField(); i++ {
+			field := value.Type().Field(i)
+			if field.Type == reflect.TypeOf(span{}) {
+				reflect.NewAt(field.Type, unsafe.Pointer(value.Field(i).UnsafeAddr())).Elem().Set(reflect.Zero(field.Type))
+			} else if field.Name == "Text" && value.Type() == reflect.TypeOf(BackgroundT{}) {
+				value.Field(i).SetString("")
+			} else {
+				clearSource(value.Field(i))
+			}
+		}
+	}
+}
+
+// checkFormat returns the formatted text and "" when it is parsed to
+// the same tree as text and formatted to itself again.
+func checkFormat(text string) (string, string) {
+	source, err := Parse(text)
+	if err != nil {
+		return "", ""
+	}
+	formatted := Format(source)
+	result, err := Parse(formatted)
+	if err != nil {
+		return formatted, err.Error()
+	}
+	if again := Format(result); again != formatted {
+		return formatted, "formatted again: " + again
+	}
+	// Format quotes `#` and `;` starting the words.
+	Walk(source, func(node Node) bool {
+		if statement, ok := node.(*StatementT); ok {
+			for i, word := range statement.Words {
+				statement.Words[i] = quoteWord(word)
+			}
+		}
+		return true
+	})
+	clearSource(reflect.ValueOf(source))
+	clearSource(reflect.ValueOf(result))
+	if !reflect.DeepEqual(source, result) {
+		return formatted, "the tree is changed"
+	}
+	return formatted, ""
+}
+
+var formatSamples = []struct {
+	text   string
+	expect string
+}{
+	{"echo   a  b>x.txt   2>&1|sort&&echo ok||echo ng",
+		"echo a b >x.txt 2>&1 | sort && echo ok || echo ng"},
+	{"a ; b & c |& d>>log 1>&2 <in 3>&-",
+		"a ; b & c |& d >>log >&2 <in 3>&-"},
+	{`echo "a  b" 'c  d' %X% $(ls  -l) &>out`,
+		`echo "a  b" 'c  d' %X% $(ls  -l) &>out`},
+	{"(a ; b) >x ; { c ; d ; } <y ; ( )", "( a ; b ) >x ; { c ; d ; } <y ; ( )"},
+	{"if /i not %a%==b (echo x) else (echo y)", "if /I not %a%==b ( echo x ) else ( echo y )"},
+	{"if exist x  echo a ;echo b", "if exist x echo a ; echo b"},
+	{"if a equ b (echo x) else if c==d echo y", "if a EQU b ( echo x ) else if c==d echo y"},
+	{"if a==b (x) ; y", "if a==b ( x ) ; y"},
+	{"if a==b (x) else y\necho z", "if a==b ( x ) else y\necho z"},
+	{"if a==b x;y ; else z", "if a==b x;y ; else z"},
+	{"if a==b\n(x)\nelse\ny\nend | more", "if a==b\n    ( x )\nelse\n    y\nend | more"},
+	{"if a==b then\n  x\n  y\nelse\n  z\nend | more",
+		"if a==b\n    x\n    y\nelse\n    z\nend | more"},
+	{"for %%i in (a,b c) do echo %%i", "for %i in (a b c) do echo %%i"},
+	{"for /l %i in (1 2 3) do (echo %i)", "for /L %i in (1,2,3) do ( echo %i )"},
+	{"while not errorlevel 1\nx\nend", "while not errorlevel 1 do x"},
+	{"while a lss 3 do\nx\nend & y", "while a LSS 3 do\n    x\nend & y"},
+	{"function f { echo $1\n}", "function f { echo $1 ; }"},
+	{"time a|b", "time a | b"},
+	{"cat <<EOF ; echo x\nline %A%\nEOF\necho done", "cat <<EOF ; echo x ; echo done\nline %A%\nEOF"},
+	{">x if a", ">x if a"},
+	{">0 if(", ">0 if("},
+	{"!(\n)", "!(\n)"},
+	{"!(|\n)", "!( |\n)"},
+	{"<<'' 0\n\n", "0 <<''\n\n"},
+	{"for %0 in(0,0,#00)do 0", "for %0 in (0 0,#00) do 0"},
+	{"for %0 in(,#)do 0", "for %0 in (,#) do 0"},
+	{"for %0 in(,;#)do 0", "for %0 in (,;#) do 0"},
+	{"for %0 in(;())do 0", "for %0 in (;()) do 0"},
+	{"for %0 in(;( ))do 0", "for %0 in (;( )) do 0"},
+	{"if = == 0 0", "if = == 0 0"},
+	{"if 0==<0 equ", "if 0== then equ <0"},
+	{"if a==b then then >x", "if a==b then then >x"},
+	{"if 0==;==(", "if 0== then ==("},
+	{"if 0== else else", "if 0== else else"},
+	{"x >&1#a b", `x "#"a b >&1`},
+	{"x 2>&-;a", `x ";"a 2>&-`},
+	{"if 0==0 >&1#", `if 0==0 "#" >&1`},
+	{"( ls !(\n) >x", "( ls !(\n) >x"},
+	{"sort <<-'EOF' <<<%X% 2>>err\n\tb\n\ta\n\tEOF", "sort <<-'EOF' <<<%X% 2>>err\nb\na\nEOF"},
+	{"diff <(ls a)   >(cat) !(*.go|*.txt)", "diff <(ls a) >(cat) !(*.go|*.txt)"},
+}
+
+func TestFormat(t *testing.T) {
+	for _, p := range formatSamples {
+		result, err := FormatText(p.text)
+		if err != nil {
+			t.Errorf("`%s`: %s", p.text, err.Error())
+			continue
+		}
+		if result != p.expect {
+			t.Errorf("`%s`:\n%s\nexpect\n%s", p.text, result, p.expect)
+		}
+		if formatted, message := checkFormat(p.text); message != "" {
+			t.Errorf("`%s`: `%s`: %s", p.text, formatted, message)
+		}
+	}
+}
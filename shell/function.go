@@ -0,0 +1,99 @@
+package shell
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// MAX_CALL_DEPTH is the limit of nesting calls of functions and aliases.
+const MAX_CALL_DEPTH = 100
+
+// ErrReturn is the error which the built-in command `return` returns
+// to end the function running.
+var ErrReturn = errors.New("return: not in a function")
+
+// FunctionNames returns the names of the shell functions of DefaultSession sorted.
+func FunctionNames() []string {
+	return DefaultSession.FunctionNames()
+}
+
+// frame is the context of the function running.
+type frame struct {
+	args []string // the raw arguments. args[0] is the function name.
+}
+
+// EnterCall records that the alias or function `name` is called on this.
+// It fails when the calls are nested too deeply.
+func (this *Cmd) EnterCall(name string) error {
+	if len(this.callStack) >= MAX_CALL_DEPTH {
+		return fmt.Errorf("%s: too deep recursive calls", name)
+	}
+	stack := make([]string, len(this.callStack), len(this.callStack)+1)
+	copy(stack, this.callStack)
+	this.callStack = append(stack, strings.ToLower(name))
+	return nil
+}
+
+// IsCalling returns true when the alias or function `name` is called
+// on this and not finished yet.
+func (this *Cmd) IsCalling(name string) bool {
+	name = strings.ToLower(name)
+	for _, name1 := range this.callStack {
+		if name1 == name {
+			return true
+		}
+	}
+	return false
+}
+
+// InFunction returns true when this runs in a shell function.
+func (this *Cmd) InFunction() bool {
+	return this.frame != nil
+}
+
+func (this *Cmd) defineFunction(node *FunctionT) (int, error) {
+	this.Session().SetFunction(node)
+	return 0, nil
+}
+
+func (this *Cmd) callFunction(ctx context.Context, function *FunctionT) (int, error) {
+	if err := this.EnterCall(function.Name); err != nil {
+		return 255, err
+	}
+	this.frame = &frame{args: this.RawArgs}
+	this.vars = newVariables(this.vars)
+	this.loopVars = nil
+	errorlevel, err := this.run(ctx, function.Body)
+	if err == ErrReturn {
+		err = nil
+	}
+	return errorlevel, err
+}
+
+var rxPositional = regexp.MustCompile(`\$(\*|#|[0-9]+)`)
+
+// expandPositional replaces $1..$N, $* and $# in word with the arguments
+// of the function running.
+func (this *Cmd) expandPositional(word string) string {
+	if this.frame == nil || strings.IndexByte(word, '$') < 0 {
+		return word
+	}
+	args := this.frame.args
+	return rxPositional.ReplaceAllStringFunc(word, func(s string) string {
+		switch s {
+		case "$*":
+			return strings.Join(args[1:], " ")
+		case "$#":
+			return strconv.Itoa(len(args) - 1)
+		}
+		i, _ := strconv.Atoi(s[1:])
+		if i < len(args) {
+			return args[i]
+		}
+		return ""
+	})
+}
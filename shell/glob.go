@@ -0,0 +1,351 @@
+package shell
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// hasWildcard returns true when s has the characters which Glob expands.
+func hasWildcard(s string) bool {
+	return strings.ContainsAny(s, "*?[") || strings.Contains(s, "!(")
+}
+
+// Glob returns the sorted filenames matching pattern.
+//
+//	?          one character
+//	*          any characters
+//	[a-z]      one character in the class ([!a-z] or [^a-z] for not in it)
+//	!(A|B)     any characters except for A and B
+//	{A,B}      A or B
+//	**         any depth of directories as a component (`**\*.go`)
+//
+// The wildcards can be used in directory components too. The names
+// starting with `.` match only the components starting with `.`.
+// The case is ignored unless GlobCaseSensitive is true.
+func (this *Session) Glob(pattern string) []string {
+	fold := !this.GlobCaseSensitive()
+	result := []string{}
+	for _, pattern1 := range expandBrace(pattern) {
+		g := &globber{fold: fold}
+		g.glob(pattern1)
+		sort.Strings(g.matches)
+		result = append(result, g.matches...)
+	}
+	return result
+}
+
+// Glob returns the filenames matching pattern with the options of
+// DefaultSession.
+func Glob(pattern string) []string {
+	return DefaultSession.Glob(pattern)
+}
+
+func isPathSeparator(ch rune) bool {
+	return ch == '/' || ch == '\\'
+}
+
+type globber struct {
+	fold    bool
+	sep     string
+	matches []string
+}
+
+func (this *globber) glob(pattern string) {
+	root := filepath.VolumeName(pattern)
+	rest := pattern[len(root):]
+	// the filenames found are joined with the separator used in pattern.
+	this.sep = string(os.PathSeparator)
+	if i := strings.IndexAny(rest, `/\`); i >= 0 {
+		this.sep = rest[i : i+1]
+	}
+	for len(rest) > 0 && isPathSeparator(rune(rest[0])) {
+		root += rest[:1]
+		rest = rest[1:]
+	}
+	this.walk(root, strings.FieldsFunc(rest, isPathSeparator))
+}
+
+func (this *globber) join(dir, name string) string {
+	if dir == "" || strings.HasSuffix(dir, ":") || isPathSeparator(rune(dir[len(dir)-1])) {
+		return dir + name
+	}
+	return dir + this.sep + name
+}
+
+// readDir returns the entries of dir ("" is the current directory).
+func readDir(dir string) ([]os.FileInfo, error) {
+	if dir == "" {
+		dir = "."
+	}
+	return ioutil.ReadDir(dir)
+}
+
+func isDir(path string, info os.FileInfo) bool {
+	if info.Mode()&os.ModeSymlink != 0 {
+		if stat, err := os.Stat(path); err == nil {
+			return stat.IsDir()
+		}
+	}
+	return info.IsDir()
+}
+
+// walkAll appends all the files and directories under dir
+// to this.matches for `**` at the end of the pattern.
+func (this *globber) walkAll(dir string) {
+	entries, err := readDir(dir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if name := entry.Name(); !strings.HasPrefix(name, ".") {
+			path := this.join(dir, name)
+			this.matches = append(this.matches, path)
+			// the links are not followed not to loop.
+			if entry.IsDir() {
+				this.walkAll(path)
+			}
+		}
+	}
+}
+
+// walk appends the paths under dir matching components to this.matches.
+func (this *globber) walk(dir string, components []string) {
+	if len(components) <= 0 {
+		if dir != "" {
+			this.matches = append(this.matches, dir)
+		}
+		return
+	}
+	component := components[0]
+	if component == "**" {
+		if len(components) == 1 {
+			this.walkAll(dir)
+			return
+		}
+		// `**` as zero directories
+		this.walk(dir, components[1:])
+		entries, err := readDir(dir)
+		if err != nil {
+			return
+		}
+		for _, entry := range entries {
+			// the links are not followed not to loop.
+			if name := entry.Name(); entry.IsDir() && !strings.HasPrefix(name, ".") {
+				this.walk(this.join(dir, name), components)
+			}
+		}
+		return
+	}
+	if !hasWildcard(component) {
+		path := this.join(dir, component)
+		if _, err := os.Stat(path); err == nil {
+			this.walk(path, components[1:])
+		}
+		return
+	}
+	entries, err := readDir(dir)
+	if err != nil {
+		return
+	}
+	pattern := []rune(component)
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasPrefix(name, ".") && !strings.HasPrefix(component, ".") {
+			continue
+		}
+		if !globMatch(pattern, []rune(name), this.fold) {
+			continue
+		}
+		path := this.join(dir, name)
+		if len(components) > 1 && !isDir(path, entry) {
+			continue
+		}
+		this.walk(path, components[1:])
+	}
+}
+
+func equalRune(a, b rune, fold bool) bool {
+	return a == b || (fold && unicode.ToLower(a) == unicode.ToLower(b))
+}
+
+// classEnd returns the index of `]` closing `[` at pattern[0] or -1.
+func classEnd(pattern []rune) int {
+	i := 1
+	if i < len(pattern) && (pattern[i] == '!' || pattern[i] == '^') {
+		i++
+	}
+	if i < len(pattern) && pattern[i] == ']' {
+		i++
+	}
+	for ; i < len(pattern); i++ {
+		if pattern[i] == ']' {
+			return i
+		}
+	}
+	return -1
+}
+
+// matchClass returns true when ch is in the class `[...]` without brackets.
+func matchClass(class []rune, ch rune, fold bool) bool {
+	not := false
+	if len(class) > 0 && (class[0] == '!' || class[0] == '^') {
+		not = true
+		class = class[1:]
+	}
+	for i := 0; i < len(class); i++ {
+		if i+2 < len(class) && class[i+1] == '-' {
+			low, high := class[i], class[i+2]
+			if (low <= ch && ch <= high) ||
+				(fold && ((low <= unicode.ToLower(ch) && unicode.ToLower(ch) <= high) ||
+					(low <= unicode.ToUpper(ch) && unicode.ToUpper(ch) <= high))) {
+				return !not
+			}
+			i += 2
+		} else if equalRune(class[i], ch, fold) {
+			return !not
+		}
+	}
+	return not
+}
+
+// parenEnd returns the index of `)` closing `(` at pattern[0] or -1.
+func parenEnd(pattern []rune) int {
+	depth := 0
+	for i, ch := range pattern {
+		switch ch {
+		case '(':
+			depth++
+		case ')':
+			if depth--; depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// splitAlternatives splits the inside of `!(...)` with `|` not nested.
+func splitAlternatives(pattern []rune) [][]rune {
+	result := [][]rune{}
+	depth := 0
+	last := 0
+	for i, ch := range pattern {
+		switch ch {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case '|':
+			if depth == 0 {
+				result = append(result, pattern[last:i])
+				last = i + 1
+			}
+		}
+	}
+	return append(result, pattern[last:])
+}
+
+// globMatch returns true when the whole name matches the pattern
+// of one component.
+func globMatch(pattern, name []rune, fold bool) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 0 && pattern[0] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) <= 0 {
+				return true
+			}
+			for i := 0; i <= len(name); i++ {
+				if globMatch(pattern, name[i:], fold) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(name) <= 0 {
+				return false
+			}
+			pattern, name = pattern[1:], name[1:]
+			continue
+		case '[':
+			if end := classEnd(pattern); end > 0 {
+				if len(name) <= 0 || !matchClass(pattern[1:end], name[0], fold) {
+					return false
+				}
+				pattern, name = pattern[end+1:], name[1:]
+				continue
+			}
+		case '!':
+			if len(pattern) > 1 && pattern[1] == '(' {
+				if end := parenEnd(pattern[1:]); end > 0 {
+					alternatives := splitAlternatives(pattern[2 : end+1])
+					rest := pattern[end+2:]
+					for i := 0; i <= len(name); i++ {
+						if !matchAny(alternatives, name[:i], fold) && globMatch(rest, name[i:], fold) {
+							return true
+						}
+					}
+					return false
+				}
+			}
+		}
+		if len(name) <= 0 || !equalRune(pattern[0], name[0], fold) {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) <= 0
+}
+
+func matchAny(patterns [][]rune, name []rune, fold bool) bool {
+	for _, pattern := range patterns {
+		if globMatch(pattern, name, fold) {
+			return true
+		}
+	}
+	return false
+}
+
+// GlobArgs replaces the arguments having wildcards except for Args[0]
+// with the filenames matching them. RawArgs are replaced too, and
+// the filenames are quoted there when the wildcard was quoted or
+// they have spaces, so that makeCmdline keeps them one argument.
+func (this *Cmd) GlobArgs() {
+	args := make([]string, 0, len(this.Args))
+	rawArgs := make([]string, 0, len(this.Args))
+	for i, arg := range this.Args {
+		rawArg := arg
+		if i < len(this.RawArgs) {
+			rawArg = this.RawArgs[i]
+		}
+		if i == 0 || !hasWildcard(arg) {
+			args = append(args, arg)
+			rawArgs = append(rawArgs, rawArg)
+			continue
+		}
+		matches := this.Session().Glob(arg)
+		if len(matches) <= 0 {
+			if !this.Session().GlobNull() {
+				args = append(args, arg)
+				rawArgs = append(rawArgs, rawArg)
+			}
+			continue
+		}
+		for _, match := range matches {
+			args = append(args, match)
+			if strings.HasPrefix(rawArg, `"`) || strings.ContainsAny(match, " \t") {
+				rawArgs = append(rawArgs, `"`+match+`"`)
+			} else {
+				rawArgs = append(rawArgs, match)
+			}
+		}
+	}
+	this.Args = args
+	this.RawArgs = rawArgs
+}
@@ -0,0 +1,90 @@
+package shell
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func makeGlobTree(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "nyagos-glob")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	for _, name := range []string{
+		"a.go", "b.txt", "x y.txt", ".hidden.go",
+		"sub/c.go", "sub/deep/d.go", "Sub2/E.GO", ".git/f.go",
+	} {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(path), 0777)
+		if err := ioutil.WriteFile(path, []byte{}, 0666); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	return dir
+}
+
+func TestGlob(t *testing.T) {
+	dir := makeGlobTree(t)
+	defer os.RemoveAll(dir)
+
+	session := NewSession()
+	test := func(pattern, expect string) {
+		t.Helper()
+		matches := session.Glob(dir + "/" + pattern)
+		for i, match := range matches {
+			matches[i] = filepath.ToSlash(strings.TrimPrefix(match, dir+"/"))
+		}
+		if result := strings.Join(matches, " "); result != expect {
+			t.Errorf("Glob(%q)=%q, expected %q", pattern, result, expect)
+		}
+	}
+	test("*.go", "a.go")
+	test("**/*.go", "Sub2/E.GO a.go sub/c.go sub/deep/d.go")
+	test("sub/**", "sub/c.go sub/deep sub/deep/d.go")
+	test("s*/*.go", "Sub2/E.GO sub/c.go")
+	test("[a-b].*", "a.go b.txt")
+	test("[!a]*", "Sub2 b.txt sub x y.txt")
+	test("!(*.go|sub*)", "b.txt x y.txt")
+	test("{b,a}.*", "b.txt a.go")
+	test(".*", ".git .hidden.go")
+	test("nothing*", "")
+
+	session.SetGlobCaseSensitive(true)
+	test("**/*.go", "a.go sub/c.go sub/deep/d.go")
+	test("*/[A-Z].GO", "Sub2/E.GO")
+}
+
+func TestGlobArgs(t *testing.T) {
+	dir := makeGlobTree(t)
+	defer os.RemoveAll(dir)
+
+	session := NewSession()
+	test := func(expectArgs, expectRawArgs string) {
+		t.Helper()
+		cmd := session.NewCmd()
+		cmd.Args = []string{"cmd", "nothing*", "q", dir + "/*.txt"}
+		cmd.RawArgs = []string{"cmd", "nothing*", `"q"`, dir + "/*.txt"}
+		cmd.GlobArgs()
+		args := strings.Replace(strings.Join(cmd.Args, ","), dir, "DIR", -1)
+		if args != expectArgs {
+			t.Errorf("Args=%s", args)
+		}
+		rawArgs := strings.Replace(strings.Join(cmd.RawArgs, ","), dir, "DIR", -1)
+		if rawArgs != expectRawArgs {
+			t.Errorf("RawArgs=%s", rawArgs)
+		}
+		cmdline := strings.Replace(makeCmdline(cmd.Args, cmd.RawArgs), dir, "DIR", -1)
+		if expectCmdline := strings.Replace(expectRawArgs, ",", " ", -1); cmdline != expectCmdline {
+			t.Errorf("makeCmdline=%s", cmdline)
+		}
+	}
+	test("cmd,nothing*,q,DIR/b.txt,DIR/x y.txt",
+		`cmd,nothing*,"q",DIR/b.txt,"DIR/x y.txt"`)
+
+	session.SetGlobNull(true)
+	test("cmd,q,DIR/b.txt,DIR/x y.txt",
+		`cmd,"q",DIR/b.txt,"DIR/x y.txt"`)
+}
@@ -8,18 +8,15 @@ import (
 	"os"
 	"os/exec"
 	"reflect"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
 
-	"github.com/zetamatta/go-findfile"
-
 	"github.com/zetamatta/nyagos/dos"
 	. "github.com/zetamatta/nyagos/ifdbg"
 )
 
-var WildCardExpansionAlways = false
-
 type CommandNotFound struct {
 	Name string
 	Err  error
@@ -44,12 +41,14 @@ func isElevationRequired(err error) bool {
 	return ok && e.Err == syscall.Errno(0x2e4)
 }
 
+// Cmd is the interpreter and the command running on it.
+// Stdin, Stdout and Stderr need not be files. They are converted into
+// the handles of the OS only when an external command is spawned.
 type Cmd struct {
-	Stdout       *os.File
-	Stderr       *os.File
-	Stdin        *os.File
+	Stdout       io.Writer
+	Stderr       io.Writer
+	Stdin        io.Reader
 	Args         []string
-	HookCount    int
 	Tag          interface{}
 	PipeSeq      [2]uint
 	IsBackGround bool
@@ -58,6 +57,19 @@ type Cmd struct {
 	OnFork  func(*Cmd) error
 	OffFork func(*Cmd) error
 	Closers []io.Closer
+
+	loopVars  map[string]string // the variables of for-loops running
+	callStack []string          // the names of aliases and functions running
+	frame     *frame            // the function running
+
+	session    *Session            // the state shared with the clones
+	extraFiles map[int]interface{} // the descriptors except for 0,1,2
+	vars       *variables          // the shell variables shared with the clones
+	job        *Job                // the background job which this runs in
+	timer      *cpuTimer           // the timer of `time` running
+
+	conditional int  // > 0 while the left side of && and || runs
+	concurrent  bool // true while this runs with the other stages of a pipeline
 }
 
 func (this *Cmd) GetRawArgs() []string {
@@ -73,15 +85,26 @@ func (this *Cmd) Close() {
 	}
 }
 
+// New returns the interpreter on DefaultSession.
 func New() *Cmd {
-	this := Cmd{
+	return DefaultSession.NewCmd()
+}
+
+func newCmd() *Cmd {
+	return &Cmd{
 		Stdin:  os.Stdin,
 		Stdout: os.Stdout,
 		Stderr: os.Stderr,
+		vars:   newVariables(nil),
 	}
-	this.PipeSeq[0] = pipeSeq
-	this.PipeSeq[1] = 0
-	return &this
+}
+
+// Session returns the session which this runs on.
+func (this *Cmd) Session() *Session {
+	if this.session == nil {
+		return DefaultSession
+	}
+	return this.session
 }
 
 func (this *Cmd) Clone() (*Cmd, error) {
@@ -91,44 +114,44 @@ func (this *Cmd) Clone() (*Cmd, error) {
 	rv.Stdin = this.Stdin
 	rv.Stdout = this.Stdout
 	rv.Stderr = this.Stderr
-	rv.HookCount = this.HookCount
 	rv.Tag = this.Tag
 	rv.PipeSeq = this.PipeSeq
 	rv.Closers = nil
 	rv.OnFork = this.OnFork
 	rv.OffFork = this.OffFork
+	rv.loopVars = this.loopVars
+	rv.callStack = this.callStack
+	rv.frame = this.frame
+	rv.session = this.session
+	rv.extraFiles = this.extraFiles
+	rv.vars = this.vars
+	rv.job = this.job
+	rv.timer = this.timer
+	rv.conditional = this.conditional
+	rv.concurrent = this.concurrent
 	return rv, nil
 }
 
 type ArgsHookT func(it *Cmd, args []string) ([]string, error)
 
-var argsHook = func(it *Cmd, args []string) ([]string, error) {
-	return args, nil
-}
-
+// SetArgsHook sets the filter of the arguments of DefaultSession.
 func SetArgsHook(argsHook_ ArgsHookT) (rv ArgsHookT) {
-	rv, argsHook = argsHook, argsHook_
-	return
+	return DefaultSession.SetArgsHook(argsHook_)
 }
 
 type HookT func(context.Context, *Cmd) (int, bool, error)
 
-var hook = func(context.Context, *Cmd) (int, bool, error) {
-	return 0, false, nil
-}
-
+// SetHook sets the hook of DefaultSession.
 func SetHook(hook_ HookT) (rv HookT) {
-	rv, hook = hook, hook_
-	return
+	return DefaultSession.SetHook(hook_)
 }
 
-var OnCommandNotFound = func(this *Cmd, err error) error {
-	err = &CommandNotFound{this.Args[0], err}
-	return err
+// SetOnCommandNotFound sets the function making the error of
+// the command not found on DefaultSession.
+func SetOnCommandNotFound(f func(*Cmd, error) error) (rv func(*Cmd, error) error) {
+	return DefaultSession.SetOnCommandNotFound(f)
 }
 
-var LastErrorLevel int
-
 func nvl(a *os.File, b *os.File) *os.File {
 	if a != nil {
 		return a
@@ -164,16 +187,24 @@ func (this *Cmd) spawnvp_noerrmsg(ctx context.Context) (int, error) {
 		print("spawnvp_noerrmsg('", this.Args[0], "')\n")
 	}
 
+	// shell functions
+	if function, ok := this.Session().Function(this.Args[0]); ok {
+		this.Trace()
+		return this.callFunction(ctx, function)
+	}
+
 	// aliases and lua-commands
-	if errorlevel, done, err := hook(ctx, this); done || err != nil {
+	if errorlevel, done, err := this.Session().getHook()(ctx, this); done || err != nil {
 		return errorlevel, err
 	}
 
+	this.Trace()
+
 	// command not found hook
 	var err error
 	path1 := dos.LookPath(this.Args[0], "NYAGOSPATH")
 	if path1 == "" {
-		return 255, OnCommandNotFound(this, os.ErrNotExist)
+		return 255, this.Session().getOnCommandNotFound()(this, os.ErrNotExist)
 	}
 	this.Args[0] = path1
 
@@ -181,8 +212,8 @@ func (this *Cmd) spawnvp_noerrmsg(ctx context.Context) (int, error) {
 		print("exec.LookPath(", this.Args[0], ")==", path1, "\n")
 	}
 
-	if WildCardExpansionAlways {
-		this.Args = findfile.Globs(this.Args)
+	if this.Session().WildCardExpansionAlways() {
+		this.GlobArgs()
 	}
 
 	cmd1 := exec.Command(this.Args[0], this.Args[1:]...)
@@ -198,7 +229,23 @@ func (this *Cmd) spawnvp_noerrmsg(ctx context.Context) (int, error) {
 		println(cmdline)
 	}
 	cmd1.SysProcAttr.CmdLine = cmdline
-	err = cmd1.Run()
+	err = cmd1.Start()
+	if err == nil {
+		if this.job != nil {
+			this.job.addProcess(cmd1.Process)
+		}
+		err = cmd1.Wait()
+		if this.job != nil {
+			this.job.removeProcess(cmd1.Process)
+		}
+		if this.timer != nil {
+			this.timer.add(cmd1.ProcessState)
+		}
+		if err == io.ErrClosedPipe {
+			// the next stage of the pipeline ended before reading all.
+			err = nil
+		}
+	}
 	if isElevationRequired(err) {
 		cmdline := ""
 		if len(cmd1.Args) >= 2 {
@@ -237,7 +284,13 @@ func (this *Cmd) Spawnvp() (int, error) {
 
 func (this *Cmd) SpawnvpContext(ctx context.Context) (int, error) {
 	errorlevel, err := this.spawnvp_noerrmsg(ctx)
-	if err != nil && err != io.EOF && !IsAlreadyReported(err) {
+	return errorlevel, this.report(err)
+}
+
+// report prints err to the standard error of this and returns it as
+// AlreadyReportedError unless it has been reported or it stops the script.
+func (this *Cmd) report(err error) error {
+	if err != nil && err != io.EOF && err != ErrReturn && !IsAlreadyReported(err) && !IsErrorLevelError(err) {
 		if DBG {
 			val := reflect.ValueOf(err)
 			fmt.Fprintf(this.Stderr, "error-type=%s\n", val.Type())
@@ -245,174 +298,552 @@ func (this *Cmd) SpawnvpContext(ctx context.Context) (int, error) {
 		fmt.Fprintln(this.Stderr, err.Error())
 		err = AlreadyReportedError{err}
 	}
-	return errorlevel, err
+	return err
 }
 
-var pipeSeq uint = 0
-
 func (this *Cmd) Interpret(text string) (int, error) {
 	return this.InterpretContext(context.Background(), text)
 }
 
-type gotoEol struct{}
-
-var GotoEol = gotoEol{}
-
-func (this *Cmd) InterpretContext(ctx_ context.Context, text string) (errorlevel int, finalerr error) {
+func (this *Cmd) InterpretContext(ctx context.Context, text string) (errorlevel int, finalerr error) {
 	if DBG {
 		print("Interpret('", text, "')\n")
 	}
 	if this == nil {
 		return 255, errors.New("Fatal Error: Interpret: instance is nil")
 	}
-	errorlevel = 0
-	finalerr = nil
 
-	statements, statementsErr := Parse(text)
-	if statementsErr != nil {
+	tree, treeErr := Parse(text)
+	if treeErr != nil {
 		if DBG {
-			print("Parse Error:", statementsErr.Error(), "\n")
+			print("Parse Error:", treeErr.Error(), "\n")
 		}
-		return 0, statementsErr
+		return 0, treeErr
 	}
-	if argsHook != nil {
-		if DBG {
-			print("call argsHook\n")
-		}
-		for _, pipeline := range statements {
-			for _, state := range pipeline {
-				var err error
-				state.Args, err = argsHook(this, state.Args)
-				if err != nil {
-					return 255, err
-				}
+	return this.run(ctx, tree)
+}
+
+// expandWord replaces the arguments of the function, the variables of
+// for-loops, the shell variables and the environment variables in word.
+func (this *Cmd) expandWord(word string, removeQuote bool) (string, error) {
+	word = this.expandPositional(word)
+	for name, value := range this.loopVars {
+		word = strings.Replace(word, "%%"+name, value, -1)
+		word = strings.Replace(word, "%"+name, value, -1)
+	}
+	return this.vars.expandString(word, removeQuote)
+}
+
+// expandText replaces the arguments of the function, the variables of
+// for-loops, the shell variables and the environment variables in
+// the text of a here-document.
+func (this *Cmd) expandText(text string) string {
+	text = this.expandPositional(text)
+	for name, value := range this.loopVars {
+		text = strings.Replace(text, "%%"+name, value, -1)
+		text = strings.Replace(text, "%"+name, value, -1)
+	}
+	return rxPercentVar.ReplaceAllStringFunc(text, func(s string) string {
+		if value, ok := this.vars.ourGetenvSub(s[1 : len(s)-1]); ok {
+			return value
+		}
+		return s
+	})
+}
+
+func (this *Cmd) run(ctx context.Context, node Node) (int, error) {
+	switch n := node.(type) {
+	case *SequenceT:
+		errorlevel := 0
+		var err error
+		for _, node1 := range n.Nodes {
+			errorlevel, err = this.run(ctx, node1)
+			if err == ErrReturn || IsErrorLevelError(err) {
+				break
 			}
 		}
-		if DBG {
-			print("done argsHook\n")
+		return errorlevel, err
+	case *AndOrT:
+		this.conditional++
+		errorlevel, err := this.run(ctx, n.Left)
+		this.conditional--
+		if err == ErrReturn || IsErrorLevelError(err) {
+			return errorlevel, err
 		}
-	}
-	for _, pipeline := range statements {
-		for i, state := range pipeline {
-			if state.Term == "|" && (i+1 >= len(pipeline) || len(pipeline[i+1].Args) <= 0) {
-				return 255, errors.New("The syntax of the command is incorrect.")
+		switch n.Op {
+		case "&&":
+			if errorlevel != 0 {
+				return errorlevel, err
+			}
+		case "||":
+			if errorlevel == 0 {
+				return errorlevel, err
 			}
 		}
+		return this.run(ctx, n.Right)
+	case *BackgroundT:
+		return this.runBackground(ctx, n)
+	case *TimeT:
+		return this.runTime(ctx, n)
+	case *FunctionT:
+		return this.defineFunction(n)
+	case *PipelineT:
+		return this.checkErrorLevel(this.runPipeline(ctx, n))
+	case *StatementT, *SubshellT, *GroupT, *IfT, *ForT, *WhileT:
+		return this.checkErrorLevel(this.runPipeline(ctx, &PipelineT{
+			span:   span{pos: node.Pos(), end: node.End()},
+			Stages: []Node{node},
+		}))
 	}
+	return 255, fmt.Errorf("Fatal Error: can not run %s", reflect.TypeOf(node))
+}
 
-	for _, pipeline := range statements {
+// checkErrorLevel returns ErrorLevelError when ExitOnError is true
+// and the command out of conditionals failed.
+func (this *Cmd) checkErrorLevel(errorlevel int, err error) (int, error) {
+	if err == nil && errorlevel != 0 && this.conditional <= 0 && !this.IsBackGround && this.Session().ExitOnError() {
+		err = &ErrorLevelError{ErrorLevel: errorlevel}
+	}
+	return errorlevel, err
+}
 
-		var pipeIn *os.File = nil
-		pipeSeq++
-		isBackGround := this.IsBackGround
-		for _, state := range pipeline {
-			if state.Term == "&" {
-				isBackGround = true
-				break
-			}
+// runBackground starts node as a job. The job is not canceled when
+// ctx is canceled, but by Job.Kill.
+func (this *Cmd) runBackground(ctx context.Context, node *BackgroundT) (int, error) {
+	cmd, err := this.Clone()
+	if err != nil {
+		return 255, err
+	}
+	cmd.IsBackGround = true
+	if cmd.OnFork != nil {
+		if err := cmd.OnFork(cmd); err != nil {
+			fmt.Fprintln(cmd.Stderr, err.Error())
+			return -1, err
 		}
-		var wg sync.WaitGroup
-		shutdown_immediately := false
-		for i, state := range pipeline {
-			if DBG {
-				print(i, ": pipeline loop(", state.Args[0], ")\n")
-			}
-			cmd, err := this.Clone()
-			if err != nil {
-				return 255, err
+	}
+	job, jobCtx := this.Session().jobs.newJob(ctx, node.Text)
+	cmd.job = job
+	go func(cmd1 *Cmd) {
+		errorlevel, _ := cmd1.run(jobCtx, node.Node)
+		job.finish(errorlevel)
+		if cmd1.OffFork != nil {
+			if err := cmd1.OffFork(cmd1); err != nil {
+				fmt.Fprintln(cmd1.Stderr, err.Error())
 			}
-			cmd.PipeSeq[0] = pipeSeq
-			cmd.PipeSeq[1] = uint(1 + i)
-			cmd.IsBackGround = isBackGround
-
-			ctx := context.WithValue(ctx_, GotoEol, func() {
-				shutdown_immediately = true
-				gotoeol, ok := ctx_.Value(GotoEol).(func())
-				if ok {
-					gotoeol()
-				}
-			})
+		}
+		cmd1.Close()
+	}(cmd)
+	return 0, nil
+}
 
-			if pipeIn != nil {
-				cmd.Stdin = pipeIn
-				cmd.Closers = append(cmd.Closers, pipeIn)
-				pipeIn = nil
+// runSubshell runs body. The shell variables and the functions changed
+// by body are not seen from the parent.
+//
+// The current directory and the environment variables are those of
+// the process, so they are restored after body only when the subshell
+// runs in the foreground. In a pipeline or the background, the other
+// commands run at the same time and the restoring would overwrite
+// their changes. There the subshell changes them as `{ ... ; }` does.
+func (this *Cmd) runSubshell(ctx context.Context, body *SequenceT) (int, error) {
+	this.session = this.Session().fork()
+	this.vars = this.vars.copy()
+	this.vars.session = this.session
+	if this.IsBackGround || this.concurrent {
+		return this.runSubshellBody(ctx, body)
+	}
+	wd, wdErr := os.Getwd()
+	environ := os.Environ()
+	defer func() {
+		if wdErr == nil {
+			dos.Chdir(wd)
+		}
+		saved := map[string]string{}
+		for _, env1 := range environ {
+			if eqlPos := strings.Index(env1[1:], "="); eqlPos >= 0 {
+				saved[env1[:eqlPos+1]] = env1[eqlPos+2:]
 			}
-
-			if state.Term[0] == '|' {
-				var pipeOut *os.File
-				pipeIn, pipeOut, err = os.Pipe()
-				cmd.Stdout = pipeOut
-				if state.Term == "|&" {
-					cmd.Stderr = pipeOut
+		}
+		for _, env1 := range os.Environ() {
+			if eqlPos := strings.Index(env1[1:], "="); eqlPos >= 0 {
+				name := env1[:eqlPos+1]
+				if _, ok := saved[name]; !ok && name[0] != '=' {
+					os.Unsetenv(name)
 				}
-				cmd.Closers = append(cmd.Closers, pipeOut)
 			}
+		}
+		for name, value := range saved {
+			if name[0] != '=' && os.Getenv(name) != value {
+				os.Setenv(name, value)
+			}
+		}
+	}()
+	return this.runSubshellBody(ctx, body)
+}
 
-			for _, red := range state.Redirect {
-				var fd *os.File
-				fd, err = red.OpenOn(cmd)
-				if err != nil {
-					return 0, err
-				}
-				defer fd.Close()
+func (this *Cmd) runSubshellBody(ctx context.Context, body *SequenceT) (int, error) {
+	errorlevel, err := this.run(ctx, body)
+	if err == ErrReturn {
+		// `return` ends only the subshell.
+		err = nil
+	}
+	return errorlevel, err
+}
+
+// evalCondition returns the result of the condition of if or while.
+func (this *Cmd) evalCondition(ctx context.Context, cond *ConditionT) (bool, error) {
+	args := make([]string, len(cond.Args))
+	for i, word := range cond.Args {
+		// the output of $(...) is not split in the condition.
+		args1, _, err := this.expandArgs(ctx, []string{word})
+		if err != nil {
+			return false, err
+		}
+		args[i] = strings.Join(args1, " ")
+	}
+	status := false
+	switch cond.Op {
+	case "==":
+		if cond.IgnoreCase {
+			status = strings.EqualFold(args[0], args[1])
+		} else {
+			status = (args[0] == args[1])
+		}
+	case "equ", "neq", "lss", "leq", "gtr", "geq":
+		var cmp int
+		left, leftErr := strconv.Atoi(args[0])
+		right, rightErr := strconv.Atoi(args[1])
+		if leftErr == nil && rightErr == nil {
+			cmp = left - right
+		} else if cond.IgnoreCase {
+			cmp = strings.Compare(strings.ToUpper(args[0]), strings.ToUpper(args[1]))
+		} else {
+			cmp = strings.Compare(args[0], args[1])
+		}
+		switch cond.Op {
+		case "equ":
+			status = (cmp == 0)
+		case "neq":
+			status = (cmp != 0)
+		case "lss":
+			status = (cmp < 0)
+		case "leq":
+			status = (cmp <= 0)
+		case "gtr":
+			status = (cmp > 0)
+		case "geq":
+			status = (cmp >= 0)
+		}
+	case "exist":
+		_, err := os.Stat(args[0])
+		status = (err == nil)
+	case "errorlevel":
+		num, err := strconv.Atoi(args[0])
+		if err != nil {
+			return false, fmt.Errorf("errorlevel: %s: not a number", args[0])
+		}
+		status = (this.Session().LastErrorLevel() >= num)
+	case "defined":
+		if _, status = this.LookupVar(args[0]); !status {
+			_, status = os.LookupEnv(args[0])
+		}
+	default:
+		return false, fmt.Errorf("%s: unknown condition", cond.Op)
+	}
+	if cond.Not {
+		status = !status
+	}
+	return status, nil
+}
+
+func (this *Cmd) runIf(ctx context.Context, node *IfT) (int, error) {
+	status, err := this.evalCondition(ctx, node.Cond)
+	if err != nil {
+		return 255, err
+	}
+	if status {
+		return this.run(ctx, node.Then)
+	} else if node.Else != nil {
+		return this.run(ctx, node.Else)
+	}
+	return 0, nil
+}
+
+// forItems returns the values which the variable of the for-loop takes.
+func (this *Cmd) forItems(ctx context.Context, node *ForT) ([]string, error) {
+	items, _, err := this.expandArgs(ctx, node.Items)
+	if err != nil {
+		return nil, err
+	}
+	if node.Range {
+		var num [3]int
+		if len(items) != 3 {
+			return nil, errors.New("for /L: (START,STEP,END) is required")
+		}
+		for i, item := range items {
+			var err error
+			num[i], err = strconv.Atoi(item)
+			if err != nil {
+				return nil, fmt.Errorf("for /L: %s: not a number", item)
 			}
+		}
+		if num[1] == 0 {
+			return nil, errors.New("for /L: STEP must not be zero")
+		}
+		result := []string{}
+		for i := num[0]; (num[1] > 0 && i <= num[2]) || (num[1] < 0 && i >= num[2]); i += num[1] {
+			result = append(result, strconv.Itoa(i))
+		}
+		return result, nil
+	}
+	result := make([]string, 0, len(items))
+	for _, item := range items {
+		if strings.ContainsAny(item, "*?") {
+			// a wildcard which matches nothing is skipped as CMD.EXE.
+			result = append(result, this.Session().Glob(item)...)
+		} else {
+			result = append(result, item)
+		}
+	}
+	return result, nil
+}
+
+func (this *Cmd) runFor(ctx context.Context, node *ForT) (int, error) {
+	items, err := this.forItems(ctx, node)
+	if err != nil {
+		return 255, err
+	}
+	saved := this.loopVars
+	defer func() { this.loopVars = saved }()
 
-			cmd.Args = state.Args
-			cmd.RawArgs = state.RawArgs
-			if i > 0 {
-				cmd.IsBackGround = true
+	errorlevel := 0
+	for _, item := range items {
+		if err := ctx.Err(); err != nil {
+			return errorlevel, err
+		}
+		this.loopVars = map[string]string{}
+		for name, value := range saved {
+			this.loopVars[name] = value
+		}
+		this.loopVars[node.Var] = item
+		errorlevel, err = this.run(ctx, node.Body)
+		if err == ErrReturn || IsErrorLevelError(err) {
+			break
+		}
+	}
+	return errorlevel, err
+}
+
+func (this *Cmd) runWhile(ctx context.Context, node *WhileT) (int, error) {
+	errorlevel := 0
+	var err error
+	for {
+		if err := ctx.Err(); err != nil {
+			return errorlevel, err
+		}
+		status, condErr := this.evalCondition(ctx, node.Cond)
+		if condErr != nil {
+			return 255, condErr
+		}
+		if !status {
+			return errorlevel, err
+		}
+		errorlevel, err = this.run(ctx, node.Body)
+		if err == ErrReturn || IsErrorLevelError(err) {
+			return errorlevel, err
+		}
+	}
+}
+
+// runStage runs a statement, a group or a control statement
+// with the standard I/O of this.
+func (this *Cmd) runStage(ctx context.Context, stage Node) (int, error) {
+	switch n := stage.(type) {
+	case *StatementT:
+		return this.runStatement(ctx, n)
+	case *SubshellT:
+		return this.runSubshell(ctx, n.Body)
+	case *GroupT:
+		return this.run(ctx, n.Body)
+	case *IfT:
+		return this.runIf(ctx, n)
+	case *ForT:
+		return this.runFor(ctx, n)
+	case *WhileT:
+		return this.runWhile(ctx, n)
+	case *FunctionT:
+		return this.defineFunction(n)
+	}
+	return 255, fmt.Errorf("Fatal Error: can not pipe %s", reflect.TypeOf(stage))
+}
+
+// runStatement expands the words of statement and runs the command.
+// The commands of `<(...)` and `>(...)` run while the command runs and
+// their errors are returned when the command succeeds.
+func (this *Cmd) runStatement(ctx context.Context, statement *StatementT) (errorlevel int, err error) {
+	words := make([]string, len(statement.Words))
+	for i, word := range statement.Words {
+		if isProcSubst(word) {
+			subst, substErr := this.startProcSubst(ctx, word)
+			if substErr != nil {
+				return 255, substErr
 			}
-			if i == len(pipeline)-1 && state.Term != "&" {
-				// foreground execution.
-				errorlevel, finalerr = cmd.SpawnvpContext(ctx)
-				LastErrorLevel = errorlevel
-				cmd.Close()
-			} else {
-				// background
-				if !isBackGround {
-					wg.Add(1)
-				}
-				if cmd.OnFork != nil {
-					if err := cmd.OnFork(cmd); err != nil {
-						fmt.Fprintln(cmd.Stderr, err.Error())
-						return -1, err
-					}
+			defer func() {
+				if err1 := subst.Wait(); err1 != nil && err == nil {
+					err = err1
 				}
-				go func(cmd1 *Cmd) {
-					if !isBackGround {
-						defer wg.Done()
-					}
-					cmd1.SpawnvpContext(ctx)
-					if cmd1.OffFork != nil {
-						if err := cmd1.OffFork(cmd1); err != nil {
-							fmt.Fprintln(cmd1.Stderr, err.Error())
-							goto exit
-						}
-					}
-				exit:
-					cmd1.Close()
-				}(cmd)
+			}()
+			word = `"` + subst.pipe.Path + `"`
+		}
+		words[i] = word
+	}
+	this.Args, this.RawArgs, err = this.expandArgs(ctx, words)
+	if err != nil {
+		// not to be lost when the other statements follow
+		return 255, this.report(err)
+	}
+	if len(this.Args) <= 0 {
+		// the command was only $(...) which printed nothing.
+		return this.Session().LastErrorLevel(), nil
+	}
+	if argsHook := this.Session().getArgsHook(); argsHook != nil {
+		this.Args, err = argsHook(this, this.Args)
+		if err != nil {
+			return 255, err
+		}
+	}
+	return this.SpawnvpContext(ctx)
+}
+
+func redirectOf(stage Node) []*Redirecter {
+	switch n := stage.(type) {
+	case *StatementT:
+		return n.Redirect
+	case *SubshellT:
+		return n.Redirect
+	case *GroupT:
+		return n.Redirect
+	}
+	return nil
+}
+
+// openRedirects applies the redirections of stage to this. The files
+// opened are appended to files, which are closed after the pipeline.
+func (this *Cmd) openRedirects(stage Node, files *[]*os.File) error {
+	for _, red := range redirectOf(stage) {
+		fd, err := red.OpenOn(this)
+		if err != nil {
+			return err
+		}
+		if fd != nil {
+			*files = append(*files, fd)
+		}
+	}
+	return nil
+}
+
+func (this *Cmd) runPipeline(ctx context.Context, pipeline *PipelineT) (errorlevel int, finalerr error) {
+	// the pipes are in-process. os/exec makes the pipes of the OS
+	// only for the stages running external commands.
+	var pipeIn *io.PipeReader = nil
+	pipeSeq := this.Session().nextPipeSeq()
+	var wg sync.WaitGroup
+	var files []*os.File
+	statuses := make([]int, len(pipeline.Stages))
+	failed := -1 // the stage which could not start
+	for i, stage := range pipeline.Stages {
+		if DBG {
+			print(i, ": pipeline loop(", reflect.TypeOf(stage).String(), ")\n")
+		}
+		cmd, err := this.Clone()
+		if err != nil {
+			finalerr, failed = err, i
+			break
+		}
+		cmd.PipeSeq[0] = pipeSeq
+		cmd.PipeSeq[1] = uint(1 + i)
+		cmd.IsBackGround = this.IsBackGround
+		if len(pipeline.Stages) > 1 {
+			cmd.concurrent = true
+		}
+
+		if pipeIn != nil {
+			cmd.Stdin = pipeIn
+			cmd.Closers = append(cmd.Closers, pipeIn)
+			pipeIn = nil
+		}
+
+		if i < len(pipeline.Pipes) {
+			var pipeOut *io.PipeWriter
+			pipeIn, pipeOut = io.Pipe()
+			cmd.Stdout = pipeOut
+			if pipeline.Pipes[i] == "|&" {
+				cmd.Stderr = pipeOut
 			}
+			cmd.Closers = append(cmd.Closers, pipeOut)
+		}
+
+		if err := cmd.openRedirects(stage, &files); err != nil {
+			cmd.Close()
+			finalerr, failed = err, i
+			break
+		}
+
+		if i > 0 {
+			cmd.IsBackGround = true
 		}
-		if !isBackGround {
-			wg.Wait()
-			if shutdown_immediately {
-				return errorlevel, nil
+		if i == len(pipeline.Stages)-1 {
+			// foreground execution.
+			statuses[i], finalerr = cmd.runStage(ctx, stage)
+			cmd.Close()
+		} else {
+			// background
+			if cmd.OnFork != nil {
+				if err := cmd.OnFork(cmd); err != nil {
+					fmt.Fprintln(cmd.Stderr, err.Error())
+					cmd.Close()
+					finalerr, failed = err, i
+					break
+				}
 			}
-			if len(pipeline) > 0 {
-				switch pipeline[len(pipeline)-1].Term {
-				case "&&":
-					if errorlevel != 0 {
-						return errorlevel, nil
-					}
-				case "||":
-					if errorlevel == 0 {
-						return errorlevel, nil
+			wg.Add(1)
+			go func(cmd1 *Cmd, stage1 Node, i1 int) {
+				defer wg.Done()
+				statuses[i1], _ = cmd1.runStage(ctx, stage1)
+				if cmd1.OffFork != nil {
+					if err := cmd1.OffFork(cmd1); err != nil {
+						fmt.Fprintln(cmd1.Stderr, err.Error())
+						goto exit
 					}
 				}
+			exit:
+				cmd1.Close()
+			}(cmd, stage, i)
+		}
+	}
+	if failed >= 0 {
+		// The stages started get EOF or the broken pipe by the pipes
+		// closed, and end. The stages not started fail.
+		if pipeIn != nil {
+			pipeIn.Close()
+		}
+		for j := failed; j < len(statuses); j++ {
+			statuses[j] = 255
+		}
+	}
+	wg.Wait()
+	for _, fd := range files {
+		fd.Close()
+	}
+	errorlevel = statuses[len(statuses)-1]
+	if this.Session().PipeFail() {
+		for _, status := range statuses {
+			if status != 0 {
+				errorlevel = status
 			}
 		}
 	}
+	if !this.IsBackGround {
+		this.Session().setLastStatus(errorlevel, statuses)
+	}
 	return
 }
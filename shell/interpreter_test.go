@@ -1,11 +1,512 @@
 package shell
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestInterpret(t *testing.T) {
 	_, err := New().Interpret("ls.exe | cat.exe -n > hogehoge")
 	fmt.Println(err)
 }
+
+func TestInterpretAndOr(t *testing.T) {
+	called := []string{}
+	orgHook := SetHook(func(ctx context.Context, cmd *Cmd) (int, bool, error) {
+		called = append(called, cmd.Args[0])
+		if cmd.Args[0] == "false" {
+			return 1, true, nil
+		}
+		return 0, true, nil
+	})
+	defer SetHook(orgHook)
+
+	errorlevel, _ := New().Interpret("true || false && echo ; false && echo || true")
+	if result := strings.Join(called, " "); result != "true echo false true" {
+		t.Errorf("called: %s", result)
+	}
+	if errorlevel != 0 {
+		t.Errorf("errorlevel: %d", errorlevel)
+	}
+}
+
+func TestInterpretSubshell(t *testing.T) {
+	orgHook := SetHook(func(ctx context.Context, cmd *Cmd) (int, bool, error) {
+		if cmd.Args[0] == "setenv" {
+			os.Setenv(cmd.Args[1], cmd.Args[2])
+		}
+		return 0, true, nil
+	})
+	defer SetHook(orgHook)
+
+	os.Unsetenv("NYAGOS_TEST_SUBSHELL")
+	New().Interpret("(setenv NYAGOS_TEST_SUBSHELL 1)")
+	if value := os.Getenv("NYAGOS_TEST_SUBSHELL"); value != "" {
+		t.Errorf("subshell: %s", value)
+	}
+	New().Interpret("{ setenv NYAGOS_TEST_SUBSHELL 2 ; }")
+	if value := os.Getenv("NYAGOS_TEST_SUBSHELL"); value != "2" {
+		t.Errorf("group: %s", value)
+	}
+	// the subshells in a pipeline do not restore the environment
+	// which the other stages may change.
+	New().Interpret("(setenv NYAGOS_TEST_SUBSHELL 3) | (echo)")
+	if value := os.Getenv("NYAGOS_TEST_SUBSHELL"); value != "3" {
+		t.Errorf("pipeline: %s", value)
+	}
+	os.Unsetenv("NYAGOS_TEST_SUBSHELL")
+}
+
+func TestInterpretControl(t *testing.T) {
+	called := []string{}
+	orgHook := SetHook(func(ctx context.Context, cmd *Cmd) (int, bool, error) {
+		called = append(called, strings.Join(cmd.Args, ":"))
+		if cmd.Args[0] == "setenv" {
+			os.Setenv(cmd.Args[1], cmd.Args[2])
+		}
+		return 0, true, nil
+	})
+	defer SetHook(orgHook)
+
+	os.Setenv("NYAGOS_TEST_CONTROL", "1")
+	New().Interpret("if %NYAGOS_TEST_CONTROL% EQU 01\n  echo equ\nelse\n  echo neq\nend")
+	New().Interpret("if not defined NYAGOS_TEST_CONTROL (echo x) else (echo y)")
+	New().Interpret("for %i in (a,b) do for /L %j in (1,1,2) do echo %i%j")
+	New().Interpret("while %NYAGOS_TEST_CONTROL% LSS 3\n  setenv NYAGOS_TEST_CONTROL 3\nend")
+	os.Unsetenv("NYAGOS_TEST_CONTROL")
+
+	expect := "echo:equ echo:y echo:a1 echo:a2 echo:b1 echo:b2 setenv:NYAGOS_TEST_CONTROL:3"
+	if result := strings.Join(called, " "); result != expect {
+		t.Errorf("called: %s", result)
+	}
+}
+
+func TestInterpretFunction(t *testing.T) {
+	called := []string{}
+	session := NewSession()
+	session.SetHook(func(ctx context.Context, cmd *Cmd) (int, bool, error) {
+		switch cmd.Args[0] {
+		case "return":
+			n, _ := strconv.Atoi(cmd.Args[1])
+			return n, true, ErrReturn
+		case "local":
+			return 0, true, cmd.SetLocal(cmd.Args[1], cmd.Args[2])
+		}
+		called = append(called, strings.Join(cmd.Args, ":"))
+		return 0, true, nil
+	})
+
+	os.Setenv("NYAGOS_TEST_FUNCTION", "global")
+	errorlevel, err := session.NewCmd().Interpret("function greet {\n local NYAGOS_TEST_FUNCTION local\n echo $# $1 %NYAGOS_TEST_FUNCTION%\n args $*\n return 3\n echo never\n}\ngreet \"a b\" c")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if errorlevel != 3 {
+		t.Errorf("errorlevel: %d", errorlevel)
+	}
+	if value := os.Getenv("NYAGOS_TEST_FUNCTION"); value != "global" {
+		t.Errorf("local variable: %s", value)
+	}
+	os.Unsetenv("NYAGOS_TEST_FUNCTION")
+	if result := strings.Join(called, " "); result != "echo:2:a b:local args:a b:c" {
+		t.Errorf("called: %s", result)
+	}
+
+	_, err = session.NewCmd().Interpret("function loop { loop ; }\nloop")
+	if err == nil {
+		t.Error("infinite recursion: no error")
+	}
+}
+
+func TestInterpretHereDocument(t *testing.T) {
+	var input []string
+	orgHook := SetHook(func(ctx context.Context, cmd *Cmd) (int, bool, error) {
+		data, err := ioutil.ReadAll(cmd.Stdin)
+		input = append(input, string(data))
+		return 0, true, err
+	})
+	defer SetHook(orgHook)
+
+	os.Setenv("NYAGOS_TEST_HERE", "world")
+	New().Interpret("for %i in (1 2) do cat <<EOF\nhello %NYAGOS_TEST_HERE% %i\nEOF\ncat <<< \"%NYAGOS_TEST_HERE%\"")
+	os.Unsetenv("NYAGOS_TEST_HERE")
+
+	expect := []string{"hello world 1\n", "hello world 2\n", "world\n"}
+	if strings.Join(input, "|") != strings.Join(expect, "|") {
+		t.Errorf("input: %q", input)
+	}
+}
+
+func TestInterpretRedirect(t *testing.T) {
+	orgHook := SetHook(func(ctx context.Context, cmd *Cmd) (int, bool, error) {
+		fmt.Fprint(cmd.Stdout, "out;")
+		fmt.Fprint(cmd.Stderr, "err;")
+		return 0, true, nil
+	})
+	defer SetHook(orgHook)
+
+	dir, err := ioutil.TempDir("", "nyagos")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	out := filepath.Join(dir, "out.txt")
+	both := filepath.Join(dir, "both.txt")
+
+	// 2>&1 duplicates the stdout before 1> changes it.
+	New().Interpret(fmt.Sprintf("{ hook 2>&1 1>%s ; } >nul", out))
+	New().Interpret(fmt.Sprintf("hook 3>%s 1>&3 2>&1 ; hook &>>%s", both, both))
+	for path, expect := range map[string]string{out: "out;", both: "out;err;out;err;"} {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if string(data) != expect {
+			t.Errorf("%s: %s", filepath.Base(path), data)
+		}
+	}
+
+	// the stage writing the pipe ends when the next stage fails to start.
+	it := New()
+	errorlevel, err := it.Interpret(fmt.Sprintf("hook | hook >%s", filepath.Join(dir, "none", "out.txt")))
+	if err == nil || errorlevel != 255 {
+		t.Errorf("failed redirection: %d %v", errorlevel, err)
+	}
+	if value, _ := it.GetEnv("PIPESTATUS"); value != "0 255" {
+		t.Errorf("failed redirection: PIPESTATUS: %s", value)
+	}
+}
+
+func TestInterpretProcSubst(t *testing.T) {
+	var files []string
+	var output string
+	got := make(chan struct{})
+	orgHook := SetHook(func(ctx context.Context, cmd *Cmd) (int, bool, error) {
+		switch cmd.Args[0] {
+		case "gen":
+			fmt.Fprint(cmd.Stdout, strings.Join(cmd.Args[1:], " "))
+		case "ping":
+			// the rest is written after the first is read.
+			fmt.Fprint(cmd.Stdout, "1")
+			<-got
+			fmt.Fprint(cmd.Stdout, "2")
+		case "pong":
+			fd, err := os.Open(cmd.Args[1])
+			if err != nil {
+				return 1, true, err
+			}
+			first := make([]byte, 1)
+			fd.Read(first)
+			close(got)
+			rest, _ := ioutil.ReadAll(fd)
+			fd.Close()
+			output += string(first) + "," + string(rest) + ";"
+		case "fail":
+			return 1, true, errors.New("failed")
+		case "read":
+			for _, path := range cmd.Args[1:] {
+				data, _ := ioutil.ReadFile(path)
+				files = append(files, path)
+				output += string(data) + ";"
+			}
+		case "write":
+			ioutil.WriteFile(cmd.Args[1], []byte("written"), 0666)
+		case "cat":
+			data, _ := ioutil.ReadAll(cmd.Stdin)
+			output += string(data) + ";"
+		}
+		return 0, true, nil
+	})
+	defer SetHook(orgHook)
+
+	New().Interpret("read <(gen a b) <(gen c) ; write >(cat)")
+	if output != "a b;c;written;" {
+		t.Errorf("output: %s", output)
+	}
+	for _, path := range files {
+		if _, err := os.Stat(path); err == nil {
+			t.Errorf("%s: not removed", path)
+		}
+	}
+
+	output = ""
+	it := New()
+	it.Stderr = ioutil.Discard
+	if _, err := it.Interpret("pong <(ping)"); err != nil || output != "1,2;" {
+		t.Errorf("stream: %s %v", output, err)
+	}
+	if _, err := it.Interpret("read <(fail)"); err == nil {
+		t.Error("error: not returned")
+	}
+}
+
+func TestInterpretCommandSubst(t *testing.T) {
+	var args [][]string
+	orgHook := SetHook(func(ctx context.Context, cmd *Cmd) (int, bool, error) {
+		switch cmd.Args[0] {
+		case "echo":
+			fmt.Fprintln(cmd.Stdout, strings.Join(cmd.Args[1:], " "))
+		case "fail":
+			return 3, true, nil
+		default:
+			args = append(args, cmd.Args)
+		}
+		return 0, true, nil
+	})
+	defer SetHook(orgHook)
+
+	New().Interpret(`show $(echo a  b)c "[$(echo x  $(echo y))]" ; $(fail) || show %ERRORLEVEL%`)
+	expect := "show a bc [x y] ; show 3"
+	result := []string{}
+	for _, args1 := range args {
+		result = append(result, strings.Join(args1, " "))
+	}
+	if strings.Join(result, " ; ") != expect {
+		t.Errorf("args: %q", args)
+	}
+	if len(args) > 0 && len(args[0]) != 4 {
+		t.Errorf("args-0: %q", args[0])
+	}
+}
+
+func TestInterpretVariable(t *testing.T) {
+	var args []string
+	session := NewSession()
+	session.SetHook(func(ctx context.Context, cmd *Cmd) (int, bool, error) {
+		switch cmd.Args[0] {
+		case "setl":
+			cmd.SetVar(cmd.Args[1], cmd.Args[2])
+		case "local":
+			return 0, true, cmd.SetLocal(cmd.Args[1], cmd.Args[2])
+		default:
+			args = append(args, strings.Join(cmd.Args, ":"))
+		}
+		return 0, true, nil
+	})
+
+	it := session.NewCmd()
+	_, err := it.Interpret("setl NYAGOS_TEST_VAR shell ; ( setl NYAGOS_TEST_VAR sub ; show $NYAGOS_TEST_VAR ) ; show %NYAGOS_TEST_VAR% ${NYAGOS_TEST_VAR}x '$NYAGOS_TEST_VAR' $NYAGOS_TEST_UNDEF")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, ok := os.LookupEnv("NYAGOS_TEST_VAR"); ok {
+		t.Error("shell variable is exported")
+	}
+	_, err = it.Interpret("function f {\n local NYAGOS_TEST_VAR local\n setl NYAGOS_TEST_VAR2 global\n show $NYAGOS_TEST_VAR\n}\nf ; show $NYAGOS_TEST_VAR $NYAGOS_TEST_VAR2")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expect := "show:sub show:shell:shellx:$NYAGOS_TEST_VAR:$NYAGOS_TEST_UNDEF show:local show:shell:global"
+	if result := strings.Join(args, " "); result != expect {
+		t.Errorf("args: %s", result)
+	}
+
+	if !it.Export("NYAGOS_TEST_VAR") {
+		t.Error("export: not found")
+	}
+	if value := os.Getenv("NYAGOS_TEST_VAR"); value != "shell" {
+		t.Errorf("export: %s", value)
+	}
+	if _, ok := it.LookupVar("NYAGOS_TEST_VAR"); ok {
+		t.Error("export: not removed")
+	}
+	os.Unsetenv("NYAGOS_TEST_VAR")
+}
+
+func TestInterpretJob(t *testing.T) {
+	orgHook := SetHook(func(ctx context.Context, cmd *Cmd) (int, bool, error) {
+		switch cmd.Args[0] {
+		case "block":
+			<-ctx.Done()
+			return 9, true, nil
+		case "fail":
+			return 3, true, nil
+		}
+		return 0, true, nil
+	})
+	defer SetHook(orgHook)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if _, err := New().InterpretContext(ctx, "block & fail &"); err != nil {
+		t.Fatal(err.Error())
+	}
+	// the jobs are not canceled when the command line ends.
+	cancel()
+	list := Jobs()
+	if len(list) != 2 || list[0].Command != "block" || list[1].Command != "fail" {
+		t.Fatalf("jobs: %v", list)
+	}
+	errorlevel, err := list[1].Wait(context.Background())
+	if err != nil || errorlevel != 3 {
+		t.Errorf("wait: %d %v", errorlevel, err)
+	}
+	if list[0].State() != JOB_RUNNING {
+		t.Errorf("state: %s", list[0].State())
+	}
+	if job, err := FindJob("%%"); err != nil || job != list[0] {
+		t.Errorf("FindJob: %v %v", job, err)
+	}
+	list[0].Kill()
+	<-list[0].Done()
+	if list[0].State() != JOB_KILLED {
+		t.Errorf("state: %s", list[0].State())
+	}
+	var buffer bytes.Buffer
+	ReportJobs(&buffer)
+	if buffer.String() != "[1] Killed     block\n" {
+		t.Errorf("report: %q", buffer.String())
+	}
+	if len(Jobs()) != 0 {
+		t.Errorf("jobs: %v", Jobs())
+	}
+}
+
+func TestInterpretPipeStatus(t *testing.T) {
+	orgHook := SetHook(func(ctx context.Context, cmd *Cmd) (int, bool, error) {
+		n, _ := strconv.Atoi(cmd.Args[1])
+		return n, true, nil
+	})
+	defer SetHook(orgHook)
+
+	it := New()
+	errorlevel, _ := it.Interpret("exit 2 | exit 0 | exit 0")
+	if errorlevel != 0 {
+		t.Errorf("errorlevel: %d", errorlevel)
+	}
+	if value, _ := it.GetEnv("PIPESTATUS"); value != "2 0 0" {
+		t.Errorf("PIPESTATUS: %s", value)
+	}
+
+	it.Session().SetPipeFail(true)
+	defer it.Session().SetPipeFail(false)
+	errorlevel, _ = it.Interpret("exit 1 | exit 3 | exit 0 && echo never")
+	if errorlevel != 3 {
+		t.Errorf("pipefail: errorlevel: %d", errorlevel)
+	}
+}
+
+func TestInterpretErrExit(t *testing.T) {
+	called := []string{}
+	session := NewSession()
+	session.SetHook(func(ctx context.Context, cmd *Cmd) (int, bool, error) {
+		cmd.Trace()
+		called = append(called, cmd.Args[0])
+		n, _ := strconv.Atoi(cmd.Args[1])
+		return n, true, nil
+	})
+	session.SetExitOnError(true)
+	session.SetXTrace(true)
+	session.SetXTracePrefix("++ ")
+	var trace bytes.Buffer
+	it := session.NewCmd()
+	it.Stderr = &trace
+	errorlevel, err := it.Interpret("a 1 && b 0 ; c 1 || d 0 ; { e 0 ; f 2 ; g 0 ; } ; h 0")
+
+	if !IsErrorLevelError(err) || errorlevel != 2 {
+		t.Errorf("errexit: %d %v", errorlevel, err)
+	}
+	if result := strings.Join(called, " "); result != "a c d e f" {
+		t.Errorf("called: %s", result)
+	}
+	if trace.String() != "++ a 1\n++ c 1\n++ d 0\n++ e 0\n++ f 2\n" {
+		t.Errorf("xtrace: %q", trace.String())
+	}
+
+	// the failure in the body ends the loops too.
+	session.SetXTrace(false)
+	called = called[:0]
+	errorlevel, err = it.Interpret("for %i in (a b c) do %i 1\nz 0")
+	if !IsErrorLevelError(err) || errorlevel != 1 {
+		t.Errorf("errexit: for: %d %v", errorlevel, err)
+	}
+	if result := strings.Join(called, " "); result != "a" {
+		t.Errorf("called: for: %s", result)
+	}
+	called = called[:0]
+	errorlevel, err = it.Interpret("while 1 EQU 1\n  w 3\nend\nz 0")
+	if !IsErrorLevelError(err) || errorlevel != 3 {
+		t.Errorf("errexit: while: %d %v", errorlevel, err)
+	}
+	if result := strings.Join(called, " "); result != "w" {
+		t.Errorf("called: while: %s", result)
+	}
+}
+
+func TestInterpretTime(t *testing.T) {
+	orgHook := SetHook(func(ctx context.Context, cmd *Cmd) (int, bool, error) {
+		time.Sleep(20 * time.Millisecond)
+		n, _ := strconv.Atoi(cmd.Args[1])
+		return n, true, nil
+	})
+	defer SetHook(orgHook)
+
+	var output bytes.Buffer
+	it := New()
+	it.Stderr = &output
+	errorlevel, err := it.Interpret("time a 0 | b 3")
+	if err != nil || errorlevel != 3 {
+		t.Errorf("time: %d %v", errorlevel, err)
+	}
+	lines := strings.Split(output.String(), "\n")
+	if len(lines) != 5 || lines[0] != "" || !strings.HasPrefix(lines[1], "real\t0m0.") ||
+		lines[2] != "user\t0m0.000s" || lines[3] != "sys\t0m0.000s" {
+		t.Errorf("time: %q", output.String())
+	}
+	if lines[1] < "real\t0m0.020s" {
+		t.Errorf("time: too short: %s", lines[1])
+	}
+
+	times := Times{Real: 61500 * time.Millisecond, User: 2 * time.Millisecond}
+	if times.String() != "real\t1m1.500s\nuser\t0m0.002s\nsys\t0m0.000s\n" {
+		t.Errorf("Times: %q", times.String())
+	}
+}
+
+func TestInterpretStream(t *testing.T) {
+	orgHook := SetHook(func(ctx context.Context, cmd *Cmd) (int, bool, error) {
+		for _, stream := range []interface{}{cmd.Stdin, cmd.Stdout, cmd.Stderr} {
+			if _, ok := stream.(*os.File); ok {
+				return 1, true, fmt.Errorf("%s: %T", cmd.Args[0], stream)
+			}
+		}
+		switch cmd.Args[0] {
+		case "emit":
+			fmt.Fprintln(cmd.Stdout, strings.Join(cmd.Args[1:], " "))
+		case "warn":
+			fmt.Fprintln(cmd.Stderr, strings.Join(cmd.Args[1:], " "))
+		case "upper":
+			data, err := ioutil.ReadAll(cmd.Stdin)
+			if err != nil {
+				return 1, true, err
+			}
+			fmt.Fprint(cmd.Stdout, strings.ToUpper(string(data)))
+		}
+		return 0, true, nil
+	})
+	defer SetHook(orgHook)
+
+	var stdout, stderr bytes.Buffer
+	it := New()
+	it.Stdin = strings.NewReader("")
+	it.Stdout = &stdout
+	it.Stderr = &stderr
+	_, err := it.Interpret("emit hello | upper ; warn oops 2>&1 | upper ; upper <<<here ; warn bye ; emit $(emit x)y | upper")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if stdout.String() != "HELLO\nOOPS\nHERE\nXY\n" {
+		t.Errorf("stdout: %q", stdout.String())
+	}
+	if stderr.String() != "bye\n" {
+		t.Errorf("stderr: %q", stderr.String())
+	}
+}
@@ -0,0 +1,238 @@
+package shell
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	JOB_RUNNING = "Running"
+	JOB_DONE    = "Done"
+	JOB_KILLED  = "Killed"
+)
+
+// Job is a command running in background by `&`.
+type Job struct {
+	ID        int
+	Command   string // the source of the command
+	StartTime time.Time
+
+	mutex      sync.Mutex
+	processes  map[int]*os.Process
+	state      string
+	errorLevel int
+	done       chan struct{}
+	cancel     func()
+	table      *jobTable
+}
+
+// jobTable is the jobs of a session.
+type jobTable struct {
+	mutex sync.Mutex
+	jobs  map[int]*Job
+}
+
+// jobContext has the values of the parent, but it is not canceled
+// when the command line which starts the job ends.
+type jobContext struct {
+	context.Context
+}
+
+func (jobContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (jobContext) Done() <-chan struct{}       { return nil }
+func (jobContext) Err() error                  { return nil }
+
+// newJob registers the new job and returns it with the context to run it.
+func (this *jobTable) newJob(ctx context.Context, command string) (*Job, context.Context) {
+	ctx, cancel := context.WithCancel(jobContext{ctx})
+	job := &Job{
+		Command:   command,
+		StartTime: time.Now(),
+		processes: map[int]*os.Process{},
+		state:     JOB_RUNNING,
+		done:      make(chan struct{}),
+		cancel:    cancel,
+		table:     this,
+	}
+	this.mutex.Lock()
+	for id := range this.jobs {
+		if id > job.ID {
+			job.ID = id
+		}
+	}
+	job.ID++
+	this.jobs[job.ID] = job
+	this.mutex.Unlock()
+	return job, ctx
+}
+
+func (this *Job) addProcess(p *os.Process) {
+	this.mutex.Lock()
+	this.processes[p.Pid] = p
+	this.mutex.Unlock()
+}
+
+func (this *Job) removeProcess(p *os.Process) {
+	this.mutex.Lock()
+	delete(this.processes, p.Pid)
+	this.mutex.Unlock()
+}
+
+func (this *Job) finish(errorlevel int) {
+	this.mutex.Lock()
+	if this.state == JOB_RUNNING {
+		this.state = JOB_DONE
+	}
+	this.errorLevel = errorlevel
+	this.mutex.Unlock()
+	this.cancel()
+	close(this.done)
+}
+
+// State returns JOB_RUNNING, JOB_DONE or JOB_KILLED.
+func (this *Job) State() string {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.state
+}
+
+// ErrorLevel returns the errorlevel of the job finished.
+func (this *Job) ErrorLevel() int {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.errorLevel
+}
+
+// Pids returns the process ids of the external commands running in the job.
+func (this *Job) Pids() []int {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	pids := make([]int, 0, len(this.processes))
+	for pid := range this.processes {
+		pids = append(pids, pid)
+	}
+	sort.Ints(pids)
+	return pids
+}
+
+// Done returns the channel closed when the job finishes.
+func (this *Job) Done() <-chan struct{} {
+	return this.done
+}
+
+// Wait waits for the job to finish and returns its errorlevel.
+// The job finished is removed from the job table.
+func (this *Job) Wait(ctx context.Context) (int, error) {
+	select {
+	case <-this.done:
+		this.table.forget(this)
+		return this.ErrorLevel(), nil
+	case <-ctx.Done():
+		return 255, ctx.Err()
+	}
+}
+
+// Kill stops the commands in the job and the processes started by it.
+func (this *Job) Kill() error {
+	this.mutex.Lock()
+	if this.state == JOB_RUNNING {
+		this.state = JOB_KILLED
+	}
+	processes := make([]*os.Process, 0, len(this.processes))
+	for _, p := range this.processes {
+		processes = append(processes, p)
+	}
+	this.mutex.Unlock()
+
+	this.cancel()
+	var err error
+	for _, p := range processes {
+		if err1 := p.Kill(); err1 != nil && err == nil {
+			err = err1
+		}
+	}
+	return err
+}
+
+func (this *Job) String() string {
+	state := this.State()
+	if state == JOB_DONE {
+		state = fmt.Sprintf("%s(%d)", state, this.ErrorLevel())
+	}
+	return fmt.Sprintf("[%d] %-10s %s", this.ID, state, this.Command)
+}
+
+func (this *jobTable) forget(job *Job) {
+	this.mutex.Lock()
+	delete(this.jobs, job.ID)
+	this.mutex.Unlock()
+}
+
+// Jobs returns the jobs of this sorted by ID.
+func (this *Session) Jobs() []*Job {
+	this.jobs.mutex.Lock()
+	list := make([]*Job, 0, len(this.jobs.jobs))
+	for _, job := range this.jobs.jobs {
+		list = append(list, job)
+	}
+	this.jobs.mutex.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// Jobs returns the jobs of DefaultSession sorted by ID.
+func Jobs() []*Job {
+	return DefaultSession.Jobs()
+}
+
+// FindJob returns the job of `%N`, `N`, `%%` or `%+` (the latest job).
+func (this *Session) FindJob(spec string) (*Job, error) {
+	list := this.Jobs()
+	if spec == "%%" || spec == "%+" || spec == "" {
+		if len(list) <= 0 {
+			return nil, errors.New("no current job")
+		}
+		return list[len(list)-1], nil
+	}
+	id, err := strconv.Atoi(strings.TrimPrefix(spec, "%"))
+	if err != nil {
+		return nil, fmt.Errorf("%s: no such job", spec)
+	}
+	for _, job := range list {
+		if job.ID == id {
+			return job, nil
+		}
+	}
+	return nil, fmt.Errorf("%s: no such job", spec)
+}
+
+// FindJob returns the job of DefaultSession.
+func FindJob(spec string) (*Job, error) {
+	return DefaultSession.FindJob(spec)
+}
+
+// ReportJobs prints the jobs finished since the last report and
+// removes them from the job table.
+func (this *Session) ReportJobs(w io.Writer) {
+	for _, job := range this.Jobs() {
+		select {
+		case <-job.done:
+			fmt.Fprintln(w, job.String())
+			this.jobs.forget(job)
+		default:
+		}
+	}
+}
+
+// ReportJobs reports the jobs of DefaultSession.
+func ReportJobs(w io.Writer) {
+	DefaultSession.ReportJobs(w)
+}
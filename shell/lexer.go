@@ -0,0 +1,621 @@
+package shell
+
+import (
+	"bytes"
+	"io"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// TokenType is the kind of Token.
+type TokenType int
+
+const (
+	TOKEN_WORD     TokenType = iota // the characters out of the quotations
+	TOKEN_QUOTED                    // "...", '...' and the contents of the here-documents
+	TOKEN_VARIABLE                  // %NAME%, $NAME, ${...}, $N, $(...), $((...)), <(...) and >(...)
+	TOKEN_OPERATOR                  // ; \n & | |& && || ( )
+	TOKEN_REDIRECT                  // > >> < << <<< &> &>> with the number before them and &N or &- after them
+	TOKEN_COMMENT                   // # and the rest of the line
+	TOKEN_HISTORY                   // !! !N !-N !?STR? !STR with :N ^ $ * after them
+)
+
+var tokenTypeNames = [...]string{
+	"word", "quoted", "variable", "operator", "redirect", "comment", "history",
+}
+
+func (this TokenType) String() string {
+	if this < 0 || int(this) >= len(tokenTypeNames) {
+		return "unknown"
+	}
+	return tokenTypeNames[this]
+}
+
+// Token is a piece of the command line. The tokens without spaces
+// between them are one word of the command.
+type Token struct {
+	Type    TokenType
+	Text    string
+	Pos     int // the byte offset where the token starts
+	End     int // the byte offset where the token ends
+	RunePos int // the rune offset where the token starts
+	RuneEnd int // the rune offset where the token ends
+}
+
+// IsWord returns true when the token is a part of a word.
+func (this Token) IsWord() bool {
+	switch this.Type {
+	case TOKEN_WORD, TOKEN_QUOTED, TOKEN_VARIABLE, TOKEN_HISTORY:
+		return true
+	}
+	return false
+}
+
+// Lexer splits the command line into the tokens. The parser, the history
+// expansion and the completion read the line with it, so that they agree
+// on the quotations and the operators.
+type Lexer struct {
+	HistoryMark   rune   // the mark of the history expansion (0 disables it)
+	HistoryQuotes string // the quotations in which HistoryMark is not a mark
+
+	text         string
+	pos          int
+	quote        rune // the quotation not closed yet
+	yenCount     int  // the number of the backslashes just before pos
+	lastchar     byte
+	commandStart bool // true when a command can start at pos
+	parens       int  // the number of `(` not closed yet
+	inWord       bool // true when the last token is a part of the word at pos
+
+	readingDelimiter bool
+	delimiter        string
+	hereDocs         []string // the delimiters whose contents are not read
+	atHereDoc        bool     // true when the contents of the here-documents start at pos
+
+	runeByte  int // the byte offset which runeCount is counted to
+	runeCount int
+}
+
+// NewLexer returns the lexer of text, which reads `!` out of
+// the quotations as the history mark.
+func NewLexer(text string) *Lexer {
+	return &Lexer{
+		HistoryMark:   '!',
+		HistoryQuotes: `"'`,
+		text:          text,
+		lastchar:      ' ',
+		commandStart:  true,
+	}
+}
+
+// Tokenize returns all the tokens of text.
+func Tokenize(text string) []Token {
+	return NewLexer(text).Tokens()
+}
+
+// Tokens returns the rest of the tokens. The errors are ignored and
+// the token not closed extends to the end of the text.
+func (this *Lexer) Tokens() []Token {
+	tokens := []Token{}
+	for {
+		token, err := this.Next()
+		if err == io.EOF {
+			return tokens
+		}
+		if token.End > token.Pos {
+			tokens = append(tokens, token)
+		}
+	}
+}
+
+// reset moves the lexer to pos as the start of a statement.
+func (this *Lexer) reset(pos int, parens int, commandStart bool) {
+	this.pos = pos
+	this.quote = NOTQUOTED
+	this.yenCount = 0
+	this.lastchar = ' '
+	this.commandStart = commandStart
+	this.parens = parens
+	this.inWord = false
+	this.readingDelimiter = false
+	this.hereDocs = nil
+	this.atHereDoc = false
+}
+
+func (this *Lexer) byteAt(pos int) byte {
+	if pos < 0 || pos >= len(this.text) {
+		return 0
+	}
+	return this.text[pos]
+}
+
+func isDigit(ch byte) bool {
+	return '0' <= ch && ch <= '9'
+}
+
+func (this *Lexer) skipDigits(pos int) int {
+	for isDigit(this.byteAt(pos)) {
+		pos++
+	}
+	return pos
+}
+
+// runeOffset returns the number of the runes before pos.
+// It counts from the last offset asked since they are usually near.
+func (this *Lexer) runeOffset(pos int) int {
+	if pos >= this.runeByte {
+		this.runeCount += utf8.RuneCountInString(this.text[this.runeByte:pos])
+	} else {
+		this.runeCount -= utf8.RuneCountInString(this.text[pos:this.runeByte])
+	}
+	this.runeByte = pos
+	return this.runeCount
+}
+
+func (this *Lexer) token(tokenType TokenType, start int) Token {
+	return Token{
+		Type:    tokenType,
+		Text:    this.text[start:this.pos],
+		Pos:     start,
+		End:     this.pos,
+		RunePos: this.runeOffset(start),
+		RuneEnd: this.runeOffset(this.pos),
+	}
+}
+
+// Next returns the next token. It returns io.EOF at the end of the text
+// and IncompleteError with the token when `$(...)`, `<(...)`, the quotation
+// or the here-document is not closed.
+func (this *Lexer) Next() (Token, error) {
+	if this.atHereDoc {
+		return this.readHereDocs()
+	}
+	if this.quote == NOTQUOTED {
+		for this.byteAt(this.pos) == ' ' {
+			this.pos++
+			this.lastchar = ' '
+			this.yenCount = 0
+			this.inWord = false
+		}
+	}
+	if this.pos >= len(this.text) {
+		if this.quote != NOTQUOTED {
+			quote := this.quote
+			this.quote = NOTQUOTED
+			return this.token(TOKEN_QUOTED, this.pos), &IncompleteError{Closer: string(quote)}
+		}
+		return Token{}, io.EOF
+	}
+	var token Token
+	var err error
+	if this.quote != NOTQUOTED {
+		token, err = this.readQuoted()
+	} else {
+		token, err = this.readToken()
+	}
+
+	if token.Type == TOKEN_REDIRECT && strings.HasSuffix(token.Text, "<<") {
+		this.readingDelimiter = true
+		this.delimiter = ""
+	} else if this.readingDelimiter {
+		if token.IsWord() && (this.delimiter == "" || this.inWord) {
+			this.delimiter += token.Text
+		} else {
+			if this.delimiter != "" {
+				this.hereDocs = append(this.hereDocs, this.delimiter)
+			}
+			this.readingDelimiter = false
+		}
+	}
+	if token.Type == TOKEN_OPERATOR {
+		this.commandStart = token.Text != ")"
+		if token.Text == "\n" && len(this.hereDocs) > 0 {
+			this.atHereDoc = true
+		}
+	} else {
+		this.commandStart = false
+	}
+	if token.Type != TOKEN_WORD && token.Type != TOKEN_QUOTED {
+		this.yenCount = 0
+	}
+	this.inWord = token.IsWord()
+	if token.End > token.Pos {
+		this.lastchar = this.text[token.End-1]
+	}
+	return token, err
+}
+
+// readToken reads the token at pos out of the quotations.
+func (this *Lexer) readToken() (Token, error) {
+	start := this.pos
+	ch := this.text[start]
+	next := this.byteAt(start + 1)
+	switch {
+	case ch == '#' && (this.lastchar == ' ' || this.commandStart):
+		if end := strings.IndexByte(this.text[start:], '\n'); end >= 0 {
+			this.pos = start + end
+		} else {
+			this.pos = len(this.text)
+		}
+		return this.token(TOKEN_COMMENT, start), nil
+	case ch == '\n' || (ch == ';' && (this.lastchar == ' ' || this.commandStart)):
+		this.pos++
+	case ch == '|':
+		this.pos++
+		if next == '|' || next == '&' {
+			this.pos++
+		}
+	case ch == '&' && next == '>':
+		return this.readRedirect(), nil
+	case ch == '&':
+		this.pos++
+		if next == '&' {
+			this.pos++
+		}
+	case ch == '(' && this.commandStart:
+		this.parens++
+		this.pos++
+	case ch == ')' && this.parens > 0:
+		this.parens--
+		this.pos++
+	case (ch == '<' || ch == '>') && next == '(' && !this.inWord:
+		return this.readSubst(start, 2)
+	case ch == '<' || ch == '>' || (isDigit(ch) && (next == '<' || next == '>')):
+		return this.readRedirect(), nil
+	default:
+		return this.readWordPart()
+	}
+	return this.token(TOKEN_OPERATOR, start), nil
+}
+
+// readRedirect reads `[N]>`, `[N]>>`, `[N]<`, `<<`, `<<<`, `&>`, `&>>`
+// and `&N` or `&-` after `>` and `<`.
+func (this *Lexer) readRedirect() Token {
+	start := this.pos
+	pos := start
+	digit := isDigit(this.text[pos])
+	both := this.text[pos] == '&'
+	if digit || both {
+		pos++
+	}
+	op := this.text[pos]
+	pos++
+	if op == '>' && this.byteAt(pos) == '>' {
+		pos++
+	} else if op == '<' && !digit && this.byteAt(pos) == '<' {
+		// the here-document and the here-string
+		pos++
+		if this.byteAt(pos) == '<' {
+			pos++
+		}
+		this.pos = pos
+		return this.token(TOKEN_REDIRECT, start)
+	}
+	if !both && this.byteAt(pos) == '&' {
+		pos++
+		if ch := this.byteAt(pos); ch == '-' || isDigit(ch) {
+			pos++
+		}
+	}
+	this.pos = pos
+	return this.token(TOKEN_REDIRECT, start)
+}
+
+// readWordPart reads the characters of a word until the spaces,
+// the operators, the quotations and the variables.
+func (this *Lexer) readWordPart() (Token, error) {
+	start := this.pos
+	ch := this.text[start]
+	if (ch == '"' || ch == '\'') && this.yenCount%2 == 0 {
+		this.quote = rune(ch)
+		this.pos++
+		return this.readQuotedFrom(start), nil
+	}
+	if token, ok, err := this.readSpecial(); ok {
+		return token, err
+	}
+	for this.pos < len(this.text) {
+		ch := this.text[this.pos]
+		if this.pos > start {
+			if strings.IndexByte(" \n|&<>", ch) >= 0 ||
+				(ch == ')' && this.parens > 0) ||
+				(isDigit(ch) && strings.IndexByte("<>", this.byteAt(this.pos+1)) >= 0) ||
+				((ch == '"' || ch == '\'') && this.yenCount%2 == 0) ||
+				this.atSpecial() {
+				break
+			}
+		}
+		if ch == '\\' {
+			this.yenCount++
+		} else {
+			this.yenCount = 0
+		}
+		this.pos++
+	}
+	return this.token(TOKEN_WORD, start), nil
+}
+
+// readQuoted reads the quoted string continued from the last token.
+func (this *Lexer) readQuoted() (Token, error) {
+	if token, ok, err := this.readSpecial(); ok {
+		return token, err
+	}
+	return this.readQuotedFrom(this.pos), nil
+}
+
+// readQuotedFrom reads the quoted string until the closing quotation.
+// The variables in the double quotations are the other tokens.
+func (this *Lexer) readQuotedFrom(start int) Token {
+	for this.pos < len(this.text) {
+		ch := this.text[this.pos]
+		if rune(ch) == this.quote && this.yenCount%2 == 0 {
+			this.pos++
+			this.quote = NOTQUOTED
+			this.yenCount = 0
+			break
+		}
+		if this.pos > start && this.atSpecial() {
+			break
+		}
+		if ch == '\\' {
+			this.yenCount++
+		} else {
+			this.yenCount = 0
+		}
+		this.pos++
+	}
+	return this.token(TOKEN_QUOTED, start)
+}
+
+// atSpecial returns true when a variable, a substitution, `!(...)`
+// of the wildcard or a history mark starts at pos.
+func (this *Lexer) atSpecial() bool {
+	if this.yenCount%2 != 0 {
+		return false
+	}
+	switch this.text[this.pos] {
+	case '$':
+		if this.quote != '\'' &&
+			(this.byteAt(this.pos+1) == '(' || this.varLength(this.pos) > 0) {
+			return true
+		}
+	case '%':
+		if this.quote != '\'' && this.varLength(this.pos) > 0 {
+			return true
+		}
+	case '!':
+		if this.quote == NOTQUOTED && this.exclusionLength(this.pos) > 0 {
+			return true
+		}
+	}
+	return this.historyLength(this.pos) > 0
+}
+
+// readSpecial reads the token which atSpecial finds.
+func (this *Lexer) readSpecial() (Token, bool, error) {
+	if !this.atSpecial() {
+		return Token{}, false, nil
+	}
+	start := this.pos
+	if this.quote != '\'' {
+		if strings.HasPrefix(this.text[start:], "$(") {
+			token, err := this.readSubst(start, 2)
+			return token, true, err
+		}
+		if n := this.varLength(start); n > 0 {
+			this.pos += n
+			return this.token(TOKEN_VARIABLE, start), true, nil
+		}
+	}
+	if this.quote == NOTQUOTED {
+		if n := this.exclusionLength(start); n > 0 {
+			this.pos += n
+			this.yenCount = 0
+			return this.token(TOKEN_WORD, start), true, nil
+		}
+	}
+	this.pos += this.historyLength(start)
+	return this.token(TOKEN_HISTORY, start), true, nil
+}
+
+var rxDollarVar = regexp.MustCompile(`^\$(?:[A-Za-z_][A-Za-z0-9_]*|[0-9]+|\*|#)`)
+
+// varLength returns the length of `%NAME%`, `${...}` closed on the line,
+// `$NAME`, `$N`, `$*` or `$#` at pos, or 0.
+func (this *Lexer) varLength(pos int) int {
+	text := this.text[pos:]
+	if strings.HasPrefix(text, "%") {
+		if end := strings.IndexAny(text[1:], "% \t\r\n"); end > 0 && text[1+end] == '%' {
+			return end + 2
+		}
+	} else if strings.HasPrefix(text, "${") {
+		if end := closingBrace([]byte(text[1:])); end >= 0 && strings.IndexByte(text[:end+2], '\n') < 0 {
+			return end + 2
+		}
+	} else if m := rxDollarVar.FindString(text); m != "" {
+		return len(m)
+	}
+	return 0
+}
+
+// exclusionLength returns the length of `!(...)` of the wildcard
+// closed on the line at pos, or 0.
+func (this *Lexer) exclusionLength(pos int) int {
+	if !strings.HasPrefix(this.text[pos:], "!(") {
+		return 0
+	}
+	depth := 0
+	for i := pos + 1; i < len(this.text); i++ {
+		switch this.text[i] {
+		case '(':
+			depth++
+		case ')':
+			if depth--; depth == 0 {
+				return i + 1 - pos
+			}
+		case '\n':
+			return 0
+		}
+	}
+	return 0
+}
+
+// historyLength returns the length of the history mark at pos, or 0.
+// The mark followed by a space, `(` or nothing is not a mark.
+func (this *Lexer) historyLength(pos int) int {
+	if this.HistoryMark == 0 ||
+		(this.quote != NOTQUOTED && strings.ContainsRune(this.HistoryQuotes, this.quote)) {
+		return 0
+	}
+	mark := string(this.HistoryMark)
+	if !strings.HasPrefix(this.text[pos:], mark) {
+		return 0
+	}
+	i := pos + len(mark)
+	ch := this.byteAt(i)
+	switch {
+	case i >= len(this.text) || strings.IndexByte(" \t\r\n(\"'", ch) >= 0:
+		return 0
+	case strings.HasPrefix(this.text[i:], mark):
+		i = this.skipHistoryModifier(i + len(mark))
+	case ch == '^' || ch == '$' || ch == '*':
+		i++
+	case ch == ':' && isDigit(this.byteAt(i+1)):
+		i = this.skipDigits(i + 1)
+	case isDigit(ch):
+		i = this.skipHistoryModifier(this.skipDigits(i))
+	case ch == '-' && isDigit(this.byteAt(i+1)):
+		i = this.skipHistoryModifier(this.skipDigits(i + 1))
+	case ch == '?':
+		if end := strings.IndexAny(this.text[i+1:], "?\n"); end < 0 {
+			i = len(this.text)
+		} else if this.text[i+1+end] == '?' {
+			i += end + 2
+		} else {
+			i += end + 1
+		}
+	default:
+		for i < len(this.text) && strings.IndexByte(" \t\r\n\"'", this.text[i]) < 0 {
+			i++
+		}
+	}
+	return i - pos
+}
+
+// skipHistoryModifier skips `^`, `$`, `*` or `:N` after `!!`, `!N` and `!-N`.
+func (this *Lexer) skipHistoryModifier(pos int) int {
+	switch ch := this.byteAt(pos); {
+	case ch == '^' || ch == '$' || ch == '*':
+		return pos + 1
+	case ch == ':' && isDigit(this.byteAt(pos+1)):
+		return this.skipDigits(pos + 1)
+	}
+	return pos
+}
+
+// readSubst reads `$(...)`, `$((...))`, `<(...)` and `>(...)` at start.
+// prefix is the length before the command in them.
+func (this *Lexer) readSubst(start, prefix int) (Token, error) {
+	if strings.HasPrefix(this.text[start:], "$((") {
+		depth := 0
+		for i := start + 1; i < len(this.text); i++ {
+			if this.text[i] == '(' {
+				depth++
+			} else if this.text[i] == ')' {
+				if depth--; depth == 0 {
+					if isArith(this.text[start : i+1]) {
+						this.pos = i + 1
+						return this.token(TOKEN_VARIABLE, start), nil
+					}
+					break
+				}
+			}
+		}
+	}
+	sub := &Lexer{
+		text:         this.text,
+		pos:          start + prefix,
+		lastchar:     ' ',
+		commandStart: true,
+		parens:       1,
+		runeByte:     this.runeByte,
+		runeCount:    this.runeCount,
+	}
+	for {
+		token, err := sub.Next()
+		if err != nil {
+			this.pos = len(this.text)
+			if err == io.EOF {
+				err = &IncompleteError{Closer: ")"}
+			}
+			return this.token(TOKEN_VARIABLE, start), err
+		}
+		if token.Type == TOKEN_OPERATOR && token.Text == ")" && sub.parens <= 0 {
+			this.pos = sub.pos
+			return this.token(TOKEN_VARIABLE, start), nil
+		}
+	}
+}
+
+// readHereDoc reads the contents of the here-document from text[pos:]
+// until the line of delimiter. It returns the contents, the offset after
+// the line of delimiter and whether the delimiter is found.
+func readHereDoc(text string, pos int, delimiter string) (string, int, bool) {
+	stripTabs := false
+	if strings.HasPrefix(delimiter, "-") {
+		// <<-WORD removes the leading tabs.
+		delimiter = delimiter[1:]
+		stripTabs = true
+	}
+	delimiter = string2word(delimiter, true)
+
+	var buffer bytes.Buffer
+	for pos < len(text) {
+		var line string
+		if end := strings.IndexByte(text[pos:], '\n'); end >= 0 {
+			line = text[pos : pos+end]
+			pos += end + 1
+		} else {
+			line = text[pos:]
+			pos = len(text)
+		}
+		line = strings.TrimSuffix(line, "\r")
+		if stripTabs {
+			line = strings.TrimLeft(line, "\t")
+		}
+		if line == delimiter {
+			return buffer.String(), pos, true
+		}
+		buffer.WriteString(line)
+		buffer.WriteByte('\n')
+	}
+	return buffer.String(), pos, false
+}
+
+// readHereDocs reads the contents of the here-documents as one token
+// which ends before the newline after the last delimiter.
+func (this *Lexer) readHereDocs() (Token, error) {
+	this.atHereDoc = false
+	start := this.pos
+	var err error
+	for _, delimiter := range this.hereDocs {
+		var found bool
+		_, this.pos, found = readHereDoc(this.text, this.pos, delimiter)
+		if !found {
+			err = &IncompleteError{Closer: string2word(strings.TrimPrefix(delimiter, "-"), true)}
+			break
+		}
+	}
+	this.hereDocs = nil
+	if this.pos > start && this.text[this.pos-1] == '\n' {
+		this.pos--
+	}
+	this.inWord = false
+	this.lastchar = ' '
+	this.commandStart = true
+	if err == nil && this.pos <= start {
+		return this.Next()
+	}
+	return this.token(TOKEN_QUOTED, start), err
+}
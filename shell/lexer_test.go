@@ -0,0 +1,88 @@
+package shell
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func tokensString(tokens []Token) string {
+	result := make([]string, len(tokens))
+	for i, token := range tokens {
+		result[i] = fmt.Sprintf("%s[%s]", token.Type, token.Text)
+	}
+	return strings.Join(result, " ")
+}
+
+func TestTokenize(t *testing.T) {
+	for _, p := range []struct {
+		text   string
+		expect string
+	}{
+		{`echo "a %PATH% b"x ; ls`,
+			`word[echo] quoted["a ] variable[%PATH%] quoted[ b"] word[x] operator[;] word[ls]`},
+		{`echo a;b 'c;$d' $e ${f} $1 $*`,
+			`word[echo] word[a;b] quoted['c;$d'] variable[$e] variable[${f}] variable[$1] variable[$*]`},
+		{`a 2>&1 >>x.txt <y &>z | b |& c && d || e &`,
+			`word[a] redirect[2>&1] redirect[>>] word[x.txt] redirect[<] word[y] redirect[&>] word[z] operator[|] word[b] operator[|&] word[c] operator[&&] word[d] operator[||] word[e] operator[&]`},
+		{`echo $(a | b)c <(sort x) $((1+2)) # comment`,
+			`word[echo] variable[$(a | b)] word[c] variable[<(sort x)] variable[$((1+2))] comment[# comment]`},
+		{`( a ) ; echo a#b)`,
+			`operator[(] word[a] operator[)] operator[;] word[echo] word[a#b)]`},
+		{`echo !! !$ !-2:1 !?foo? !ls "!x" !(*.go|*.txt) a!`,
+			`word[echo] history[!!] history[!$] history[!-2:1] history[!?foo?] history[!ls] quoted["!x"] word[!(*.go|*.txt)] word[a!]`},
+		{"cat <<EOF ; echo x\nline %A%\nEOF\necho done",
+			`word[cat] redirect[<<] word[EOF] operator[;] word[echo] word[x] operator[` + "\n" + `] quoted[line %A%` + "\nEOF" + `] operator[` + "\n" + `] word[echo] word[done]`},
+	} {
+		if result := tokensString(Tokenize(p.text)); result != p.expect {
+			t.Errorf("`%s`:\n  %s\n  expect %s", p.text, result, p.expect)
+		}
+	}
+}
+
+func TestLexerOffset(t *testing.T) {
+	text := "ｅｃｈｏ \"あ b\" c"
+	tokens := Tokenize(text)
+	if len(tokens) != 3 {
+		t.Fatalf("tokens: %s", tokensString(tokens))
+	}
+	for _, token := range tokens {
+		if text[token.Pos:token.End] != token.Text {
+			t.Errorf("%s: byte offset %d-%d", token.Text, token.Pos, token.End)
+		}
+		runes := []rune(text)
+		if string(runes[token.RunePos:token.RuneEnd]) != token.Text {
+			t.Errorf("%s: rune offset %d-%d", token.Text, token.RunePos, token.RuneEnd)
+		}
+	}
+}
+
+func TestLexerHistoryMark(t *testing.T) {
+	lexer := NewLexer(`echo ^^ "^x" '^y'`)
+	lexer.HistoryMark = '^'
+	lexer.HistoryQuotes = `'`
+	expect := `word[echo] history[^^] quoted["] history[^x] quoted["] quoted['^y']`
+	if result := tokensString(lexer.Tokens()); result != expect {
+		t.Errorf("%s\n  expect %s", result, expect)
+	}
+
+	lexer = NewLexer(`echo !! !x`)
+	lexer.HistoryMark = 0
+	expect = `word[echo] word[!!] word[!x]`
+	if result := tokensString(lexer.Tokens()); result != expect {
+		t.Errorf("%s\n  expect %s", result, expect)
+	}
+}
+
+func TestLexerIncomplete(t *testing.T) {
+	for _, text := range []string{"echo $(echo a", "cat <<EOF\nline1"} {
+		lexer := NewLexer(text)
+		var err error
+		for err == nil {
+			_, err = lexer.Next()
+		}
+		if !IsIncomplete(err) {
+			t.Errorf("`%s`: %v", text, err)
+		}
+	}
+}
@@ -6,6 +6,8 @@ import (
 	"io"
 	"os"
 	"os/signal"
+	"strings"
+	"time"
 )
 
 type Stream interface {
@@ -14,6 +16,65 @@ type Stream interface {
 	SetPos(int) error
 }
 
+// Recorder is the Stream which keeps the results of the command-lines
+// read from it. Loop calls Record after each command-line runs.
+type Recorder interface {
+	Record(errorlevel int, elapsed time.Duration)
+}
+
+// endsWithCaret returns true when text ends with `^` out of
+// the quotations, which continues the command to the next line
+// as CMD.EXE. `^^` is the caret itself.
+func endsWithCaret(text string) bool {
+	if !strings.HasSuffix(text, "^") {
+		return false
+	}
+	lexer := NewLexer(text)
+	lexer.HistoryMark = 0
+	tokens := lexer.Tokens()
+	if len(tokens) <= 0 {
+		return false
+	}
+	last := tokens[len(tokens)-1]
+	if last.Type != TOKEN_WORD || last.End != len(text) {
+		return false
+	}
+	carets := len(last.Text) - len(strings.TrimRight(last.Text, "^"))
+	return carets%2 == 1
+}
+
+// ContinueLine joins next to line which is incomplete. The lines are
+// joined with "\n" but the line ending with `^` is joined without
+// the caret and the newline.
+func ContinueLine(line, next string) string {
+	if endsWithCaret(line) {
+		return line[:len(line)-1] + next
+	}
+	return line + "\n" + next
+}
+
+// readCommand reads lines until they make a complete command.
+// The lines of if/for/while-blocks, groups and quotations and the lines
+// after `|`, `&&` and `||` are joined by ContinueLine.
+func readCommand(ctx context.Context, stream Stream) (context.Context, string, error) {
+	ctx, line, err := stream.ReadLine(ctx)
+	if err != nil {
+		return ctx, line, err
+	}
+	for {
+		if _, err := Parse(line); !IsIncomplete(err) {
+			return ctx, line, nil
+		}
+		var next string
+		ctx, next, err = stream.ReadLine(ctx)
+		if err != nil {
+			// let the interpreter report that the block is not closed.
+			return ctx, line, nil
+		}
+		line = ContinueLine(line, next)
+	}
+}
+
 func (it *Cmd) Loop(stream Stream) error {
 	sigint := make(chan os.Signal, 1)
 	defer close(sigint)
@@ -21,8 +82,9 @@ func (it *Cmd) Loop(stream Stream) error {
 	defer close(quit)
 
 	for {
+		it.Session().ReportJobs(os.Stderr)
 		ctx, cancel := context.WithCancel(context.Background())
-		ctx, line, err := stream.ReadLine(ctx)
+		ctx, line, err := readCommand(ctx, stream)
 
 		if err != nil {
 			cancel()
@@ -43,20 +105,36 @@ func (it *Cmd) Loop(stream Stream) error {
 				}
 			}
 		}(sigint, quit, cancel)
-		_, err = it.InterpretContext(ctx, line)
+		times, errorlevel, err := it.measure(func() (int, error) {
+			return it.InterpretContext(ctx, line)
+		})
 		signal.Stop(sigint)
 		quit <- struct{}{}
 
+		if recorder, ok := stream.(Recorder); ok {
+			recorder.Record(errorlevel, times.Real)
+		}
+
+		if reportTime := it.Session().ReportTime(); reportTime > 0 && times.Real >= time.Duration(reportTime)*time.Second {
+			fmt.Fprint(os.Stderr, times)
+		}
+
 		if err != nil {
 			if err == io.EOF {
 				break
 			}
+			if IsErrorLevelError(err) {
+				return err
+			}
 			if err1, ok := err.(AlreadyReportedError); ok {
 				if err1.Err == io.EOF {
 					break
 				}
 			} else {
 				fmt.Fprintln(os.Stderr, err)
+				if err1, ok := err.(*ParseError); ok {
+					fmt.Fprintln(os.Stderr, err1.Caret())
+				}
 			}
 		}
 	}
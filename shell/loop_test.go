@@ -0,0 +1,87 @@
+package shell
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"testing"
+	"time"
+)
+
+type linesStream struct {
+	lines []string
+	pos   int
+}
+
+func (this *linesStream) ReadLine(ctx context.Context) (context.Context, string, error) {
+	if this.pos >= len(this.lines) {
+		return ctx, "", io.EOF
+	}
+	this.pos++
+	return ctx, this.lines[this.pos-1], nil
+}
+
+func (this *linesStream) GetPos() int { return this.pos }
+
+func (this *linesStream) SetPos(pos int) error {
+	this.pos = pos
+	return nil
+}
+
+func TestReadCommand(t *testing.T) {
+	stream := &linesStream{lines: []string{"if a==a", "echo 1", "end", "echo 2"}}
+	_, line, err := readCommand(context.Background(), stream)
+	if err != nil || line != "if a==a\necho 1\nend" {
+		t.Errorf("command-1: %q %v", line, err)
+	}
+	_, line, err = readCommand(context.Background(), stream)
+	if err != nil || line != "echo 2" {
+		t.Errorf("command-2: %q %v", line, err)
+	}
+	if _, _, err = readCommand(context.Background(), stream); err != io.EOF {
+		t.Errorf("command-3: %v", err)
+	}
+}
+
+func TestReadCommandContinued(t *testing.T) {
+	stream := &linesStream{lines: []string{
+		`echo "a`, `b"`,
+		"dir |", "more",
+		"a &&", "", "b",
+		"echo a ^", "b ^^",
+	}}
+	for _, expect := range []string{"echo \"a\nb\"", "dir |\nmore", "a &&\n\nb", "echo a b ^^"} {
+		_, line, err := readCommand(context.Background(), stream)
+		if err != nil || line != expect {
+			t.Errorf("%q %v: expect %q", line, err, expect)
+		}
+	}
+}
+
+type recordStream struct {
+	linesStream
+	results []int
+}
+
+func (this *recordStream) Record(errorlevel int, elapsed time.Duration) {
+	if elapsed <= 0 {
+		errorlevel = -1
+	}
+	this.results = append(this.results, errorlevel)
+}
+
+func TestLoopRecord(t *testing.T) {
+	session := NewSession()
+	session.SetHook(func(ctx context.Context, cmd *Cmd) (int, bool, error) {
+		n, _ := strconv.Atoi(cmd.Args[1])
+		return n, true, nil
+	})
+	stream := &recordStream{linesStream: linesStream{lines: []string{"x 0", "x 3 | x 4", "x 0 &&", "x 6"}}}
+	if err := session.NewCmd().Loop(stream); err != io.EOF {
+		t.Errorf("Loop: %v", err)
+	}
+	if result := fmt.Sprint(stream.results); result != "[0 4 6]" {
+		t.Errorf("results: %s", result)
+	}
+}
@@ -0,0 +1,156 @@
+package shell
+
+import (
+	"fmt"
+)
+
+// options are the values of nyagos.option. Each session has them,
+// and a subshell starts with the copy of its parent's.
+type options struct {
+	wildCardExpansionAlways bool
+	pipeFail                bool
+	exitOnError             bool
+	xTrace                  bool
+	xTracePrefix            string
+	reportTime              int
+	globNull                bool
+	globCaseSensitive       bool
+}
+
+var defaultOptions = options{xTracePrefix: "+ "}
+
+// WildCardExpansionAlways makes the wildcards in the arguments of
+// the external commands expanded too.
+func (this *Session) WildCardExpansionAlways() bool {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.options.wildCardExpansionAlways
+}
+
+func (this *Session) SetWildCardExpansionAlways(value bool) {
+	this.mutex.Lock()
+	this.options.wildCardExpansionAlways = value
+	this.mutex.Unlock()
+}
+
+// PipeFail makes the errorlevel of a pipeline that of the last stage
+// which failed instead of the last stage.
+func (this *Session) PipeFail() bool {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.options.pipeFail
+}
+
+func (this *Session) SetPipeFail(value bool) {
+	this.mutex.Lock()
+	this.options.pipeFail = value
+	this.mutex.Unlock()
+}
+
+// ExitOnError (errexit) makes the command which fails out of conditionals
+// (the left side of `&&` and `||`) end the script.
+func (this *Session) ExitOnError() bool {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.options.exitOnError
+}
+
+func (this *Session) SetExitOnError(value bool) {
+	this.mutex.Lock()
+	this.options.exitOnError = value
+	this.mutex.Unlock()
+}
+
+// XTrace makes each command printed to the standard error with
+// XTracePrefix before it runs. The command is printed after aliases
+// and argsfilter are applied.
+func (this *Session) XTrace() bool {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.options.xTrace
+}
+
+func (this *Session) SetXTrace(value bool) {
+	this.mutex.Lock()
+	this.options.xTrace = value
+	this.mutex.Unlock()
+}
+
+func (this *Session) XTracePrefix() string {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.options.xTracePrefix
+}
+
+func (this *Session) SetXTracePrefix(value string) {
+	this.mutex.Lock()
+	this.options.xTracePrefix = value
+	this.mutex.Unlock()
+}
+
+// ReportTime is the threshold in seconds. When a command line takes
+// longer than it, Loop prints the times. Zero or less disables it.
+func (this *Session) ReportTime() int {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.options.reportTime
+}
+
+func (this *Session) SetReportTime(value int) {
+	this.mutex.Lock()
+	this.options.reportTime = value
+	this.mutex.Unlock()
+}
+
+// GlobNull removes the wildcards which match no files from
+// the arguments instead of leaving them as they are.
+func (this *Session) GlobNull() bool {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.options.globNull
+}
+
+func (this *Session) SetGlobNull(value bool) {
+	this.mutex.Lock()
+	this.options.globNull = value
+	this.mutex.Unlock()
+}
+
+// GlobCaseSensitive makes the wildcards distinguish upper and lower case.
+func (this *Session) GlobCaseSensitive() bool {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.options.globCaseSensitive
+}
+
+func (this *Session) SetGlobCaseSensitive(value bool) {
+	this.mutex.Lock()
+	this.options.globCaseSensitive = value
+	this.mutex.Unlock()
+}
+
+// ErrorLevelError is the error which stops the script by ExitOnError.
+type ErrorLevelError struct {
+	ErrorLevel int
+}
+
+func (this *ErrorLevelError) Error() string {
+	return fmt.Sprintf("stopped by errexit (ERRORLEVEL=%d)", this.ErrorLevel)
+}
+
+// IsErrorLevelError returns true when err is ErrorLevelError or
+// its AlreadyReportedError.
+func IsErrorLevelError(err error) bool {
+	if e, ok := err.(AlreadyReportedError); ok {
+		err = e.Err
+	}
+	_, ok := err.(*ErrorLevelError)
+	return ok
+}
+
+// Trace prints Args to the standard error of this when XTrace is true.
+func (this *Cmd) Trace() {
+	if session := this.Session(); session.XTrace() && len(this.Args) > 0 {
+		fmt.Fprintf(this.Stderr, "%s%s\n", session.XTracePrefix(), makeCmdline(this.Args, this.RawArgs))
+	}
+}
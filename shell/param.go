@@ -0,0 +1,213 @@
+package shell
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+var rxVarName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*`)
+
+// readDollar reads NAME or {...} after `$` and returns the value.
+// `$NAME` is replaced only when NAME is a shell variable.
+// When it is not replaced, source is not moved.
+func (this *variables) readDollar(source *strings.Reader) (string, bool, error) {
+	start, _ := source.Seek(0, io.SeekCurrent)
+	rest := make([]byte, source.Len())
+	source.Read(rest)
+	source.Seek(start, io.SeekStart)
+
+	if len(rest) > 0 && rest[0] == '{' {
+		end := closingBrace(rest)
+		if end < 0 {
+			return "", false, nil
+		}
+		value, ok, err := this.expandParam(string(rest[1:end]))
+		if ok && err == nil {
+			source.Seek(start+int64(end+1), io.SeekStart)
+		}
+		return value, ok, err
+	}
+	name := string(rxVarName.Find(rest))
+	if name == "" {
+		return "", false, nil
+	}
+	value, ok := this.lookup(name)
+	if !ok {
+		return "", false, nil
+	}
+	source.Seek(start+int64(len(name)), io.SeekStart)
+	return value, true, nil
+}
+
+// closingBrace returns the offset of `}` for `{` at text[0] or -1.
+func closingBrace(text []byte) int {
+	depth := 0
+	for i, ch := range text {
+		switch ch {
+		case '{':
+			depth++
+		case '}':
+			if depth--; depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// expandParam returns the value of `${PARAM}`. PARAM is one of
+//
+//	NAME            the value (empty when not defined)
+//	#NAME           the length of the value
+//	NAME:-WORD      WORD when NAME is not defined or empty
+//	NAME:=WORD      same as :- and sets WORD to NAME
+//	NAME:?MESSAGE   an error when NAME is not defined or empty
+//	NAME#PATTERN    removes the shortest prefix matching PATTERN (## for the longest)
+//	NAME%PATTERN    removes the shortest suffix matching PATTERN (%% for the longest)
+//
+// NAME is looked up in the shell variables and OurGetEnv.
+func (this *variables) expandParam(param string) (string, bool, error) {
+	if strings.HasPrefix(param, "#") {
+		if name := rxVarName.FindString(param[1:]); name != "" && len(name) == len(param)-1 {
+			value, _ := this.getenv(name)
+			return strconv.Itoa(utf8.RuneCountInString(value)), true, nil
+		}
+	}
+	name := rxVarName.FindString(param)
+	if name == "" {
+		return "", false, nil
+	}
+	value, ok := this.getenv(name)
+	op := param[len(name):]
+	if op == "" {
+		return value, true, nil
+	}
+	for _, prefix := range []string{":-", ":=", ":?", "##", "#", "%%", "%"} {
+		if !strings.HasPrefix(op, prefix) {
+			continue
+		}
+		word, err := this.expandString(op[len(prefix):], true)
+		if err != nil {
+			return "", false, err
+		}
+		switch prefix {
+		case ":-":
+			if !ok {
+				value = word
+			}
+		case ":=":
+			if !ok {
+				this.assign(name, word)
+				value = word
+			}
+		case ":?":
+			if !ok {
+				if word == "" {
+					word = "parameter null or not set"
+				}
+				return "", false, fmt.Errorf("%s: %s", name, word)
+			}
+		case "##", "#":
+			value = removeMatch(value, word, true, prefix == "##")
+		case "%%", "%":
+			value = removeMatch(value, word, false, prefix == "%%")
+		}
+		return value, true, nil
+	}
+	return "", false, fmt.Errorf("${%s}: bad substitution", param)
+}
+
+// pattern2regexp converts the wildcard pattern (`*`, `?` and `[...]`)
+// into the regular expression matching the whole string.
+func pattern2regexp(pattern string) (*regexp.Regexp, error) {
+	var buffer bytes.Buffer
+	buffer.WriteString(`^(?s:`)
+	for i := 0; i < len(pattern); i++ {
+		switch ch := pattern[i]; ch {
+		case '*':
+			buffer.WriteString(`.*`)
+		case '?':
+			buffer.WriteString(`.`)
+		case '[':
+			if end := strings.IndexByte(pattern[i+1:], ']'); end >= 0 {
+				class := pattern[i+1 : i+1+end]
+				if strings.HasPrefix(class, "!") {
+					class = "^" + class[1:]
+				}
+				buffer.WriteString("[" + strings.Replace(class, `\`, `\\`, -1) + "]")
+				i += end + 1
+			} else {
+				buffer.WriteString(regexp.QuoteMeta("["))
+			}
+		default:
+			buffer.WriteString(regexp.QuoteMeta(string(ch)))
+		}
+	}
+	buffer.WriteString(`)$`)
+	return regexp.Compile(buffer.String())
+}
+
+// removeMatch removes the prefix (or the suffix) of value matching pattern.
+func removeMatch(value, pattern string, prefix, longest bool) string {
+	rx, err := pattern2regexp(pattern)
+	if err != nil {
+		return value
+	}
+	// the offsets of the characters and the end of value
+	offsets := []int{}
+	for i := range value {
+		offsets = append(offsets, i)
+	}
+	offsets = append(offsets, len(value))
+	for j := range offsets {
+		if longest {
+			j = len(offsets) - 1 - j
+		}
+		if prefix {
+			if rx.MatchString(value[:offsets[j]]) {
+				return value[offsets[j]:]
+			}
+		} else {
+			k := len(offsets) - 1 - j
+			if rx.MatchString(value[offsets[k]:]) {
+				return value[:offsets[k]]
+			}
+		}
+	}
+	return value
+}
+
+// substring returns `%VAR:~START,LENGTH%` of value.
+// Negative START is counted from the end. Negative LENGTH leaves
+// that many characters at the end.
+func substring(value, start_, length_ string) string {
+	chars := []rune(value)
+	start, _ := strconv.Atoi(start_)
+	if start < 0 {
+		start += len(chars)
+		if start < 0 {
+			start = 0
+		}
+	}
+	if start > len(chars) {
+		return ""
+	}
+	end := len(chars)
+	if length_ != "" {
+		length, _ := strconv.Atoi(length_)
+		if length < 0 {
+			end = len(chars) + length
+		} else if start+length < end {
+			end = start + length
+		}
+	}
+	if end <= start {
+		return ""
+	}
+	return string(chars[start:end])
+}
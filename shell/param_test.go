@@ -0,0 +1,90 @@
+package shell
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestExpandParam(t *testing.T) {
+	os.Setenv("NYAGOS_TEST_PATH", `C:\foo\bar.tar.gz`)
+	defer os.Unsetenv("NYAGOS_TEST_PATH")
+	os.Unsetenv("NYAGOS_TEST_UNDEF")
+	it := New()
+	it.SetVar("V", "0123456789")
+
+	cases := []struct {
+		word   string
+		expect string
+	}{
+		{`%V:~2,3%`, `234`},
+		{`%V:~-3%`, `789`},
+		{`%V:~1,-7%`, `12`},
+		{`%V:~20%`, ``},
+		{`%V:3=x%`, `012x456789`},
+		{`${#V}`, `10`},
+		{`${NYAGOS_TEST_UNDEF:-a b}`, `a b`},
+		{`${V:-none}`, `0123456789`},
+		{`${NYAGOS_TEST_PATH##*\}`, `bar.tar.gz`},
+		{`${NYAGOS_TEST_PATH#*\}`, `foo\bar.tar.gz`},
+		{`${NYAGOS_TEST_PATH%.*}`, `C:\foo\bar.tar`},
+		{`${NYAGOS_TEST_PATH%%.*}`, `C:\foo\bar`},
+		{`${NYAGOS_TEST_PATH%.[gx]z}`, `C:\foo\bar.tar`},
+		{`[${NYAGOS_TEST_UNDEF}]`, `[]`},
+		{`${ERRORLEVEL:-x}`, `0`},
+	}
+	it.Session().SetLastErrorLevel(0)
+	for _, c := range cases {
+		result, err := it.expandWord(c.word, true)
+		if err != nil {
+			t.Errorf("%s: %s", c.word, err.Error())
+		} else if result != c.expect {
+			t.Errorf("%s: %s (expected %s)", c.word, result, c.expect)
+		}
+	}
+
+	if _, err := it.expandWord(`${NYAGOS_TEST_UNDEF:-${V/0/1}}`, true); err == nil {
+		t.Error("bad substitution: no error")
+	}
+	if _, err := it.expandWord(`${NYAGOS_TEST_UNDEF:?is required}`, true); err == nil || err.Error() != "NYAGOS_TEST_UNDEF: is required" {
+		t.Errorf(":?: %v", err)
+	}
+	if result, _ := it.expandWord(`${NYAGOS_TEST_UNDEF:=set}`, true); result != "set" || os.Getenv("NYAGOS_TEST_UNDEF") != "set" {
+		t.Errorf(":=: %s", result)
+	}
+	os.Unsetenv("NYAGOS_TEST_UNDEF")
+}
+
+func TestInterpretParam(t *testing.T) {
+	called := []string{}
+	orgHook := SetHook(func(ctx context.Context, cmd *Cmd) (int, bool, error) {
+		called = append(called, cmd.Args[1])
+		return 0, true, nil
+	})
+	defer SetHook(orgHook)
+
+	var stderr bytes.Buffer
+	it := New()
+	it.Stderr = &stderr
+	_, err := it.Interpret(`show ${NYAGOS_TEST_UNDEF:?}`)
+	if !IsAlreadyReported(err) || !strings.Contains(stderr.String(), "parameter null or not set") {
+		t.Errorf("error: %v %q", err, stderr.String())
+	}
+	if len(called) > 0 {
+		t.Error("the command ran")
+	}
+
+	stderr.Reset()
+	errorlevel, err := it.Interpret(`show ${NYAGOS_TEST_UNDEF:?missing} ; show after`)
+	if err != nil || errorlevel != 0 {
+		t.Errorf("not last: %d %v", errorlevel, err)
+	}
+	if stderr.String() != "NYAGOS_TEST_UNDEF: missing\n" {
+		t.Errorf("not last: stderr %q", stderr.String())
+	}
+	if result := strings.Join(called, " "); result != "after" {
+		t.Errorf("not last: called %s", result)
+	}
+}
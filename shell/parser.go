@@ -2,7 +2,6 @@ package shell
 
 import (
 	"bytes"
-	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -10,17 +9,12 @@ import (
 	"strconv"
 	"strings"
 	"unicode"
+	"unicode/utf8"
 
+	"github.com/mattn/go-runewidth"
 	"github.com/zetamatta/nyagos/dos"
 )
 
-type StatementT struct {
-	Args     []string
-	RawArgs  []string
-	Redirect []*Redirecter
-	Term     string
-}
-
 var prefix []string = []string{" 0<", " 1>", " 2>"}
 
 var PercentFunc = map[string]func() string{
@@ -33,25 +27,41 @@ var PercentFunc = map[string]func() string{
 		}
 	},
 	"ERRORLEVEL": func() string {
-		return fmt.Sprintf("%d", LastErrorLevel)
+		value, _ := DefaultSession.getenv("ERRORLEVEL")
+		return value
+	},
+	"PIPESTATUS": func() string {
+		value, _ := DefaultSession.getenv("PIPESTATUS")
+		return value
 	},
 }
 
 var rxUnicode = regexp.MustCompile("^[uU]\\+?([0-9a-fA-F]+)$")
 
+var rxPercentVar = regexp.MustCompile(`%[^%\s]+%`)
+
 var rxSubstitute = regexp.MustCompile(`^([^\:]+)\:([^\=]+)=(.*)$`)
 
-func ourGetenvSub(name string) (string, bool) {
+var rxSubstring = regexp.MustCompile(`^([^\:]+)\:~\s*(-?[0-9]+)\s*(?:,\s*(-?[0-9]+)\s*)?$`)
+
+func (this *variables) ourGetenvSub(name string) (string, bool) {
+	if m := rxSubstring.FindStringSubmatch(name); m != nil {
+		base, ok := this.getenv(m[1])
+		if !ok {
+			return "", false
+		}
+		return substring(base, m[2], m[3]), true
+	}
 	m := rxSubstitute.FindStringSubmatch(name)
 	if m != nil {
-		base, ok := OurGetEnv(m[1])
+		base, ok := this.getenv(m[1])
 		if ok {
 			return strings.Replace(base, m[2], m[3], -1), true
 		} else {
 			return "", false
 		}
 	} else {
-		return OurGetEnv(name)
+		return this.getenv(name)
 	}
 }
 
@@ -69,23 +79,22 @@ func OurGetEnv(name string) (string, bool) {
 	}
 }
 
-func chomp(buffer *bytes.Buffer) {
-	original := buffer.String()
-	buffer.Reset()
-	var lastchar rune
-	for i, ch := range original {
-		if i > 0 {
-			buffer.WriteRune(lastchar)
-		}
-		lastchar = ch
-	}
-}
-
 const NOTQUOTED = '\000'
 
 const EMPTY_COMMAND_FOUND = "Empty command found"
 
+const SYNTAX_ERROR = "The syntax of the command is incorrect."
+
 func string2word(source_ string, removeQuote bool) string {
+	var vars *variables
+	result, _ := vars.expandString(source_, removeQuote)
+	return result
+}
+
+// expandString is string2word with the shell variables in this.
+// `%NAME%` and `${NAME...}` are the shell variable or the environment
+// variable and `$NAME` is the shell variable only.
+func (this *variables) expandString(source_ string, removeQuote bool) (string, error) {
 	var buffer bytes.Buffer
 	source := strings.NewReader(source_)
 
@@ -108,19 +117,22 @@ func string2word(source_ string, removeQuote bool) string {
 		}
 		if ch == '%' && quoteNow != '\'' && yenCount%2 == 0 {
 			var nameBuf bytes.Buffer
+			// not nameBuf.Len() to go back because an invalid byte is
+			// written as the 3-byte replacement character
+			nameStart, _ := source.Seek(0, io.SeekCurrent)
 			for {
 				ch, _, err = source.ReadRune()
 				if err != nil {
 					buffer.WriteRune('%')
-					source.Seek(-int64(nameBuf.Len()), io.SeekCurrent)
+					source.Seek(nameStart, io.SeekStart)
 					break
 				}
 				if ch == '%' {
-					if value, ok := ourGetenvSub(nameBuf.String()); ok {
+					if value, ok := this.ourGetenvSub(nameBuf.String()); ok {
 						buffer.WriteString(value)
 					} else {
 						buffer.WriteRune('%')
-						source.Seek(-int64(nameBuf.Len()+1), io.SeekCurrent)
+						source.Seek(nameStart, io.SeekStart)
 					}
 					break
 				}
@@ -128,6 +140,20 @@ func string2word(source_ string, removeQuote bool) string {
 			}
 			continue
 		}
+		if ch == '$' && quoteNow != '\'' && yenCount%2 == 0 {
+			value, ok, err := this.readDollar(source)
+			if err != nil {
+				return "", err
+			}
+			if ok {
+				for ; yenCount > 0; yenCount-- {
+					buffer.WriteRune('\\')
+				}
+				buffer.WriteString(value)
+				lastchar = ch
+				continue
+			}
+		}
 
 		if quoteNow != NOTQUOTED && ch == quoteNow && yenCount%2 == 0 {
 			if !removeQuote {
@@ -171,194 +197,979 @@ func string2word(source_ string, removeQuote bool) string {
 	for ; yenCount > 0; yenCount-- {
 		buffer.WriteRune('\\')
 	}
-	return buffer.String()
+	return buffer.String(), nil
 }
 
-func parse1(text string) ([]*StatementT, error) {
-	quoteNow := NOTQUOTED
-	yenCount := 0
-	statements := make([]*StatementT, 0)
-	args := make([]string, 0)
-	rawArgs := make([]string, 0)
-	lastchar := ' '
-	var buffer bytes.Buffer
-	isNextRedirect := false
-	redirect := make([]*Redirecter, 0, 3)
+type parser struct {
+	text   string
+	reader *strings.Reader
+	lexer  *Lexer
+	parens int // the number of `(` not closed yet
+	braces int // the number of `{` not closed yet
+	blocks int // the number of if/for/while blocks not closed by `end` yet
+	ifLine int // the number of one-line if-statements being read
+	opPos  int // the offset of the last operator read
 
-	term_line := func(term string) {
-		statement1 := new(StatementT)
-		if buffer.Len() > 0 {
-			if isNextRedirect && len(redirect) > 0 {
-				redirect[len(redirect)-1].SetPath(string2word(buffer.String(), true))
-				isNextRedirect = false
-				statement1.RawArgs = rawArgs
-				statement1.Args = args
-			} else {
-				statement1.RawArgs = append(rawArgs, string2word(buffer.String(), false))
-				statement1.Args = append(args, string2word(buffer.String(), true))
-			}
-			buffer.Reset()
-		} else if len(args) <= 0 {
+	hereDocs   []*Redirecter // the here-documents whose contents are not read yet
+	hereDocEnd map[int]int   // the offsets of the contents of the here-documents read: start -> end
+}
+
+func (this *parser) offset() int {
+	return len(this.text) - this.reader.Len()
+}
+
+func (this *parser) seek(offset int) {
+	this.reader.Seek(int64(offset), io.SeekStart)
+}
+
+func (this *parser) skipSpaces() {
+	for this.reader.Len() > 0 {
+		ch, _, _ := this.reader.ReadRune()
+		if ch != ' ' {
+			this.reader.UnreadRune()
 			return
-		} else {
-			statement1.RawArgs = rawArgs
-			statement1.Args = args
 		}
-		statement1.Redirect = redirect
-		redirect = make([]*Redirecter, 0, 3)
-		rawArgs = make([]string, 0)
-		args = make([]string, 0)
-		statement1.Term = term
-		statements = append(statements, statement1)
 	}
+}
+
+// lexerAt returns the lexer which reads from the offset of this
+// as the start of a statement.
+func (this *parser) lexerAt(commandStart bool) *Lexer {
+	if this.lexer == nil {
+		this.lexer = &Lexer{text: this.text}
+	}
+	this.lexer.reset(this.offset(), this.parens, commandStart)
+	return this.lexer
+}
+
+// skipLineEnds skips the spaces, the comments and the newlines after
+// `|`, `&&` and `||`, whose command can be on the next line.
+// It returns false when the text ends.
+func (this *parser) skipLineEnds() bool {
+	for {
+		this.skipSpaces()
+		if this.nextIs('#') {
+			for this.reader.Len() > 0 && !this.nextIs('\n') {
+				this.reader.ReadRune()
+			}
+		}
+		if !this.nextIs('\n') {
+			return this.reader.Len() > 0
+		}
+		this.readOperator()
+	}
+}
+
+// nextIs returns true when the next character is ch.
+func (this *parser) nextIs(ch rune) bool {
+	next, _, err := this.reader.ReadRune()
+	if err != nil {
+		return false
+	}
+	this.reader.UnreadRune()
+	return next == ch
+}
+
+// atWordEnd returns true when the next character ends a word.
+func (this *parser) atWordEnd() bool {
+	ch, _, err := this.reader.ReadRune()
+	if err != nil {
+		return true
+	}
+	this.reader.UnreadRune()
+	return strings.ContainsRune(" \n;|&)", ch)
+}
+
+// atLineEnd returns true when only spaces or a comment remain on the line.
+func (this *parser) atLineEnd() bool {
+	this.skipSpaces()
+	ch, _, err := this.reader.ReadRune()
+	if err != nil {
+		return true
+	}
+	this.reader.UnreadRune()
+	return ch == '\n' || ch == '#'
+}
+
+// readWord reads one word as written in the source.
+func (this *parser) readWord() string {
+	this.skipSpaces()
+	lexer := this.lexerAt(true)
+	start := this.offset()
+	end := start
+	for {
+		token, err := lexer.Next()
+		if err != nil || token.Pos != end || !token.IsWord() {
+			break
+		}
+		if token.Type == TOKEN_WORD && !strings.HasPrefix(token.Text, "!(") {
+			// `(`, `)` and `;` in the word end it.
+			if i := strings.IndexAny(token.Text, "();"); i >= 0 {
+				end = token.Pos + i
+				break
+			}
+		}
+		end = token.End
+	}
+	this.seek(end)
+	return this.text[start:end]
+}
+
+// peekWord returns the next word in lower case without reading it.
+func (this *parser) peekWord() string {
+	pos := this.offset()
+	word := this.readWord()
+	this.seek(pos)
+	return strings.ToLower(word)
+}
+
+// peekKeyword returns "else" or "end" when it is the next word and
+// it closes the block or the one-line if being read.
+func (this *parser) peekKeyword() string {
+	switch word := this.peekWord(); word {
+	case "else":
+		if this.blocks > 0 || this.ifLine > 0 {
+			return word
+		}
+	case "end":
+		if this.blocks > 0 {
+			return word
+		}
+	}
+	return ""
+}
+
+// readStatement reads words and redirections until an operator.
+// The words are kept as written in the source and expanded on running.
+// The statement returned may have no words.
+func (this *parser) readStatement() (*StatementT, error) {
+	words := make([]string, 0)
+	var buffer bytes.Buffer
+	isNextRedirect := false
+	redirect := make([]*Redirecter, 0, 3)
+	operators := make([]string, 0, 3) // the texts of redirect for the messages
+
+	this.skipSpaces()
+	start := this.offset()
+	end := start
+	lexer := this.lexerAt(false)
 
 	term_word := func() {
 		if isNextRedirect && len(redirect) > 0 {
-			redirect[len(redirect)-1].SetPath(string2word(buffer.String(), true))
+			redirect[len(redirect)-1].SetPath(buffer.String())
 		} else {
 			if buffer.Len() > 0 {
-				rawArgs = append(rawArgs, string2word(buffer.String(), false))
-				args = append(args, string2word(buffer.String(), true))
+				words = append(words, buffer.String())
 			}
 		}
 		buffer.Reset()
 	}
 
-	reader := strings.NewReader(text)
-	for reader.Len() > 0 {
-		ch, chSize, chErr := reader.ReadRune()
-		if chSize <= 0 {
+	next := len(this.text)
+loop:
+	for {
+		token, err := lexer.Next()
+		if err == io.EOF {
 			break
 		}
-		if chErr != nil {
-			return nil, chErr
+		if err != nil {
+			return nil, err
 		}
-		if quoteNow == NOTQUOTED {
-			if yenCount%2 == 0 && (ch == '"' || ch == '\'') {
-				quoteNow = ch
-			}
-		} else if yenCount%2 == 0 && ch == quoteNow {
-			quoteNow = NOTQUOTED
+		if token.Pos != end && buffer.Len() > 0 {
+			term_word()
+			isNextRedirect = false
 		}
-		if quoteNow != NOTQUOTED {
-			buffer.WriteRune(ch)
-		} else if ch == ' ' {
-			if buffer.Len() > 0 {
-				term_word()
-				isNextRedirect = false
+		switch token.Type {
+		case TOKEN_OPERATOR:
+			next = token.Pos
+			break loop
+		case TOKEN_COMMENT:
+			next = token.End
+			break loop
+		case TOKEN_REDIRECT:
+			term_word()
+			red, err := newTokenRedirecter(token.Text)
+			if err != nil {
+				return nil, this.errorAt(token.Pos, "a file descriptor or `-` after `&`", err.Error())
 			}
-		} else if lastchar == ' ' && ch == '#' {
-			break
-		} else if lastchar == ' ' && ch == ';' {
-			term_line(";")
-		} else if ch == '|' {
-			if lastchar == '|' {
-				if len(statements) <= 0 {
-					return nil, errors.New(EMPTY_COMMAND_FOUND)
-				}
-				statements[len(statements)-1].Term = "||"
-			} else {
-				term_line("|")
+			redirect = append(redirect, red)
+			operators = append(operators, token.Text)
+			isNextRedirect = red.dupFrom < 0 && !red.isClose
+		case TOKEN_VARIABLE:
+			if err := checkSubst(this.text, token.Pos, token.Text); err != nil {
+				return nil, err
 			}
-		} else if ch == '&' {
-			switch lastchar {
-			case '&':
-				if len(statements) <= 0 {
-					return nil, errors.New(EMPTY_COMMAND_FOUND)
-				}
-				statements[len(statements)-1].Term = "&&"
+			this.seek(token.End)
+			if (token.Text[0] == '<' || token.Text[0] == '>') && !this.atWordEnd() {
+				return nil, this.errorAt(token.End, "the end of the word",
+					fmt.Sprintf("%c(...): %s", token.Text[0], SYNTAX_ERROR))
+			}
+			buffer.WriteString(token.Text)
+		case TOKEN_WORD:
+			this.seek(token.End)
+			if token.Text == "}" && this.braces > 0 && len(words) <= 0 && len(redirect) <= 0 && buffer.Len() <= 0 && this.atWordEnd() {
+				next = token.Pos
+				break loop
+			}
+			buffer.WriteString(token.Text)
+		default:
+			buffer.WriteString(token.Text)
+		}
+		end = token.End
+	}
+	this.seek(next)
+	if buffer.Len() > 0 {
+		if isNextRedirect && len(redirect) > 0 {
+			redirect[len(redirect)-1].SetPath(buffer.String())
+		} else {
+			words = append(words, buffer.String())
+		}
+	}
+	for i, red := range redirect {
+		if red.hereDoc {
+			if red.path == "" {
+				return nil, this.errorAt(next, "the delimiter", "<<: the delimiter is not found")
+			}
+			this.hereDocs = append(this.hereDocs, red)
+		} else if red.path == "" && red.dupFrom < 0 && !red.isClose {
+			return nil, this.errorAt(next, "a file name",
+				fmt.Sprintf("%s: the file name is not found", operators[i]))
+		}
+	}
+	return &StatementT{
+		span:     span{pos: start, end: end},
+		Words:    words,
+		Redirect: redirect,
+	}, nil
+}
+
+// checkSubst parses the command of subst, which is `$(...)`, `<(...)`
+// or `>(...)` at pos of text, to find the syntax errors before running.
+func checkSubst(text string, pos int, subst string) error {
+	if isArith(subst) || !strings.HasSuffix(subst, ")") {
+		return nil
+	}
+	if !strings.HasPrefix(subst, "$(") && !strings.HasPrefix(subst, "<(") && !strings.HasPrefix(subst, ">(") {
+		return nil
+	}
+	_, err := Parse(subst[2 : len(subst)-1])
+	switch e := err.(type) {
+	case *ParseError:
+		return newParseError(text, pos+2+e.Pos, e.Expected, e.Reason)
+	case *IncompleteError:
+		// the closer can not be given after `)`.
+		expected := "a command"
+		if e.After == "" {
+			expected = "`" + e.Closer + "`"
+		}
+		return newParseError(text, pos+len(subst)-1, expected, e.Error())
+	}
+	return err
+}
+
+// readHereDocs reads the contents of the here-documents from the
+// next line. The ones which end before the delimiter remain in this.hereDocs.
+func (this *parser) readHereDocs() {
+	start := this.offset()
+	for len(this.hereDocs) > 0 {
+		red := this.hereDocs[0]
+		red.expand = !strings.ContainsAny(red.path, "\"'")
+		text, end, found := readHereDoc(this.text, this.offset(), red.path)
+		this.seek(end)
+		if !found {
+			return
+		}
+		red.text = text
+		this.hereDocs = this.hereDocs[1:]
+	}
+	if this.hereDocEnd == nil {
+		this.hereDocEnd = map[int]int{}
+	}
+	this.hereDocEnd[start] = this.offset()
+}
+
+// readOperator reads one of ";", "\n", "&", "|", "|&", "&&", "||",
+// and the closers ")", "}", "else" and "end".
+// It returns "" at the end of the text.
+func (this *parser) readOperator() string {
+	this.skipSpaces()
+	this.opPos = this.offset()
+	if keyword := this.peekKeyword(); keyword != "" {
+		this.readWord()
+		return keyword
+	}
+	ch, _, err := this.reader.ReadRune()
+	if err != nil {
+		return ""
+	}
+	switch ch {
+	case ';':
+		return ";"
+	case '\n':
+		if end, ok := this.hereDocEnd[this.offset()]; ok {
+			// the here-documents already read
+			this.seek(end)
+		} else if len(this.hereDocs) > 0 {
+			this.readHereDocs()
+		}
+		return "\n"
+	case '|':
+		ch2, _, err := this.reader.ReadRune()
+		if err == nil {
+			switch ch2 {
 			case '|':
-				if len(statements) <= 0 {
-					return nil, errors.New(EMPTY_COMMAND_FOUND)
-				}
-				statements[len(statements)-1].Term = "|&"
-			case '>':
-				// >&[n]
-				ch2, ch2siz, ch2err := reader.ReadRune()
-				if ch2err != nil {
-					return nil, ch2err
-				}
-				if ch2siz <= 0 {
-					return nil, errors.New("Too Near EOF for >&")
-				}
-				red := redirect[len(redirect)-1]
-				switch ch2 {
-				case '1':
-					red.DupFrom(1)
-				case '2':
-					red.DupFrom(2)
-				default:
-					return nil, errors.New("Syntax error after >&")
-				}
-				isNextRedirect = false
-			default:
-				term_line("&")
+				return "||"
+			case '&':
+				return "|&"
 			}
-		} else if ch == '>' {
-			switch lastchar {
-			case '1':
-				// 1>
-				chomp(&buffer)
-				term_word()
-				redirect = append(redirect, NewRedirecter(1))
-			case '2':
-				// 2>
-				chomp(&buffer)
-				term_word()
-				redirect = append(redirect, NewRedirecter(2))
-			case '>':
-				// >>
-				term_word()
-				if len(redirect) >= 0 {
-					redirect[len(redirect)-1].SetAppend()
-				}
-			default:
-				// >
-				term_word()
-				redirect = append(redirect, NewRedirecter(1))
+			this.reader.UnreadRune()
+		}
+		return "|"
+	case '&':
+		ch2, _, err := this.reader.ReadRune()
+		if err == nil {
+			if ch2 == '&' {
+				return "&&"
 			}
-			isNextRedirect = true
-		} else if ch == '<' {
-			term_word()
-			redirect = append(redirect, NewRedirecter(0))
-			isNextRedirect = true
+			this.reader.UnreadRune()
+		}
+		return "&"
+	case ')':
+		return ")"
+	case '}':
+		return "}"
+	}
+	this.reader.UnreadRune()
+	return ""
+}
+
+// parseGroup reads `( ... )` or `{ ... }` and the redirections after it.
+// The open bracket has already been read.
+func (this *parser) parseGroup(open rune) (Node, error) {
+	start := this.offset() - 1
+	var body *SequenceT
+	var err error
+	if open == '(' {
+		this.parens++
+		body, _, err = this.parseSequence(")")
+		this.parens--
+	} else {
+		this.braces++
+		body, _, err = this.parseSequence("}")
+		this.braces--
+	}
+	if err != nil {
+		return nil, err
+	}
+	end := this.offset()
+	var redirect []*Redirecter
+	if this.peekKeyword() == "" {
+		rest, err := this.readStatement()
+		if err != nil {
+			return nil, err
+		}
+		if len(rest.Words) > 0 {
+			return nil, this.errorAt(rest.Pos(), "an operator", SYNTAX_ERROR)
+		}
+		if len(rest.Redirect) > 0 {
+			redirect = rest.Redirect
+			end = rest.End()
+		}
+	}
+	if open == '(' {
+		return &SubshellT{
+			span:     span{pos: start, end: end},
+			Body:     body,
+			Redirect: redirect,
+		}, nil
+	}
+	return &GroupT{
+		span:     span{pos: start, end: end},
+		Body:     body,
+		Redirect: redirect,
+	}, nil
+}
+
+var conditionOperators = map[string]struct{}{
+	"==":  struct{}{},
+	"equ": struct{}{},
+	"neq": struct{}{},
+	"lss": struct{}{},
+	"leq": struct{}{},
+	"gtr": struct{}{},
+	"geq": struct{}{},
+}
+
+// parseCondition reads `[/I] [NOT] CONDITION` of if and while.
+func (this *parser) parseCondition() (*ConditionT, error) {
+	this.skipSpaces()
+	cond := &ConditionT{span: span{pos: this.offset()}}
+	for {
+		word := this.peekWord()
+		if word == "/i" {
+			cond.IgnoreCase = true
+		} else if word == "not" && !cond.Not {
+			cond.Not = true
 		} else {
-			buffer.WriteRune(ch)
+			break
 		}
-		if ch == '\\' {
-			yenCount++
+		this.readWord()
+	}
+	this.skipSpaces()
+	firstPos := this.offset()
+	first := this.readWord()
+	switch lower := strings.ToLower(first); lower {
+	case "exist", "errorlevel", "defined":
+		this.skipSpaces()
+		argPos := this.offset()
+		arg := this.readWord()
+		if arg == "" {
+			return nil, this.errorAt(argPos, "an argument", fmt.Sprintf("%s: %s", lower, SYNTAX_ERROR))
+		}
+		cond.Op = lower
+		cond.Args = []string{arg}
+	case "":
+		return nil, this.errorAt(firstPos, "a condition", SYNTAX_ERROR)
+	default:
+		if _, ok := conditionOperators[this.peekWord()]; ok {
+			cond.Op = strings.ToLower(this.readWord())
+			this.skipSpaces()
+			argPos := this.offset()
+			cond.Args = []string{first, this.readWord()}
+			if cond.Args[1] == "" {
+				return nil, this.errorAt(argPos, "an argument", fmt.Sprintf("%s: %s", cond.Op, SYNTAX_ERROR))
+			}
+		} else if pos := strings.Index(first, "=="); pos > 0 {
+			// A==B
+			cond.Op = "=="
+			cond.Args = []string{first[:pos], first[pos+2:]}
 		} else {
-			yenCount = 0
+			return nil, this.errorAt(firstPos, "a condition", fmt.Sprintf("%s: unknown condition", first))
 		}
-		lastchar = ch
 	}
-	term_line(" ")
-	return statements, nil
+	cond.end = this.offset()
+	return cond, nil
 }
 
-// Make arrays whose elements are pipelines
-func parse2(statements []*StatementT) [][]*StatementT {
-	result := make([][]*StatementT, 1)
-	for _, statement1 := range statements {
-		result[len(result)-1] = append(result[len(result)-1], statement1)
-		switch statement1.Term {
-		case "|", "|&":
+// parseLine reads the rest of the line as the body of a one-line
+// if/for/while. The operator which ends the body is left for the caller.
+// `( ... )` as the whole body runs on the current shell as CMD.EXE.
+func (this *parser) parseLine() (*SequenceT, error) {
+	body, _, err := this.parseSequence("", "\n", ")", "}", "else", "end")
+	if err != nil {
+		return nil, err
+	}
+	this.seek(this.opPos)
+	if len(body.Nodes) == 1 {
+		if subshell, ok := body.Nodes[0].(*SubshellT); ok {
+			body.Nodes[0] = &GroupT{
+				span:     subshell.span,
+				Body:     subshell.Body,
+				Redirect: subshell.Redirect,
+			}
+		}
+	}
+	return body, nil
+}
 
-		default:
-			result = append(result, make([]*StatementT, 0))
+// parseBody reads the body of if/for/while.
+// When the header ends with the line, the body continues until one of
+// closers. Otherwise the rest of the line is the body and closer is "".
+func (this *parser) parseBody(closers ...string) (body *SequenceT, closer string, err error) {
+	if this.atLineEnd() {
+		this.blocks++
+		body, closer, err = this.parseSequence(closers...)
+		this.blocks--
+		return
+	}
+	body, err = this.parseLine()
+	return
+}
+
+// parseIf reads the rest of `if` after the keyword.
+func (this *parser) parseIf(start int) (Node, error) {
+	cond, err := this.parseCondition()
+	if err != nil {
+		return nil, err
+	}
+	if this.peekWord() == "then" {
+		this.readWord()
+	}
+	node := &IfT{Cond: cond}
+	isBlock := this.atLineEnd()
+	if !isBlock {
+		this.ifLine++
+	}
+	var closer string
+	node.Then, closer, err = this.parseBody("else", "end")
+	if !isBlock {
+		if err == nil && this.peekKeyword() == "else" {
+			this.readWord()
+			closer = "else"
 		}
+		this.ifLine--
 	}
-	if len(result[len(result)-1]) <= 0 {
-		result = result[0 : len(result)-1]
+	if err != nil {
+		return nil, err
 	}
-	return result
+	if closer == "else" {
+		if this.peekWord() == "if" {
+			// `else if` is closed with the inner if.
+			this.skipSpaces()
+			pos := this.offset()
+			this.readWord()
+			elseIf, err := this.parseIf(pos)
+			if err != nil {
+				return nil, err
+			}
+			node.Else = &SequenceT{
+				span:  span{pos: elseIf.Pos(), end: elseIf.End()},
+				Nodes: []Node{elseIf},
+			}
+		} else if isBlock {
+			this.blocks++
+			node.Else, _, err = this.parseSequence("end")
+			this.blocks--
+		} else {
+			node.Else, err = this.parseLine()
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	node.span = span{pos: start, end: this.offset()}
+	if !isBlock {
+		if node.Else != nil {
+			node.end = node.Else.End()
+		} else {
+			node.end = node.Then.End()
+		}
+	}
+	return node, nil
+}
+
+// readForSet reads `(ITEM1 ITEM2 ...)`. Items are separated by spaces or commas.
+func (this *parser) readForSet() ([]string, error) {
+	this.skipSpaces()
+	if !this.nextIs('(') {
+		return nil, this.errorAt(this.offset(), "`(`", "for: `(` is not found")
+	}
+	this.reader.ReadRune()
+	lexer := this.lexerAt(false)
+	lexer.parens = 1
+	items := []string{}
+	var buffer bytes.Buffer
+	end := this.offset()
+	flush := func() {
+		if buffer.Len() > 0 {
+			items = append(items, buffer.String())
+			buffer.Reset()
+		}
+	}
+	for {
+		token, err := lexer.Next()
+		if err == io.EOF {
+			return nil, this.errorAt(len(this.text), "`)`", "for: `)` is not found")
+		}
+		if token.Type == TOKEN_OPERATOR && token.Text == "\n" {
+			return nil, this.errorAt(token.Pos, "`)`", "for: `)` is not found")
+		}
+		if err != nil {
+			return nil, err
+		}
+		if token.Pos != end {
+			flush()
+		}
+		end = token.End
+		if token.Type == TOKEN_OPERATOR && token.Text == ")" && lexer.parens <= 0 {
+			flush()
+			this.seek(token.End)
+			return items, nil
+		}
+		if token.Type == TOKEN_WORD {
+			for i, field := range strings.Split(token.Text, ",") {
+				if i > 0 {
+					flush()
+				}
+				buffer.WriteString(field)
+			}
+			continue
+		}
+		buffer.WriteString(token.Text)
+	}
+}
+
+// parseFor reads the rest of `for [/L] %X in (SET) do ...` after the keyword.
+func (this *parser) parseFor(start int) (Node, error) {
+	node := &ForT{}
+	word := this.readWord()
+	if strings.EqualFold(word, "/l") {
+		node.Range = true
+		word = this.readWord()
+	}
+	if len(word) < 2 || word[0] != '%' || strings.TrimLeft(word, "%") == "" {
+		return nil, this.errorAt(this.offset()-len(word), "the variable `%X`", fmt.Sprintf("for: %s: invalid variable name", word))
+	}
+	node.Var = strings.TrimLeft(word, "%")
+	if this.skipSpaces(); this.peekWord() != "in" {
+		return nil, this.errorAt(this.offset(), "`in`", "for: `in` is not found")
+	}
+	this.readWord()
+	var err error
+	node.Items, err = this.readForSet()
+	if err != nil {
+		return nil, err
+	}
+	if this.skipSpaces(); this.peekWord() != "do" {
+		return nil, this.errorAt(this.offset(), "`do`", "for: `do` is not found")
+	}
+	this.readWord()
+	isBlock := this.atLineEnd()
+	node.Body, _, err = this.parseBody("end")
+	if err != nil {
+		return nil, err
+	}
+	node.span = span{pos: start, end: this.offset()}
+	if !isBlock {
+		node.end = node.Body.End()
+	}
+	return node, nil
+}
+
+// parseWhile reads the rest of `while [NOT] CONDITION [do] ...` after the keyword.
+func (this *parser) parseWhile(start int) (Node, error) {
+	cond, err := this.parseCondition()
+	if err != nil {
+		return nil, err
+	}
+	if this.peekWord() == "do" {
+		this.readWord()
+	}
+	node := &WhileT{Cond: cond}
+	isBlock := this.atLineEnd()
+	node.Body, _, err = this.parseBody("end")
+	if err != nil {
+		return nil, err
+	}
+	node.span = span{pos: start, end: this.offset()}
+	if !isBlock {
+		node.end = node.Body.End()
+	}
+	return node, nil
 }
 
-func Parse(text string) ([][]*StatementT, error) {
-	result1, err := parse1(text)
+// parseFunction reads the rest of `function NAME { BODY }` after the keyword.
+func (this *parser) parseFunction(start int) (Node, error) {
+	this.skipSpaces()
+	namePos := this.offset()
+	name := this.readWord()
+	if name == "" || strings.ContainsAny(name, "%\"'{}") {
+		return nil, this.errorAt(namePos, "a function name", fmt.Sprintf("function: %s: invalid function name", name))
+	}
+	this.skipSpaces()
+	bracePos := this.offset()
+	if ch, _, err := this.reader.ReadRune(); err != nil || ch != '{' || !this.atWordEnd() {
+		return nil, this.errorAt(bracePos, "`{`", fmt.Sprintf("function %s: `{` is not found", name))
+	}
+	this.braces++
+	body, _, err := this.parseSequence("}")
+	this.braces--
 	if err != nil {
 		return nil, err
 	}
-	result2 := parse2(result1)
-	return result2, nil
+	return &FunctionT{
+		span: span{pos: start, end: this.offset()},
+		Name: name,
+		Body: body,
+	}, nil
+}
+
+// parseCommand returns a statement, a group or a control statement.
+// It returns nil when empty.
+func (this *parser) parseCommand() (Node, error) {
+	this.skipSpaces()
+	start := this.offset()
+	if this.peekKeyword() != "" {
+		return nil, nil
+	}
+	switch this.peekWord() {
+	case "if":
+		this.readWord()
+		return this.parseIf(start)
+	case "for":
+		this.readWord()
+		return this.parseFor(start)
+	case "while":
+		this.readWord()
+		return this.parseWhile(start)
+	case "function":
+		this.readWord()
+		return this.parseFunction(start)
+	}
+	if ch, _, err := this.reader.ReadRune(); err == nil {
+		if ch == '(' {
+			return this.parseGroup(ch)
+		}
+		if ch == '{' && this.reader.Len() > 0 && this.atWordEnd() {
+			return this.parseGroup(ch)
+		}
+		this.seek(start)
+	}
+	statement, err := this.readStatement()
+	if err != nil || len(statement.Words) <= 0 {
+		return nil, err
+	}
+	return statement, nil
+}
+
+// parseTime reads `time PIPELINE`. It returns nil when `time` is not
+// the keyword but CMD.EXE's command (`time` alone and `time /T`).
+func (this *parser) parseTime() (Node, string, error) {
+	this.skipSpaces()
+	start := this.offset()
+	if this.peekWord() != "time" {
+		return nil, "", nil
+	}
+	this.readWord()
+	this.skipSpaces()
+	if this.atWordEnd() || this.nextIs('#') || this.nextIs('/') {
+		this.seek(start)
+		return nil, "", nil
+	}
+	pipeline, op, err := this.parsePipeline()
+	if err != nil {
+		return nil, "", err
+	}
+	if pipeline == nil {
+		return nil, "", this.errorAt(this.opPos, "a command", EMPTY_COMMAND_FOUND)
+	}
+	return &TimeT{
+		span: span{pos: start, end: pipeline.End()},
+		Node: pipeline,
+	}, op, nil
+}
+
+// parsePipeline returns the pipeline (nil if empty) and the operator after it.
+func (this *parser) parsePipeline() (Node, string, error) {
+	if timed, op, err := this.parseTime(); timed != nil || err != nil {
+		return timed, op, err
+	}
+	first, err := this.parseCommand()
+	if err != nil {
+		return nil, "", err
+	}
+	op := this.readOperator()
+	if op != "|" && op != "|&" {
+		return first, op, nil
+	}
+	if first == nil {
+		return nil, "", this.errorAt(this.opPos, "a command", EMPTY_COMMAND_FOUND)
+	}
+	pipeline := &PipelineT{
+		span:   span{pos: first.Pos(), end: first.End()},
+		Stages: []Node{first},
+	}
+	for op == "|" || op == "|&" {
+		if !this.skipLineEnds() {
+			return nil, "", &IncompleteError{After: op}
+		}
+		next, err := this.parseCommand()
+		if err != nil {
+			return nil, "", err
+		}
+		if next == nil {
+			this.skipSpaces()
+			return nil, "", this.errorAt(this.offset(), "a command", SYNTAX_ERROR)
+		}
+		pipeline.Pipes = append(pipeline.Pipes, op)
+		pipeline.Stages = append(pipeline.Stages, next)
+		pipeline.end = next.End()
+		op = this.readOperator()
+	}
+	return pipeline, op, nil
+}
+
+// parseAndOr returns the and-or list (nil if empty) and the operator after it.
+func (this *parser) parseAndOr() (Node, string, error) {
+	left, op, err := this.parsePipeline()
+	if err != nil {
+		return nil, "", err
+	}
+	for op == "&&" || op == "||" {
+		if left == nil {
+			return nil, "", this.errorAt(this.opPos, "a command", EMPTY_COMMAND_FOUND)
+		}
+		if !this.skipLineEnds() {
+			return nil, "", &IncompleteError{After: op}
+		}
+		right, nextOp, err := this.parsePipeline()
+		if err != nil {
+			return nil, "", err
+		}
+		if right == nil {
+			return nil, "", this.errorAt(this.opPos, "a command", SYNTAX_ERROR)
+		}
+		left = &AndOrT{
+			span:  span{pos: left.Pos(), end: right.End()},
+			Left:  left,
+			Op:    op,
+			Right: right,
+		}
+		op = nextOp
+	}
+	return left, op, nil
+}
+
+// parseSequence reads nodes until one of closers and returns the closer found.
+// "" in closers means the end of the text.
+func (this *parser) parseSequence(closers ...string) (*SequenceT, string, error) {
+	sequence := &SequenceT{
+		span:  span{pos: this.offset(), end: this.offset()},
+		Nodes: []Node{},
+	}
+	for {
+		node, op, err := this.parseAndOr()
+		if err != nil {
+			return nil, "", err
+		}
+		if node != nil {
+			if op == "&" {
+				node = &BackgroundT{
+					span: span{pos: node.Pos(), end: this.offset()},
+					Node: node,
+					Text: strings.TrimSpace(this.text[node.Pos():node.End()]),
+				}
+			}
+			if len(sequence.Nodes) <= 0 {
+				sequence.pos = node.Pos()
+			}
+			sequence.Nodes = append(sequence.Nodes, node)
+			sequence.end = node.End()
+		} else if op == "&" {
+			return nil, "", this.errorAt(this.opPos, "a command", EMPTY_COMMAND_FOUND)
+		}
+		for _, closer := range closers {
+			if op == closer {
+				return sequence, op, nil
+			}
+		}
+		switch op {
+		case ";", "\n", "&":
+		case "":
+			return nil, "", &IncompleteError{Closer: closers[len(closers)-1]}
+		default:
+			expected := make([]string, len(closers))
+			for i, closer := range closers {
+				expected[i] = describeToken(closer)
+			}
+			return nil, "", this.errorAt(this.opPos, strings.Join(expected, " or "), SYNTAX_ERROR)
+		}
+	}
+}
+
+// IncompleteError is the error that the text ends before the closer
+// of a group, a block or a quotation, or after an operator which needs
+// the next command. Reading the next line may complete it.
+type IncompleteError struct {
+	Closer string
+	After  string // the operator or `^` at the end of the text
+}
+
+func (this *IncompleteError) Error() string {
+	if this.After != "" {
+		return fmt.Sprintf("no command after `%s`", this.After)
+	}
+	return fmt.Sprintf("`%s` is not found", this.Closer)
+}
+
+// ParseError is the syntax error of the command line with its position.
+type ParseError struct {
+	Text     string // the text parsed
+	Pos      int    // the byte offset of the error in Text
+	Line     int    // the line number from 1
+	Column   int    // the column in characters from 1
+	Expected string // what should be at Pos ("" when unknown)
+	Found    string // what is at Pos
+	Reason   string
+}
+
+func newParseError(text string, pos int, expected, reason string) *ParseError {
+	before := text[:pos]
+	lineTop := strings.LastIndexByte(before, '\n') + 1
+	lexer := &Lexer{text: text, pos: pos, lastchar: ' ', commandStart: true, parens: 1}
+	found := ""
+	if token, err := lexer.Next(); err != io.EOF {
+		found = token.Text
+	}
+	return &ParseError{
+		Text:     text,
+		Pos:      pos,
+		Line:     strings.Count(before, "\n") + 1,
+		Column:   utf8.RuneCountInString(before[lineTop:]) + 1,
+		Expected: expected,
+		Found:    describeToken(found),
+		Reason:   reason,
+	}
+}
+
+// errorAt returns the ParseError at pos of the text being parsed.
+func (this *parser) errorAt(pos int, expected, reason string) error {
+	return newParseError(this.text, pos, expected, reason)
+}
+
+// describeToken returns the name of the token for the messages.
+func describeToken(text string) string {
+	switch text {
+	case "":
+		return "the end of the text"
+	case "\n":
+		return "the newline"
+	}
+	return "`" + text + "`"
+}
+
+func (this *ParseError) Error() string {
+	message := this.Reason
+	if this.Expected != "" {
+		message = fmt.Sprintf("%s: %s is expected, but %s is found", message, this.Expected, this.Found)
+	}
+	return fmt.Sprintf("%s (at line %d, column %d)", message, this.Line, this.Column)
+}
+
+// Caret returns the line of the error and the caret under the position.
+func (this *ParseError) Caret() string {
+	lineTop := strings.LastIndexByte(this.Text[:this.Pos], '\n') + 1
+	line := this.Text[lineTop:]
+	if end := strings.IndexByte(line, '\n'); end >= 0 {
+		line = line[:end]
+	}
+	var caret bytes.Buffer
+	for _, ch := range this.Text[lineTop:this.Pos] {
+		if ch == '\t' {
+			caret.WriteRune(ch)
+		} else {
+			caret.WriteString(strings.Repeat(" ", runewidth.RuneWidth(ch)))
+		}
+	}
+	caret.WriteRune('^')
+	return strings.TrimSuffix(line, "\r") + "\n" + caret.String()
+}
+
+// IsIncomplete returns true when err is an IncompleteError.
+func IsIncomplete(err error) bool {
+	_, ok := err.(*IncompleteError)
+	return ok
+}
+
+// Parse makes the syntax tree of text.
+func Parse(text string) (*SequenceT, error) {
+	if endsWithCaret(text) {
+		return nil, &IncompleteError{After: "^"}
+	}
+	p := &parser{text: text, reader: strings.NewReader(text)}
+	sequence, _, err := p.parseSequence("")
+	if err == nil && len(p.hereDocs) > 0 {
+		return nil, &IncompleteError{Closer: string2word(strings.TrimPrefix(p.hereDocs[0].path, "-"), true)}
+	}
+	return sequence, err
 }
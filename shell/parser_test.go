@@ -2,28 +2,390 @@ package shell
 
 import (
 	"fmt"
+	"strings"
 	"testing"
 )
 
 func TestParser(t *testing.T) {
 	text := "gawk \"{ print(\"\"ahaha ihihi ufufu\"\") }\" <\"ddd\"\"ddd\"|ahaha \"ihihi |ufufu\" ; ohoho gegee&&hogehogeo >ihihi"
 	fmt.Println(text)
-	result, _ := Parse(text)
-	for i, st := range result {
-		fmt.Printf("pipeline-%d:\n", i)
-		for _, stsub := range st {
-			for _, word := range stsub.Args {
-				fmt.Printf("  [%s]", word)
-			}
-			fmt.Println()
+	result, err := Parse(text)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(result.Nodes) != 2 {
+		t.Fatalf("len(result.Nodes)==%d", len(result.Nodes))
+	}
+	pipeline, ok := result.Nodes[0].(*PipelineT)
+	if !ok || len(pipeline.Stages) != 2 {
+		t.Fatal("pipeline-0: not a pipeline with 2 stages")
+	}
+	for i, stage := range pipeline.Stages {
+		fmt.Printf("stage-%d:", i)
+		for _, word := range stage.(*StatementT).Words {
+			fmt.Printf("  [%s]", word)
 		}
+		fmt.Println()
+	}
+	if st := pipeline.Stages[1].(*StatementT); st.Words[1] != `"ihihi |ufufu"` {
+		t.Errorf("stage-1: [%s]", st.Words[1])
 	}
+	andor, ok := result.Nodes[1].(*AndOrT)
+	if !ok || andor.Op != "&&" {
+		t.Fatal("node-1: not &&")
+	}
+	if text[andor.Pos():andor.End()] != "ohoho gegee&&hogehogeo >ihihi" {
+		t.Errorf("node-1: position %d-%d", andor.Pos(), andor.End())
+	}
+
 	result, _ = Parse("")
 	fmt.Println("<empty-line>")
-	for i, st := range result {
-		fmt.Printf("pipeline-%d:\n", i)
-		for _, stsub := range st {
-			fmt.Printf("  %s\n", stsub.String())
+	if len(result.Nodes) != 0 {
+		t.Errorf("empty-line: len(result.Nodes)==%d", len(result.Nodes))
+	}
+}
+
+func TestParseAndOr(t *testing.T) {
+	// a || b && c => (a || b) && c
+	result, err := Parse("a || b && c & d")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(result.Nodes) != 2 {
+		t.Fatalf("len(result.Nodes)==%d", len(result.Nodes))
+	}
+	bg, ok := result.Nodes[0].(*BackgroundT)
+	if !ok {
+		t.Fatal("node-0: not background")
+	}
+	and, ok := bg.Node.(*AndOrT)
+	if !ok || and.Op != "&&" {
+		t.Fatal("node-0: not &&")
+	}
+	if or, ok := and.Left.(*AndOrT); !ok || or.Op != "||" {
+		t.Fatal("node-0: left of && is not ||")
+	}
+
+	for _, text := range []string{"&& a", "a |", "a | | b", "a ||"} {
+		if _, err := Parse(text); err == nil {
+			t.Errorf("`%s`: no error", text)
+		}
+	}
+}
+
+func TestParseGroup(t *testing.T) {
+	result, err := Parse("(cd build && make) > log.txt ; { echo a ; echo b ; } | more")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(result.Nodes) != 2 {
+		t.Fatalf("len(result.Nodes)==%d", len(result.Nodes))
+	}
+	subshell, ok := result.Nodes[0].(*SubshellT)
+	if !ok {
+		t.Fatal("node-0: not a subshell")
+	}
+	if len(subshell.Redirect) != 1 || subshell.Redirect[0].path != "log.txt" {
+		t.Error("node-0: redirect failed")
+	}
+	if _, ok := subshell.Body.Nodes[0].(*AndOrT); !ok {
+		t.Error("node-0: body is not &&")
+	}
+	pipeline, ok := result.Nodes[1].(*PipelineT)
+	if !ok {
+		t.Fatal("node-1: not a pipeline")
+	}
+	if group, ok := pipeline.Stages[0].(*GroupT); !ok || len(group.Body.Nodes) != 2 {
+		t.Error("node-1: stage-0 is not a group with 2 nodes")
+	}
+
+	for _, text := range []string{"(a", "{ a ;", "(a) b"} {
+		if _, err := Parse(text); err == nil {
+			t.Errorf("`%s`: no error", text)
+		}
+	}
+}
+
+func TestParseControl(t *testing.T) {
+	text := "if exist foo then\n  echo a\nelse if /I x==X\n  echo b\nelse\n  echo c\nend\nfor %i in (*.go, *.txt) do echo %i\nwhile not errorlevel 1\n  false\nend"
+	result, err := Parse(text)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(result.Nodes) != 3 {
+		t.Fatalf("len(result.Nodes)==%d", len(result.Nodes))
+	}
+	if1, ok := result.Nodes[0].(*IfT)
+	if !ok || if1.Cond.Op != "exist" || len(if1.Then.Nodes) != 1 {
+		t.Fatal("node-0: not if-exist")
+	}
+	if2, ok := if1.Else.Nodes[0].(*IfT)
+	if !ok || !if2.Cond.IgnoreCase || if2.Cond.Op != "==" || if2.Else == nil {
+		t.Fatal("node-0: not else-if")
+	}
+	if text[if1.Pos():if1.End()] != text[:strings.Index(text, "end")+3] {
+		t.Errorf("node-0: position %d-%d", if1.Pos(), if1.End())
+	}
+	for1, ok := result.Nodes[1].(*ForT)
+	if !ok || for1.Var != "i" || strings.Join(for1.Items, " ") != "*.go *.txt" {
+		t.Fatal("node-1: not for")
+	}
+	while1, ok := result.Nodes[2].(*WhileT)
+	if !ok || !while1.Cond.Not || len(while1.Body.Nodes) != 1 {
+		t.Fatal("node-2: not while")
+	}
+
+	// one-line forms compatible with CMD.EXE
+	result, err = Parse(`if "%A%"=="1" (echo a) else (echo b) ; echo c`)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(result.Nodes) != 1 {
+		t.Fatalf("one-line if: len(result.Nodes)==%d", len(result.Nodes))
+	}
+	if if3, ok := result.Nodes[0].(*IfT); !ok || if3.Else == nil || len(if3.Else.Nodes) != 2 {
+		t.Error("one-line if: else-part should have 2 nodes")
+	}
+
+	for _, text := range []string{"if a==b\necho a", "for %i in (a b) echo %i", "while\nend", "for %% in (a) do echo"} {
+		if _, err := Parse(text); err == nil {
+			t.Errorf("`%s`: no error", text)
+		}
+	}
+	if _, err := Parse("for %i in (a b) do\necho %i"); !IsIncomplete(err) {
+		t.Errorf("for-block without end: %v", err)
+	}
+}
+
+func TestParseFunction(t *testing.T) {
+	text := "function greet {\n  echo hello $1\n  return 3\n}"
+	result, err := Parse(text)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	function, ok := result.Nodes[0].(*FunctionT)
+	if !ok || function.Name != "greet" || len(function.Body.Nodes) != 2 {
+		t.Fatal("node-0: not a function with 2 nodes")
+	}
+	if function.End() != len(text) {
+		t.Errorf("node-0: position %d-%d", function.Pos(), function.End())
+	}
+	if _, err := Parse("function greet {"); !IsIncomplete(err) {
+		t.Errorf("function without `}`: %v", err)
+	}
+	if _, err := Parse("function greet echo"); err == nil {
+		t.Error("function without `{`: no error")
+	}
+}
+
+func TestParseHereDocument(t *testing.T) {
+	text := "cat <<EOF ; cat <<-'END' <<<here\nline1 %PATH%\nEOF\n\tline2\nEND\necho done"
+	result, err := Parse(text)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(result.Nodes) != 3 {
+		t.Fatalf("len(result.Nodes)==%d", len(result.Nodes))
+	}
+	red1 := result.Nodes[0].(*StatementT).Redirect[0]
+	if !red1.hereDoc || red1.text != "line1 %PATH%\n" || !red1.expand {
+		t.Errorf("node-0: [%s]", red1.text)
+	}
+	reds := result.Nodes[1].(*StatementT).Redirect
+	if !reds[0].hereDoc || reds[0].text != "line2\n" || reds[0].expand {
+		t.Errorf("node-1: [%s]", reds[0].text)
+	}
+	if !reds[1].hereString || reds[1].path != "here" {
+		t.Errorf("node-1: here-string [%s]", reds[1].path)
+	}
+	if st := result.Nodes[2].(*StatementT); st.Words[0] != "echo" {
+		t.Errorf("node-2: %s", st.Words[0])
+	}
+
+	for _, text := range []string{"cat <<EOF", "cat <<EOF\nline1"} {
+		if _, err := Parse(text); !IsIncomplete(err) {
+			t.Errorf("`%s`: %v", text, err)
+		}
+	}
+}
+
+func TestParseContinuation(t *testing.T) {
+	for _, text := range []string{`echo "a`, "echo 'a", "dir |", "a &&", "a ||\n# comment\n", "echo a ^", "echo $(echo \"a)"} {
+		if _, err := Parse(text); !IsIncomplete(err) {
+			t.Errorf("`%s`: %v", text, err)
+		}
+	}
+	for _, text := range []string{"echo a ^^", `echo "a ^"`, "echo ^a"} {
+		if _, err := Parse(text); err != nil {
+			t.Errorf("`%s`: %v", text, err)
+		}
+	}
+	result, err := Parse("dir |\n more && \n\n echo \"a\nb\"")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	andor, ok := result.Nodes[0].(*AndOrT)
+	if len(result.Nodes) != 1 || !ok {
+		t.Fatalf("not one && list: %d nodes", len(result.Nodes))
+	}
+	if pipeline, ok := andor.Left.(*PipelineT); !ok || len(pipeline.Stages) != 2 {
+		t.Error("left: not a pipeline with 2 stages")
+	}
+	if st, ok := andor.Right.(*StatementT); !ok || st.Words[1] != "\"a\nb\"" {
+		t.Error("right: not `echo \"a\nb\"`")
+	}
+}
+
+func TestParseRedirect(t *testing.T) {
+	result, err := Parse("cmd 3>a.txt 4>>b.txt 5<c.txt 2>&1 1>&- 0<&3 &>d.txt &>>e.txt")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	st := result.Nodes[0].(*StatementT)
+	if len(st.Words) != 1 {
+		t.Fatalf("words: %v", st.Words)
+	}
+	expect := []Redirecter{
+		{no: 3, path: "a.txt", dupFrom: -1},
+		{no: 4, path: "b.txt", dupFrom: -1, isAppend: true},
+		{no: 5, path: "c.txt", dupFrom: -1, isInput: true},
+		{no: 2, dupFrom: 1},
+		{no: 1, dupFrom: -1, isClose: true},
+		{no: 0, dupFrom: 3, isInput: true},
+		{no: 1, path: "d.txt", dupFrom: -1, both: true},
+		{no: 1, path: "e.txt", dupFrom: -1, both: true, isAppend: true},
+	}
+	if len(st.Redirect) != len(expect) {
+		t.Fatalf("len(st.Redirect)==%d", len(st.Redirect))
+	}
+	for i, red := range st.Redirect {
+		if *red != expect[i] {
+			t.Errorf("redirect-%d: %+v", i, *red)
+		}
+	}
+
+	for _, text := range []string{"x >", "x 2>>", "x <", "x &> ; y", "x > | y", "x <<<"} {
+		_, err := Parse(text)
+		if e, ok := err.(*ParseError); !ok || e.Expected != "a file name" {
+			t.Errorf("`%s`: %v", text, err)
+		}
+	}
+}
+
+func TestParseProcSubst(t *testing.T) {
+	result, err := Parse("diff <(sort a.txt | uniq) <(sort b.txt) | tee >(more) ; echo done")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	pipeline, ok := result.Nodes[0].(*PipelineT)
+	if !ok || len(pipeline.Stages) != 2 {
+		t.Fatal("node-0: not a pipeline with 2 stages")
+	}
+	words := pipeline.Stages[0].(*StatementT).Words
+	if strings.Join(words, ",") != "diff,<(sort a.txt | uniq),<(sort b.txt)" {
+		t.Errorf("stage-0: %v", words)
+	}
+	if words := pipeline.Stages[1].(*StatementT).Words; words[1] != ">(more)" {
+		t.Errorf("stage-1: %v", words)
+	}
+	for _, text := range []string{"cat <(sort a.txt", "cat <(sort a.txt)b", "cat <(|)"} {
+		if _, err := Parse(text); err == nil {
+			t.Errorf("`%s`: no error", text)
+		}
+	}
+}
+
+func TestParseCommandSubst(t *testing.T) {
+	result, err := Parse(`echo $(type "a b.txt" | sort)x "$(echo ")")" '$(echo' ; echo done`)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(result.Nodes) != 2 {
+		t.Fatalf("len(result.Nodes)==%d", len(result.Nodes))
+	}
+	words := result.Nodes[0].(*StatementT).Words
+	expect := []string{"echo", `$(type "a b.txt" | sort)x`, `"$(echo ")")"`, `'$(echo'`}
+	if strings.Join(words, "|") != strings.Join(expect, "|") {
+		t.Errorf("words: %v", words)
+	}
+	if _, err := Parse("echo $(echo a"); !IsIncomplete(err) {
+		t.Errorf("$( without ): %v", err)
+	}
+}
+
+func TestParseTime(t *testing.T) {
+	text := "time a | b && c ; time /t ; time"
+	result, err := Parse(text)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(result.Nodes) != 3 {
+		t.Fatalf("len(result.Nodes)==%d", len(result.Nodes))
+	}
+	andor, ok := result.Nodes[0].(*AndOrT)
+	if !ok {
+		t.Fatal("node-0: not &&")
+	}
+	timed, ok := andor.Left.(*TimeT)
+	if !ok {
+		t.Fatal("node-0: not time")
+	}
+	if pipeline, ok := timed.Node.(*PipelineT); !ok || len(pipeline.Stages) != 2 {
+		t.Error("node-0: not time with a pipeline of 2 stages")
+	}
+	if text[timed.Pos():timed.End()] != "time a | b" {
+		t.Errorf("node-0: position %d-%d", timed.Pos(), timed.End())
+	}
+	// CMD.EXE's time command
+	for i, expect := range []string{"time /t", "time"} {
+		st, ok := result.Nodes[i+1].(*StatementT)
+		if !ok || strings.Join(st.Words, " ") != expect {
+			t.Errorf("node-%d: not the statement `%s`", i+1, expect)
+		}
+	}
+}
+
+func TestParseExclusion(t *testing.T) {
+	result, err := Parse("ls !(*.go|*.txt) !x | more")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	pipeline, ok := result.Nodes[0].(*PipelineT)
+	if !ok || len(pipeline.Stages) != 2 {
+		t.Fatal("node-0: not a pipeline with 2 stages")
+	}
+	if words := pipeline.Stages[0].(*StatementT).Words; strings.Join(words, " ") != "ls !(*.go|*.txt) !x" {
+		t.Errorf("stage-0: %v", words)
+	}
+}
+
+func TestParseError(t *testing.T) {
+	for _, p := range []struct {
+		text     string
+		line     int
+		column   int
+		expected string
+		found    string
+		caret    string
+	}{
+		{"echo a | | b", 1, 10, "", "`|`", "echo a | | b\n         ^"},
+		{"echo a\nif a==b (\necho $(a |))", 3, 11, "", "`)`", "echo $(a |))\n          ^"},
+		{"ｅｃｈｏ a || ; x", 1, 11, "", "`;`", "ｅｃｈｏ a || ; x\n              ^"},
+	} {
+		_, err := Parse(p.text)
+		e, ok := err.(*ParseError)
+		if !ok {
+			t.Errorf("`%s`: %v", p.text, err)
+			continue
+		}
+		if e.Line != p.line || e.Column != p.column || e.Found != p.found {
+			t.Errorf("`%s`: line %d column %d found %s", p.text, e.Line, e.Column, e.Found)
+		}
+		if e.Text[e.Pos:] == "" || !strings.HasPrefix(e.Text[e.Pos:], strings.Trim(p.found, "`")) {
+			t.Errorf("`%s`: pos %d", p.text, e.Pos)
+		}
+		if caret := e.Caret(); caret != p.caret {
+			t.Errorf("`%s`: caret\n%s", p.text, caret)
 		}
 	}
 }
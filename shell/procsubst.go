@@ -0,0 +1,74 @@
+package shell
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"github.com/zetamatta/nyagos/dos"
+)
+
+// isProcSubst returns true when the word is `<(...)` or `>(...)`.
+func isProcSubst(word string) bool {
+	return len(word) >= 3 &&
+		(strings.HasPrefix(word, "<(") || strings.HasPrefix(word, ">(")) &&
+		strings.HasSuffix(word, ")")
+}
+
+// procSubstSeq makes the names of the pipes unique in the process.
+var procSubstSeq uint32
+
+// procSubst is the command of `<(...)` or `>(...)` running at the same
+// time as the command using the path of its named pipe.
+type procSubst struct {
+	pipe *dos.NamedPipe
+	done chan error
+}
+
+// startProcSubst starts the command of `<(...)` or `>(...)` in
+// a goroutine as a stage of a pipeline. The command of `<(...)` writes
+// the pipe and that of `>(...)` reads it.
+func (this *Cmd) startProcSubst(ctx context.Context, word string) (*procSubst, error) {
+	tree, err := Parse(word[2 : len(word)-1])
+	if err != nil {
+		return nil, err
+	}
+	cmd, err := this.Clone()
+	if err != nil {
+		return nil, err
+	}
+	cmd.IsBackGround = true
+	inbound := word[0] == '>'
+	name := fmt.Sprintf("nyagos-%d-%d", os.Getpid(), atomic.AddUint32(&procSubstSeq, 1))
+	pipe, err := dos.NewNamedPipe(name, inbound)
+	if err != nil {
+		return nil, err
+	}
+	subst := &procSubst{pipe: pipe, done: make(chan error, 1)}
+	go func() {
+		fd, err := pipe.Accept()
+		if err != nil {
+			subst.done <- err
+			return
+		}
+		if inbound {
+			cmd.Stdin = fd
+		} else {
+			cmd.Stdout = fd
+		}
+		_, err = cmd.run(ctx, tree)
+		fd.Close()
+		subst.done <- err
+	}()
+	return subst, nil
+}
+
+// Wait waits for the command to end after the command using the path
+// ends, and returns its error. When the path was not opened,
+// the command gets EOF or the broken pipe.
+func (this *procSubst) Wait() error {
+	this.pipe.Cancel()
+	return <-this.done
+}
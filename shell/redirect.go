@@ -2,14 +2,29 @@ package shell
 
 import (
 	"errors"
+	"fmt"
+	"io"
 	"os"
+	"strings"
 )
 
+// closedFile is the stream of the descriptor closed by `n>&-`.
+// The child processes get it as the closed handle.
+var closedFile *os.File
+
 type Redirecter struct {
 	path     string
 	isAppend bool
 	no       int
 	dupFrom  int
+	isInput  bool // n<
+	isClose  bool // n>&-
+	both     bool // &> (stdout and stderr)
+
+	hereDoc    bool   // <<WORD (path is WORD)
+	hereString bool   // <<<WORD (path is WORD)
+	text       string // the contents of the here-document
+	expand     bool   // true when the variables in text are replaced
 }
 
 func NewRedirecter(no int) *Redirecter {
@@ -20,6 +35,64 @@ func NewRedirecter(no int) *Redirecter {
 		dupFrom:  -1}
 }
 
+func newInputRedirecter(no int) *Redirecter {
+	red := NewRedirecter(no)
+	red.isInput = true
+	return red
+}
+
+// newTokenRedirecter makes the redirection of the token of TOKEN_REDIRECT.
+// The path follows it unless it is `>&N` or `>&-`.
+func newTokenRedirecter(text string) (*Redirecter, error) {
+	if strings.HasPrefix(text, "&") {
+		// &> and &>>
+		red := NewRedirecter(1)
+		red.both = true
+		red.isAppend = text == "&>>"
+		return red, nil
+	}
+	no := -1
+	if isDigit(text[0]) {
+		no = int(text[0] - '0')
+		text = text[1:]
+	}
+	op := text[0]
+	var red *Redirecter
+	if op == '<' {
+		red = newInputRedirecter(0)
+	} else {
+		red = NewRedirecter(1)
+	}
+	if no >= 0 {
+		red.no = no
+	}
+	switch {
+	case strings.HasPrefix(text, "<<<"):
+		red.hereString = true
+		text = text[3:]
+	case strings.HasPrefix(text, "<<"):
+		red.hereDoc = true
+		text = text[2:]
+	case strings.HasPrefix(text, ">>"):
+		red.isAppend = true
+		text = text[2:]
+	default:
+		text = text[1:]
+	}
+	if strings.HasPrefix(text, "&") {
+		// >&N , <&N and >&-
+		switch {
+		case text == "&-":
+			red.isClose = true
+		case len(text) == 2 && isDigit(text[1]):
+			red.DupFrom(int(text[1] - '0'))
+		default:
+			return nil, fmt.Errorf("Syntax error after %c&", op)
+		}
+	}
+	return red, nil
+}
+
 func (this *Redirecter) FileNo() int {
 	return this.no
 }
@@ -36,49 +109,131 @@ func (this *Redirecter) SetAppend() {
 	this.isAppend = true
 }
 
-func (this *Redirecter) open() (*os.File, error) {
-	if this.path == "" {
+func (this *Redirecter) open(path string) (*os.File, error) {
+	if path == "" {
 		return nil, errors.New("Redirecter.open(): path=\"\"")
 	}
-	if this.no == 0 {
-		return os.Open(this.path)
+	if strings.EqualFold(path, "nul") || path == "/dev/null" {
+		return os.OpenFile(os.DevNull, os.O_RDWR, 0666)
+	}
+	if this.isInput {
+		return os.Open(path)
 	} else if this.isAppend {
-		f, err := os.OpenFile(this.path, os.O_APPEND, 0666)
+		f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0666)
 		if err != nil && os.IsNotExist(err) {
-			f, err = os.Create(this.path)
+			f, err = os.Create(path)
 		}
 		return f, err
 	} else {
-		return os.Create(this.path)
+		return os.Create(path)
 	}
 }
 
-func (this *Redirecter) OpenOn(cmd *Cmd) (*os.File, error) {
-	var fd *os.File
-	var err error
+// openHere returns the reader of the here-document or the here-string.
+func (this *Redirecter) openHere(cmd *Cmd) (io.Reader, error) {
+	var text string
+	if this.hereString {
+		word, err := cmd.expandWord(this.path, true)
+		if err != nil {
+			return nil, err
+		}
+		text = word + "\n"
+	} else if this.expand {
+		text = cmd.expandText(this.text)
+	} else {
+		text = this.text
+	}
+	return strings.NewReader(text), nil
+}
 
-	switch this.dupFrom {
+// File returns the stream of the descriptor n: io.Reader for 0,
+// io.Writer for 1 and 2. nil means n is closed.
+func (this *Cmd) File(n int) interface{} {
+	var fd interface{}
+	switch n {
 	case 0:
-		fd = cmd.Stdin
+		fd = this.Stdin
 	case 1:
-		fd = cmd.Stdout
+		fd = this.Stdout
 	case 2:
-		fd = cmd.Stderr
+		fd = this.Stderr
 	default:
-		fd, err = this.open()
+		fd = this.extraFiles[n]
+	}
+	if f, ok := fd.(*os.File); ok && f == nil {
+		return nil
+	}
+	return fd
+}
+
+// SetFile replaces the stream of the descriptor n. The descriptors not
+// in 0,1,2 can be used as the source of `>&n` but are not inherited
+// by the child processes. When fd is nil or not readable (writable)
+// for 0 (1 and 2), n is closed.
+func (this *Cmd) SetFile(n int, fd interface{}) {
+	switch n {
+	case 0:
+		if r, ok := fd.(io.Reader); ok {
+			this.Stdin = r
+		} else {
+			this.Stdin = closedFile
+		}
+	case 1, 2:
+		w, ok := fd.(io.Writer)
+		if !ok {
+			w = closedFile
+		}
+		if n == 1 {
+			this.Stdout = w
+		} else {
+			this.Stderr = w
+		}
+	default:
+		// copy not to change the clone-source's one.
+		files := make(map[int]interface{}, len(this.extraFiles)+1)
+		for key, val := range this.extraFiles {
+			files[key] = val
+		}
+		if fd != nil {
+			files[n] = fd
+		} else {
+			delete(files, n)
+		}
+		this.extraFiles = files
+	}
+}
+
+// OpenOn redirects the descriptor of cmd. It returns the file opened
+// newly (nil when duplicated or closed), which the caller should close.
+func (this *Redirecter) OpenOn(cmd *Cmd) (*os.File, error) {
+	var fd interface{}
+	var opened *os.File
+	var err error
+
+	if this.isClose {
+		fd = nil
+	} else if this.dupFrom >= 0 {
+		fd = cmd.File(this.dupFrom)
+		if fd == nil && this.dupFrom > 2 {
+			return nil, fmt.Errorf("%d: Bad file descriptor", this.dupFrom)
+		}
+	} else {
+		if this.hereDoc || this.hereString {
+			fd, err = this.openHere(cmd)
+		} else {
+			var path string
+			if path, err = cmd.expandWord(this.path, true); err == nil {
+				opened, err = this.open(path)
+				fd = opened
+			}
+		}
 		if err != nil {
 			return nil, err
 		}
 	}
-	switch this.FileNo() {
-	case 0:
-		cmd.Stdin = fd
-	case 1:
-		cmd.Stdout = fd
-	case 2:
-		cmd.Stderr = fd
-	default:
-		panic("Assertion failed: Redirecter.OpenAs: this.no not in (0,1,2)")
+	cmd.SetFile(this.FileNo(), fd)
+	if this.both {
+		cmd.SetFile(2, fd)
 	}
-	return fd, nil
+	return opened, nil
 }
@@ -0,0 +1,270 @@
+package shell
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Session is the state of one interpreter: the errorlevels, the hooks,
+// the shell functions, the jobs, the options and the values which
+// the other packages keep per interpreter. A Cmd and its clones share one session, so
+// the interpreters made from different sessions do not see each other
+// in one process.
+type Session struct {
+	mutex sync.Mutex
+
+	errorLevel int
+	pipeStatus []int
+	pipeSeq    uint
+
+	hook              HookT
+	argsHook          ArgsHookT
+	onCommandNotFound func(*Cmd, error) error
+
+	functions       map[string]*FunctionT
+	functionsShared bool // functions must be copied before changed
+
+	jobs    *jobTable
+	values  map[interface{}]interface{}
+	options options
+}
+
+// Cloner is the value stored in Session which a subshell copies.
+// The values which are not Cloner are shared with the subshell.
+// Clone is called while the session is locked, so it must not call
+// the methods of the session.
+type Cloner interface {
+	Clone() interface{}
+}
+
+// DefaultSession is the session of New and the package-level functions.
+var DefaultSession = NewSession()
+
+// NewSession returns the session which has no functions, jobs and hooks.
+func NewSession() *Session {
+	return &Session{
+		hook: func(context.Context, *Cmd) (int, bool, error) {
+			return 0, false, nil
+		},
+		argsHook: func(it *Cmd, args []string) ([]string, error) {
+			return args, nil
+		},
+		onCommandNotFound: func(this *Cmd, err error) error {
+			return &CommandNotFound{this.Args[0], err}
+		},
+		functions: map[string]*FunctionT{},
+		jobs:      &jobTable{jobs: map[int]*Job{}},
+		values:    map[interface{}]interface{}{},
+		options:   defaultOptions,
+	}
+}
+
+// NewCmd returns the interpreter which runs on this session with
+// the standard I/O of the process.
+func (this *Session) NewCmd() *Cmd {
+	cmd := newCmd()
+	cmd.session = this
+	cmd.vars.session = this
+	cmd.PipeSeq[0] = this.PipeSeq()
+	return cmd
+}
+
+// fork returns the copy-on-write view of this for a subshell.
+// The functions and the values set in it are not seen from this.
+// The values which are Cloner are copied and the other values and
+// the jobs are shared with this.
+func (this *Session) fork() *Session {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	rv := &Session{
+		errorLevel:        this.errorLevel,
+		pipeStatus:        this.pipeStatus,
+		pipeSeq:           this.pipeSeq,
+		hook:              this.hook,
+		argsHook:          this.argsHook,
+		onCommandNotFound: this.onCommandNotFound,
+		functions:         this.functions,
+		functionsShared:   true,
+		jobs:              this.jobs,
+		values:            make(map[interface{}]interface{}, len(this.values)),
+		options:           this.options,
+	}
+	this.functionsShared = true
+	for key, value := range this.values {
+		if cloner, ok := value.(Cloner); ok {
+			value = cloner.Clone()
+		}
+		rv.values[key] = value
+	}
+	return rv
+}
+
+// LastErrorLevel returns the errorlevel of the last command line
+// run in foreground.
+func (this *Session) LastErrorLevel() int {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.errorLevel
+}
+
+// SetLastErrorLevel changes the value which %ERRORLEVEL% refers.
+func (this *Session) SetLastErrorLevel(errorlevel int) {
+	this.mutex.Lock()
+	this.errorLevel = errorlevel
+	this.mutex.Unlock()
+}
+
+// LastPipeStatus returns the errorlevels of the stages of the last
+// pipeline run in foreground.
+func (this *Session) LastPipeStatus() []int {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.pipeStatus
+}
+
+func (this *Session) setLastStatus(errorlevel int, statuses []int) {
+	this.mutex.Lock()
+	this.errorLevel = errorlevel
+	this.pipeStatus = statuses
+	this.mutex.Unlock()
+}
+
+// PipeSeq returns the sequence number of the last pipeline.
+func (this *Session) PipeSeq() uint {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.pipeSeq
+}
+
+func (this *Session) nextPipeSeq() uint {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.pipeSeq++
+	return this.pipeSeq
+}
+
+// getenv returns the values of the variables which the session has.
+func (this *Session) getenv(name string) (string, bool) {
+	switch strings.ToUpper(name) {
+	case "ERRORLEVEL":
+		return strconv.Itoa(this.LastErrorLevel()), true
+	case "PIPESTATUS":
+		pipeStatus := this.LastPipeStatus()
+		statuses := make([]string, len(pipeStatus))
+		for i, status := range pipeStatus {
+			statuses[i] = strconv.Itoa(status)
+		}
+		return strings.Join(statuses, " "), true
+	}
+	return "", false
+}
+
+// SetHook sets the hook which runs the aliases and the built-in commands
+// and returns the previous one.
+func (this *Session) SetHook(hook HookT) (rv HookT) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	rv, this.hook = this.hook, hook
+	return
+}
+
+func (this *Session) getHook() HookT {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.hook
+}
+
+// SetArgsHook sets the filter of the arguments and returns the previous one.
+func (this *Session) SetArgsHook(argsHook ArgsHookT) (rv ArgsHookT) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	rv, this.argsHook = this.argsHook, argsHook
+	return
+}
+
+func (this *Session) getArgsHook() ArgsHookT {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.argsHook
+}
+
+// SetOnCommandNotFound sets the function making the error of the command
+// not found and returns the previous one.
+func (this *Session) SetOnCommandNotFound(f func(*Cmd, error) error) (rv func(*Cmd, error) error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	rv, this.onCommandNotFound = this.onCommandNotFound, f
+	return
+}
+
+func (this *Session) getOnCommandNotFound() func(*Cmd, error) error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.onCommandNotFound
+}
+
+// Function returns the shell function `name`.
+func (this *Session) Function(name string) (*FunctionT, bool) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	f, ok := this.functions[strings.ToLower(name)]
+	return f, ok
+}
+
+// SetFunction defines the shell function.
+func (this *Session) SetFunction(f *FunctionT) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if this.functionsShared {
+		functions := make(map[string]*FunctionT, len(this.functions)+1)
+		for name, f1 := range this.functions {
+			functions[name] = f1
+		}
+		this.functions = functions
+		this.functionsShared = false
+	}
+	this.functions[strings.ToLower(f.Name)] = f
+}
+
+// FunctionNames returns the names of the shell functions sorted.
+func (this *Session) FunctionNames() []string {
+	this.mutex.Lock()
+	names := make([]string, 0, len(this.functions))
+	for _, f := range this.functions {
+		names = append(names, f.Name)
+	}
+	this.mutex.Unlock()
+	sort.Strings(names)
+	return names
+}
+
+// Value returns the value which the other packages stored with key.
+// The key should be the value of the type defined in the package
+// as the key of context.WithValue.
+func (this *Session) Value(key interface{}) interface{} {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.values[key]
+}
+
+// SetValue stores value with key.
+func (this *Session) SetValue(key, value interface{}) {
+	this.mutex.Lock()
+	this.values[key] = value
+	this.mutex.Unlock()
+}
+
+// LoadOrStore returns the value stored with key. When there is none,
+// it stores value and returns it.
+func (this *Session) LoadOrStore(key, value interface{}) interface{} {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if value1, ok := this.values[key]; ok {
+		return value1
+	}
+	this.values[key] = value
+	return value
+}
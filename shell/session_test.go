@@ -0,0 +1,136 @@
+package shell
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestSessionParallel(t *testing.T) {
+	for i := 0; i < 4; i++ {
+		name := fmt.Sprintf("session%d", i)
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			var output []string
+			session := NewSession()
+			session.SetHook(func(ctx context.Context, cmd *Cmd) (int, bool, error) {
+				switch cmd.Args[0] {
+				case "exit":
+					n, _ := strconv.Atoi(cmd.Args[1])
+					return n, true, nil
+				case "echo":
+					output = append(output, strings.Join(cmd.Args[1:], " "))
+					return 0, true, nil
+				}
+				return 0, false, nil
+			})
+			it := session.NewCmd()
+			script := fmt.Sprintf("function f {\n echo %s $1\n exit $1\n}\n", name)
+			for j := 0; j < 20; j++ {
+				script += fmt.Sprintf("f %d ; echo =%%ERRORLEVEL%%\nexit 9 | exit %d ; echo =%%ERRORLEVEL%%\n", j, j)
+			}
+			errorlevel, err := it.Interpret(script)
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			if errorlevel != 0 {
+				t.Errorf("errorlevel: %d", errorlevel)
+			}
+			if session.LastErrorLevel() != 0 || session.PipeSeq() < 20 {
+				t.Errorf("session: %d %d", session.LastErrorLevel(), session.PipeSeq())
+			}
+			expect := []string{}
+			for j := 0; j < 20; j++ {
+				expect = append(expect, fmt.Sprintf("%s %d", name, j), fmt.Sprintf("=%d", j), fmt.Sprintf("=%d", j))
+			}
+			if result := strings.Join(output, ","); result != strings.Join(expect, ",") {
+				t.Errorf("output: %s", result)
+			}
+		})
+	}
+}
+
+func TestSessionSubshell(t *testing.T) {
+	var output []string
+	session := NewSession()
+	session.SetHook(func(ctx context.Context, cmd *Cmd) (int, bool, error) {
+		output = append(output, strings.Join(cmd.Args, " "))
+		return 0, true, nil
+	})
+	it := session.NewCmd()
+	_, err := it.Interpret("function f { echo outer ; }\n( function f { echo inner ; }\nf ) ; f")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if result := strings.Join(output, ","); result != "echo inner,echo outer" {
+		t.Errorf("output: %s", result)
+	}
+	if names := session.FunctionNames(); len(names) != 1 || names[0] != "f" {
+		t.Errorf("functions: %v", names)
+	}
+	if names := DefaultSession.FunctionNames(); len(names) != 0 {
+		t.Errorf("DefaultSession: %v", names)
+	}
+
+	// the variables of a session and its subshells have their own locks,
+	// which the scopes of the functions share.
+	other := NewSession().NewCmd()
+	if it.vars.mutex == other.vars.mutex || it.vars.copy().mutex == it.vars.mutex {
+		t.Error("vars: the lock is shared with the others")
+	}
+	if newVariables(it.vars).mutex != it.vars.mutex {
+		t.Error("vars: the scope of the function has another lock")
+	}
+}
+
+func TestSessionOptions(t *testing.T) {
+	session := NewSession()
+	session.SetHook(func(ctx context.Context, cmd *Cmd) (int, bool, error) {
+		cmd.Session().SetPipeFail(true)
+		return 0, true, nil
+	})
+	session.SetXTracePrefix("> ")
+	if _, err := session.NewCmd().Interpret("(pipefail)"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if session.PipeFail() {
+		t.Error("the option set in the subshell is seen")
+	}
+	if _, err := session.NewCmd().Interpret("pipefail"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if !session.PipeFail() {
+		t.Error("the option is not set")
+	}
+	if DefaultSession.PipeFail() || DefaultSession.XTracePrefix() != "+ " {
+		t.Error("the option is seen from the other session")
+	}
+}
+
+type names struct {
+	list []string
+}
+
+func (this *names) Clone() interface{} {
+	return &names{list: append([]string{}, this.list...)}
+}
+
+type namesKey struct{}
+
+func TestSessionCloner(t *testing.T) {
+	session := NewSession()
+	session.SetValue(namesKey{}, &names{list: []string{"outer"}})
+	session.SetHook(func(ctx context.Context, cmd *Cmd) (int, bool, error) {
+		value := cmd.Session().Value(namesKey{}).(*names)
+		value.list = append(value.list, cmd.Args[0])
+		return 0, true, nil
+	})
+	if _, err := session.NewCmd().Interpret("(inner1 ; inner2) ; outer2"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if value := session.Value(namesKey{}).(*names); strings.Join(value.list, " ") != "outer outer2" {
+		t.Errorf("names: %v", value.list)
+	}
+}
@@ -1,63 +1,40 @@
 package shell
 
-import (
-	"bytes"
-	"strings"
-)
-
 const NULQUOTE = '\000'
 
-func quotedWordCutter(reader *strings.Reader) (string, bool) {
-	var buffer bytes.Buffer
-	for {
-		if reader.Len() <= 0 {
-			return "", false
-		}
-		ch, _, _ := reader.ReadRune()
-		if ch != ' ' {
-			reader.UnreadRune()
-			break
-		}
-	}
-	quote := NULQUOTE
-	yenCount := 0
-	for reader.Len() > 0 {
-		ch, _, _ := reader.ReadRune()
-		if yenCount%2 == 0 {
-			if quote == NULQUOTE && (ch == '"' || ch == '\'') {
-				quote = ch
-			} else if quote != NULQUOTE && ch == quote {
-				quote = NULQUOTE
+// splitWords returns the words of line, which are the tokens without
+// spaces between them, as written in line.
+func splitWords(line string, max int) []string {
+	lexer := NewLexer(line)
+	lexer.HistoryMark = 0
+	args := make([]string, 0, 10)
+	start, end := -1, -1
+	for _, token := range lexer.Tokens() {
+		if token.Pos != end {
+			if start >= 0 {
+				args = append(args, line[start:end])
+				if len(args) >= max {
+					return args
+				}
 			}
+			start = token.Pos
 		}
-		if ch == ' ' && quote == NULQUOTE {
-			break
-		}
-		if ch == '\\' {
-			yenCount++
-		} else {
-			yenCount = 0
-		}
-		buffer.WriteRune(ch)
+		end = token.End
 	}
-	return buffer.String(), true
+	if start >= 0 {
+		args = append(args, line[start:end])
+	}
+	return args
 }
 
 // Split s with SPACES not enclosing with double-quotations.
 func SplitQ(line string) []string {
-	args := make([]string, 0, 10)
-	reader := strings.NewReader(line)
-	for reader.Len() > 0 {
-		word, ok := quotedWordCutter(reader)
-		if ok {
-			args = append(args, word)
-		}
-	}
-	return args
+	return splitWords(line, len(line)+1)
 }
 
 func QuotedFirstWord(line string) string {
-	reader := strings.NewReader(line)
-	str, _ := quotedWordCutter(reader)
-	return str
+	if args := splitWords(line, 1); len(args) > 0 {
+		return args[0]
+	}
+	return ""
 }
@@ -0,0 +1,75 @@
+package shell
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// Times is the result of `time`.
+type Times struct {
+	Real time.Duration // the wall time
+	User time.Duration // the user CPU time of the child processes
+	Sys  time.Duration // the kernel CPU time of the child processes
+}
+
+func formatDuration(d time.Duration) string {
+	minutes := d / time.Minute
+	seconds := float64(d%time.Minute) / float64(time.Second)
+	return fmt.Sprintf("%dm%.3fs", minutes, seconds)
+}
+
+func (this Times) String() string {
+	return fmt.Sprintf("real\t%s\nuser\t%s\nsys\t%s\n",
+		formatDuration(this.Real),
+		formatDuration(this.User),
+		formatDuration(this.Sys))
+}
+
+// cpuTimer sums up the CPU times of the processes which end while
+// `time` runs. The times are added to the outer timers too.
+type cpuTimer struct {
+	mutex  sync.Mutex
+	user   time.Duration
+	sys    time.Duration
+	parent *cpuTimer
+}
+
+func (this *cpuTimer) add(state *os.ProcessState) {
+	if state == nil {
+		return
+	}
+	for t := this; t != nil; t = t.parent {
+		t.mutex.Lock()
+		t.user += state.UserTime()
+		t.sys += state.SystemTime()
+		t.mutex.Unlock()
+	}
+}
+
+// measure runs f and returns the times which f takes.
+func (this *Cmd) measure(f func() (int, error)) (Times, int, error) {
+	saved := this.timer
+	timer := &cpuTimer{parent: saved}
+	this.timer = timer
+	start := time.Now()
+	errorlevel, err := f()
+	elapsed := time.Since(start)
+	this.timer = saved
+
+	timer.mutex.Lock()
+	defer timer.mutex.Unlock()
+	return Times{Real: elapsed, User: timer.user, Sys: timer.sys}, errorlevel, err
+}
+
+// runTime runs the pipeline of `time` and prints the times to the
+// standard error even when the pipeline fails.
+func (this *Cmd) runTime(ctx context.Context, node *TimeT) (int, error) {
+	times, errorlevel, err := this.measure(func() (int, error) {
+		return this.run(ctx, node.Node)
+	})
+	fmt.Fprint(this.Stderr, "\n", times)
+	return errorlevel, err
+}
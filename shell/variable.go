@@ -0,0 +1,211 @@
+package shell
+
+import (
+	"errors"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// variable is a shell variable. It is not exported to the child processes.
+type variable struct {
+	name  string
+	value string
+}
+
+// variables is a scope of the shell variables. The key is the upper-cased name.
+// A function call makes a new scope whose parent is the caller's one.
+type variables struct {
+	table   map[string]*variable
+	parent  *variables
+	session *Session      // for %ERRORLEVEL% and %PIPESTATUS%
+	mutex   *sync.RWMutex // shared by the scopes of a session and the commands in background
+}
+
+func newVariables(parent *variables) *variables {
+	this := &variables{table: map[string]*variable{}, parent: parent}
+	if parent != nil {
+		this.session = parent.session
+		this.mutex = parent.mutex
+	} else {
+		this.mutex = new(sync.RWMutex)
+	}
+	return this
+}
+
+// find returns the variable `name` in this scope or the parents.
+// The caller locks this.mutex.
+func (this *variables) find(name string) *variable {
+	key := strings.ToUpper(name)
+	for s := this; s != nil; s = s.parent {
+		if v, ok := s.table[key]; ok {
+			return v
+		}
+	}
+	return nil
+}
+
+// lookup returns the value of the variable `name` and whether it is defined.
+func (this *variables) lookup(name string) (string, bool) {
+	if this == nil {
+		return "", false
+	}
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+	if v := this.find(name); v != nil {
+		return v.value, true
+	}
+	return "", false
+}
+
+// copy returns a new scope which has all the variables visible from this.
+// It has its own lock not to block the session which this belongs to.
+func (this *variables) copy() *variables {
+	rv := newVariables(nil)
+	if this == nil {
+		return rv
+	}
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+	rv.session = this.session
+	var chain []*variables
+	for s := this; s != nil; s = s.parent {
+		chain = append(chain, s)
+	}
+	for i := len(chain) - 1; i >= 0; i-- {
+		for key, v := range chain[i].table {
+			rv.table[key] = &variable{name: v.name, value: v.value}
+		}
+	}
+	return rv
+}
+
+// LookupVar returns the value of the shell variable `name`
+// and whether it is defined.
+func (this *Cmd) LookupVar(name string) (string, bool) {
+	return this.vars.lookup(name)
+}
+
+// SetVar sets the shell variable `name`. When it is defined in
+// a function running, the local one is changed.
+func (this *Cmd) SetVar(name, value string) {
+	if this.vars == nil {
+		this.vars = newVariables(nil)
+		this.vars.session = this.session
+	}
+	this.vars.mutex.Lock()
+	defer this.vars.mutex.Unlock()
+	if v := this.vars.find(name); v != nil {
+		v.value = value
+		return
+	}
+	global := this.vars
+	for global.parent != nil {
+		global = global.parent
+	}
+	global.table[strings.ToUpper(name)] = &variable{name: name, value: value}
+}
+
+// UnsetVar removes the shell variable `name` from the nearest scope
+// which has it.
+func (this *Cmd) UnsetVar(name string) {
+	if this.vars == nil {
+		return
+	}
+	this.vars.mutex.Lock()
+	defer this.vars.mutex.Unlock()
+	this.vars.remove(name)
+}
+
+// remove deletes the variable `name` from the nearest scope which has it.
+// The caller locks this.mutex.
+func (this *variables) remove(name string) {
+	key := strings.ToUpper(name)
+	for s := this; s != nil; s = s.parent {
+		if _, ok := s.table[key]; ok {
+			delete(s.table, key)
+			return
+		}
+	}
+}
+
+// SetLocal defines the shell variable which is removed
+// when the function running ends.
+func (this *Cmd) SetLocal(name, value string) error {
+	if this.frame == nil {
+		return errors.New("local: not in a function")
+	}
+	this.vars.mutex.Lock()
+	defer this.vars.mutex.Unlock()
+	this.vars.table[strings.ToUpper(name)] = &variable{name: name, value: value}
+	return nil
+}
+
+// Export moves the shell variable `name` to the environment variables.
+// It returns false when `name` is not a shell variable.
+func (this *Cmd) Export(name string) bool {
+	if this.vars == nil {
+		return false
+	}
+	this.vars.mutex.Lock()
+	defer this.vars.mutex.Unlock()
+	v := this.vars.find(name)
+	if v == nil {
+		return false
+	}
+	this.vars.remove(name)
+	if v.value == "" {
+		os.Unsetenv(v.name)
+	} else {
+		os.Setenv(v.name, v.value)
+	}
+	return true
+}
+
+// Vars returns the shell variables visible from this as `NAME=VALUE` sorted.
+func (this *Cmd) Vars() []string {
+	all := this.vars.copy()
+	result := make([]string, 0, len(all.table))
+	for _, v := range all.table {
+		result = append(result, v.name+"="+v.value)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// GetEnv returns the value of the shell variable `name` or
+// the environment variable when the shell variable is not defined.
+func (this *Cmd) GetEnv(name string) (string, bool) {
+	return this.vars.getenv(name)
+}
+
+// getenv is OurGetEnv with the shell variables in this.
+// A shell variable whose value is empty hides the environment variable.
+func (this *variables) getenv(name string) (string, bool) {
+	if value, ok := this.lookup(name); ok {
+		return value, value != ""
+	}
+	if this != nil && this.session != nil && os.Getenv(name) == "" {
+		if value, ok := this.session.getenv(name); ok {
+			return value, true
+		}
+	}
+	return OurGetEnv(name)
+}
+
+// assign sets the shell variable `name` when it is defined,
+// otherwise the environment variable.
+func (this *variables) assign(name, value string) {
+	if this == nil {
+		os.Setenv(name, value)
+		return
+	}
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if v := this.find(name); v != nil {
+		v.value = value
+	} else {
+		os.Setenv(name, value)
+	}
+}